@@ -93,6 +93,7 @@ func forceQuitTest() (bool, int, int) {
 
 			time.Sleep(forceQuitFQSleepTime)
 		}
+		recordHops(fmt.Sprintf("force quit round %d", t), nodes[:], nodesInNetwork)
 
 		/* Get all data. */
 		getInfo := testInfo{
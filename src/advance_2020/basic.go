@@ -66,6 +66,7 @@ func basicTest() (bool, int, int) {
 		joinInfo.finish(&basicFailedCnt, &basicTotalCnt)
 
 		time.Sleep(basicTestAfterJoinQuitSleepTime)
+		recordHops(fmt.Sprintf("basic round %d", t), nodes[:], nodesInNetwork)
 
 		/* Put, part 1. */
 		put1Info := testInfo{
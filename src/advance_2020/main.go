@@ -1,6 +1,7 @@
 package main
 
 import (
+	"dhtlog"
 	"flag"
 	"math/rand"
 	"os"
@@ -10,11 +11,18 @@ import (
 var (
 	help     bool
 	testName string
+	logLevel string
+	logJSON  bool
+	hopsPath string
+	hopsFile *os.File
 )
 
 func init() {
 	flag.BoolVar(&help, "help", false, "help")
 	flag.StringVar(&testName, "test", "", "which test(s) do you want to run: basic/advance/all")
+	flag.StringVar(&logLevel, "log", "warn", "node log level: debug/info/warn/error/off")
+	flag.BoolVar(&logJSON, "logjson", false, "write node logs as JSON")
+	flag.StringVar(&hopsPath, "hops", "", "write the path of sampled lookups to this CSV file")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -24,6 +32,20 @@ func init() {
 		os.Exit(0)
 	}
 
+	level, err := dhtlog.ParseLevel(logLevel)
+	if err != nil {
+		flag.Usage()
+		os.Exit(0)
+	}
+	logger = dhtlog.New(os.Stderr, level, logJSON)
+
+	if hopsPath != "" {
+		if hopsFile, err = os.Create(hopsPath); err != nil {
+			_, _ = red.Println("Failed to create", hopsPath, err)
+			os.Exit(0)
+		}
+	}
+
 	rand.Seed(time.Now().UnixNano())
 }
 
@@ -65,6 +65,7 @@ func basicTest() (int, int) {
 		joinInfo.finish(&basicFailedCnt, &basicTotalCnt)
 
 		time.Sleep(time.Second * 10)
+		recordHops(fmt.Sprintf("basic round %d", t), nodes[:], nodesInNetwork)
 
 		/* Put, part 1. */
 		put1Info := testInfo{
@@ -0,0 +1,12 @@
+package main
+
+import "hops"
+
+// recordHops samples the hop distribution of the nodes in the network when -hops is given.
+func recordHops(label string, nodes []dhtNode, inNetwork []int) {
+	if hopsFile == nil {
+		return
+	}
+	hist := hops.Sample(hopsFile, label, len(inNetwork), func(i int) interface{} { return nodes[inNetwork[i]] })
+	_, _ = cyan.Printf("Hop distribution (%s)\n%s", label, hops.Format(hist))
+}
@@ -0,0 +1,90 @@
+package chord
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminEdge is an Edge for JSON, the id is written in hex since a 160-bit number does not fit a JSON number.
+type AdminEdge struct {
+	Ip string `json:"ip"`
+	Id string `json:"id"`
+}
+
+func adminEdge(x Edge) AdminEdge {
+	if x.Ip == "" {
+		return AdminEdge{}
+	}
+	return AdminEdge{x.Ip, x.Id.Text(16)}
+}
+
+// NodeInfo is a snapshot of the routing state and storage of a node.
+type NodeInfo struct {
+	Ip       string      `json:"ip"`
+	Id       string      `json:"id"`
+	On       bool        `json:"on"`
+	Lookup   string      `json:"lookup"`
+	Replicas int         `json:"replicas"` // copies of every key, the owner's included
+	Pre      AdminEdge   `json:"pre"`
+	SucList  []AdminEdge `json:"sucList"`
+	Finger   []AdminEdge `json:"finger"` // finger[i] is the successor of id+2^i
+	Fixing   int         `json:"fixing"` // the finger FixFingers refreshed last
+	Keys     KeyCounts   `json:"keys"`
+}
+
+// KeyCounts are the entries of both stores, tombstones and expired values included.
+type KeyCounts struct {
+	Sto     int `json:"sto"`
+	DataPre int `json:"dataPre"`
+}
+
+// Inspect takes a snapshot of the routing state and storage of this node.
+func (pos *Node) Inspect() NodeInfo {
+	ret := NodeInfo{
+		Ip:       pos.Ip,
+		Id:       pos.id.Text(16),
+		On:       pos.On.Load(),
+		Lookup:   pos.lookup.String(),
+		Replicas: pos.replicas,
+		SucList:  make([]AdminEdge, SucListLen),
+		Finger:   make([]AdminEdge, Len),
+	}
+
+	pos.lock.Lock()
+	ret.Pre = adminEdge(pos.pre)
+	for i := 0; i < SucListLen; i++ {
+		ret.SucList[i] = adminEdge(pos.sucList[i])
+	}
+	for i := 0; i < Len; i++ {
+		ret.Finger[i] = adminEdge(pos.finger[i])
+	}
+	ret.Fixing = pos.fixing
+	pos.lock.Unlock()
+
+	pos.sto.lock.Lock()
+	ret.Keys.Sto = pos.sto.eng.Len()
+	pos.sto.lock.Unlock()
+	pos.dataPre.lock.Lock()
+	ret.Keys.DataPre = pos.dataPre.eng.Len()
+	pos.dataPre.lock.Unlock()
+	return ret
+}
+
+// Admin serves Inspect as JSON, it only answers GET.
+func (pos *Node) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, r, pos.Inspect())
+	})
+}
+
+func serveJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,296 @@
+package chord
+
+import (
+	"crypto/sha1"
+	"dhterr"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// DefaultAntiEntropy is how often an owner compares sto with each replica by default.
+const DefaultAntiEntropy = 5 * time.Second
+
+// the Merkle tree splits the hash space into merkleFanout^merkleDepth leaves by the top bits of hash(key).
+const (
+	merkleFanout = 16
+	merkleBits   = 4 // log2(merkleFanout)
+	merkleDepth  = 3
+)
+
+type MerkleHash [sha1.Size]byte
+
+// merkleTree holds every level of the tree, level 0 is the root and level merkleDepth the leaves.
+// Empty subtrees hash to zero, so a sparse tree compares cheaply.
+type merkleTree [merkleDepth + 1][]MerkleHash
+
+// MerkleArgs names nodes of one level of the tree over the replica of Owner.
+type MerkleArgs struct {
+	Owner string
+	Level int
+	Index []int
+}
+
+// PreVersions are keys of one predecessor, each with the version the replica is known to have.
+type PreVersions struct {
+	Owner Edge
+	Keys  map[string]Version
+}
+
+// AntiEntropyStats counts the keys one round moved, Pushed to replicas, Pulled from them and Dropped on them.
+type AntiEntropyStats struct {
+	Pushed  int
+	Pulled  int
+	Dropped int
+}
+
+func merkleLeaf(key string) int {
+	h := hashStr(key)
+	return int(h.Rsh(h, Len-merkleBits*merkleDepth).Int64())
+}
+
+func buildMerkle(kv map[string]Value) *merkleTree {
+	leaves := make(map[int][]string)
+	for k := range kv {
+		i := merkleLeaf(k)
+		leaves[i] = append(leaves[i], k)
+	}
+
+	var ret merkleTree
+	for level, n := 0, 1; level <= merkleDepth; level, n = level+1, n*merkleFanout {
+		ret[level] = make([]MerkleHash, n)
+	}
+	var buf [8]byte
+	for i, keys := range leaves {
+		sort.Strings(keys)
+		h := sha1.New()
+		for _, k := range keys {
+			v := kv[k]
+			binary.BigEndian.PutUint64(buf[:], uint64(v.Ver.Time))
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write(buf[:])
+			h.Write([]byte(v.Ver.Writer))
+			h.Write([]byte{0})
+			if v.Deleted {
+				h.Write([]byte{1})
+			} else {
+				h.Write([]byte{0})
+			}
+		}
+		copy(ret[merkleDepth][i][:], h.Sum(nil))
+	}
+	for level := merkleDepth - 1; level >= 0; level-- {
+		for i := range ret[level] {
+			children := ret[level+1][i*merkleFanout : (i+1)*merkleFanout]
+			empty := true
+			h := sha1.New()
+			for _, c := range children {
+				empty = empty && c == MerkleHash{}
+				h.Write(c[:])
+			}
+			if !empty {
+				copy(ret[level][i][:], h.Sum(nil))
+			}
+		}
+	}
+	return &ret
+}
+
+// preDataOf is the part of dataPre owned by ip.
+func (pos *Node) preDataOf(ip string) map[string]Value {
+	ret := make(map[string]Value)
+	pos.dataPre.lock.Lock()
+	for k, owner := range pos.preKeys {
+		if owner == ip {
+			ret[k], _ = pos.dataPre.eng.Get(k)
+		}
+	}
+	pos.dataPre.lock.Unlock()
+	return ret
+}
+
+// MerkleHashes answers the hashes of the tree over the replica of args.Owner a successor keeps.
+func (pos *Node) MerkleHashes(args MerkleArgs, ret *[]MerkleHash) error {
+	if args.Level < 0 || args.Level > merkleDepth {
+		return dhterr.New("MerkleHashes", "", dhterr.ErrBadArgument)
+	}
+	tree := buildMerkle(pos.preDataOf(args.Owner))
+	*ret = make([]MerkleHash, 0, len(args.Index))
+	for _, i := range args.Index {
+		if i < 0 || i >= len(tree[args.Level]) {
+			return dhterr.New("MerkleHashes", "", dhterr.ErrBadArgument)
+		}
+		*ret = append(*ret, tree[args.Level][i])
+	}
+	return nil
+}
+
+// MerkleLeaves answers the replica of args.Owner in the leaves args.Index.
+func (pos *Node) MerkleLeaves(args MerkleArgs, ret *map[string]Value) error {
+	want := make(map[int]bool, len(args.Index))
+	for _, i := range args.Index {
+		want[i] = true
+	}
+	*ret = make(map[string]Value)
+	for k, v := range pos.preDataOf(args.Owner) {
+		if want[merkleLeaf(k)] {
+			(*ret)[k] = v
+		}
+	}
+	return nil
+}
+
+// DropDataPreKeys forgets keys of a predecessor it no longer has, a key written since the versions were read is kept.
+func (pos *Node) DropDataPreKeys(dat PreVersions) {
+	pos.dataPre.lock.Lock()
+	for k, ver := range dat.Keys {
+		if pos.preKeys[k] != dat.Owner.Ip {
+			continue
+		}
+		if v, ok := pos.dataPre.eng.Get(k); ok && v.Ver == ver {
+			_ = pos.dataPre.eng.Delete(k)
+			delete(pos.preKeys, k)
+		}
+	}
+	pos.dataPre.lock.Unlock()
+}
+
+// antiEntropy compares sto with every replica when the period is up, see AntiEntropy.
+func (pos *Node) antiEntropy() {
+	now := time.Now()
+	if pos.antiEntropyPeriod < 0 || now.Sub(pos.lastAntiEntropy) < pos.antiEntropyPeriod {
+		return
+	}
+	pos.lastAntiEntropy = now
+	_, _ = pos.AntiEntropy()
+}
+
+// AntiEntropy runs one round of anti-entropy with every replica target. The Merkle trees over sto and over the
+// replica are compared top down and only the keys of differing leaves are sent. The newer version of a key wins
+// on both sides, keys the owner does not have are dropped from the replica.
+// Replicas that could not be repaired are reported by the first error, the others are still visited.
+func (pos *Node) AntiEntropy() (AntiEntropyStats, error) {
+	var ret AntiEntropyStats
+	var err error
+	for _, ip := range pos.replicaTargets() {
+		stats, e := pos.syncReplica(ip)
+		ret.Pushed += stats.Pushed
+		ret.Pulled += stats.Pulled
+		ret.Dropped += stats.Dropped
+		pos.metrics.antiEntropy.Inc(result(e))
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	pos.metrics.antiEntropyKeys.Add(float64(ret.Pushed), "push")
+	pos.metrics.antiEntropyKeys.Add(float64(ret.Pulled), "pull")
+	pos.metrics.antiEntropyKeys.Add(float64(ret.Dropped), "drop")
+	return ret, err
+}
+
+// syncReplica makes the replica of sto on ip agree with sto.
+func (pos *Node) syncReplica(ip string) (AntiEntropyStats, error) {
+	var ret AntiEntropyStats
+	client := pos.dial(ip)
+	if client == nil {
+		return ret, pos.fail(dhterr.New("AntiEntropy", ip, dhterr.ErrDial))
+	}
+	defer client.Close()
+
+	own := pos.sto.copy()
+	tree := buildMerkle(own)
+	diff := []int{0}
+	for level := 0; ; level++ {
+		var remote []MerkleHash
+		if err := client.Call("RPCNode.MerkleHashes", &MerkleArgs{pos.Ip, level, diff}, &remote); err != nil {
+			return ret, pos.fail(dhterr.FromRPC("AntiEntropy", ip, err))
+		}
+		if len(remote) != len(diff) {
+			return ret, pos.fail(dhterr.New("AntiEntropy", ip, dhterr.ErrBadArgument))
+		}
+		var next []int
+		for j, i := range diff {
+			if remote[j] == tree[level][i] {
+				continue
+			}
+			if level == merkleDepth {
+				next = append(next, i)
+				continue
+			}
+			for c := 0; c < merkleFanout; c++ {
+				next = append(next, i*merkleFanout+c)
+			}
+		}
+		diff = next
+		if len(diff) == 0 {
+			return ret, nil
+		}
+		if level == merkleDepth {
+			break
+		}
+	}
+
+	var copied map[string]Value
+	if err := client.Call("RPCNode.MerkleLeaves", &MerkleArgs{pos.Ip, merkleDepth, diff}, &copied); err != nil {
+		return ret, pos.fail(dhterr.FromRPC("AntiEntropy", ip, err))
+	}
+	leaves := make(map[int]bool, len(diff))
+	for _, i := range diff {
+		leaves[i] = true
+	}
+	now := time.Now().UnixNano()
+	push := make(map[string]Value)
+	pull := make(map[string]Value)
+	for k, v := range own {
+		if !leaves[merkleLeaf(k)] || !v.Deleted && !v.live(now) {
+			continue
+		}
+		if c, ok := copied[k]; !ok || v.Ver.Newer(c.Ver) {
+			push[k] = v
+		}
+	}
+	drop := make(map[string]Version)
+	for k, c := range copied {
+		if v, ok := own[k]; !ok {
+			drop[k] = c.Ver
+		} else if c.Ver.Newer(v.Ver) {
+			pull[k] = c
+		}
+	}
+
+	self := Edge{pos.Ip, pos.id}
+	if len(push) > 0 {
+		if err := client.Call("RPCNode.InsertDataPreBatch", &PreData{self, push}, nil); err != nil {
+			return ret, pos.fail(dhterr.FromRPC("AntiEntropy", ip, err))
+		}
+		ret.Pushed = len(push)
+	}
+	if len(pull) > 0 {
+		pos.sto.lock.Lock()
+		for k, v := range pull {
+			pos.witness(v.Ver)
+			if _, err := pos.sto.merge(k, v); err != nil {
+				pos.sto.lock.Unlock()
+				return ret, pos.fail(dhterr.Wrap("AntiEntropy", "", dhterr.ErrStorage, err))
+			}
+		}
+		pos.sto.lock.Unlock()
+		ret.Pulled = len(pull)
+	}
+	if len(drop) > 0 {
+		// a key written here since the copy was taken stays on the replica
+		pos.sto.lock.Lock()
+		for k := range drop {
+			if _, ok := pos.sto.eng.Get(k); ok {
+				delete(drop, k)
+			}
+		}
+		pos.sto.lock.Unlock()
+		if err := client.Call("RPCNode.DropDataPreKeys", &PreVersions{self, drop}, nil); err != nil {
+			return ret, pos.fail(dhterr.FromRPC("AntiEntropy", ip, err))
+		}
+		ret.Dropped = len(drop)
+	}
+	return ret, nil
+}
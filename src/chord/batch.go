@@ -0,0 +1,275 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"errors"
+	"math/big"
+	"net/rpc"
+	"time"
+)
+
+type BatchOp int
+
+const (
+	BatchPut BatchOp = iota
+	BatchGet
+	BatchDelete
+)
+
+// BatchArgs carries the keys of one owner, Val is only read for BatchPut.
+// W is the write quorum of the whole batch, see InsertKeyValQuorum, the W of every KeyValue is not read.
+type BatchArgs struct {
+	Op  BatchOp
+	KVs []KeyValue
+	W   int
+}
+
+// BatchReply holds one value and one error text per key, an empty text is success.
+// Errors travel as text since net/rpc can not send error values, the "error(N)::" prefix keeps their kind.
+type BatchReply struct {
+	Vals []string
+	Errs []string
+}
+
+// BatchInside applies a batch of keys this node owns, the replicas get one batch as well.
+// A key this node no longer owns fails with ErrNotOwner naming its predecessor, which took it in a join.
+// The write quorum is reported for every key written, since they are applied whether it is reached or not.
+func (pos *Node) BatchInside(args BatchArgs, ret *BatchReply) error {
+	if err := pos.checkQuorum("BatchInside", args.W); err != nil {
+		return err
+	}
+	ret.Vals = make([]string, len(args.KVs))
+	ret.Errs = make([]string, len(args.KVs))
+	changed := make(map[string]Value)
+	var written []int
+	now := time.Now().UnixNano()
+	pre := pos.predecessor()
+
+	pos.sto.lock.Lock()
+	for i, kv := range args.KVs {
+		if pre.Ip != "" && !inRange(&pre.Id, &pos.id, hashStr(kv.Key)) {
+			ret.Errs[i] = dhterr.New("BatchInside", pre.Ip, dhterr.ErrNotOwner).Error()
+			continue
+		}
+		var err error
+		switch args.Op {
+		case BatchGet:
+			if val, ok := pos.sto.eng.Get(kv.Key); ok && val.live(now) {
+				ret.Vals[i] = val.Val
+			} else {
+				err = dhterr.New("BatchInside", "", dhterr.ErrNotFound)
+			}
+		case BatchPut:
+			val := Value{Val: kv.Val, Ver: pos.tick()}
+			if kv.TTL > 0 {
+				val.Expire = val.Ver.Time + int64(kv.TTL)
+			}
+			if err = pos.sto.eng.Put(kv.Key, val); err == nil {
+				changed[kv.Key] = val
+				written = append(written, i)
+			} else {
+				err = dhterr.Wrap("BatchInside", "", dhterr.ErrStorage, err)
+			}
+		case BatchDelete:
+			if old, ok := pos.sto.eng.Get(kv.Key); !ok || !old.live(now) {
+				err = dhterr.New("BatchInside", "", dhterr.ErrNotFound)
+				break
+			}
+			tomb := Value{Ver: pos.tick(), Deleted: true}
+			if err = pos.sto.eng.Put(kv.Key, tomb); err == nil {
+				changed[kv.Key] = tomb
+				written = append(written, i)
+			} else {
+				err = dhterr.Wrap("BatchInside", "", dhterr.ErrStorage, err)
+			}
+		default:
+			err = dhterr.New("BatchInside", "", dhterr.ErrBadArgument)
+		}
+		if err != nil {
+			ret.Errs[i] = err.Error()
+		}
+	}
+	pos.sto.lock.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	// for force quit
+	var err error
+	if pos.FixList() != nil {
+		err = pos.fail(dhterr.New("BatchInside", "", dhterr.ErrAllSuccessorsFailed))
+	} else {
+		err = pos.replicateWrite("BatchInside", "RPCNode.InsertDataPreBatch", &PreData{Edge{pos.Ip, pos.id}, changed}, args.W)
+	}
+	if err != nil {
+		for _, i := range written {
+			ret.Errs[i] = err.Error()
+		}
+	}
+	return nil
+}
+
+// InsertDataPreBatch stores a batch of writes of one predecessor, the rest of its replica is kept.
+func (pos *Node) InsertDataPreBatch(dat PreData) {
+	pos.dataPre.lock.Lock()
+	for k, v := range dat.Data {
+		pos.witness(v.Ver)
+		if changed, _ := pos.dataPre.merge(k, v); changed {
+			pos.preKeys[k] = dat.Owner.Ip
+		}
+	}
+	pos.preOwners[dat.Owner.Ip] = dat.Owner
+	pos.dataPre.lock.Unlock()
+}
+
+// groupByOwner resolves the owner of every key. A lookup is only made for keys outside the ranges already known,
+// the range of an owner is learned from its predecessor. Keys whose lookup fails get their error in errs.
+func (pos *Node) groupByOwner(ctx context.Context, op string, keys []string, errs []error) map[string][]int {
+	groups := make(map[string][]int)
+	hashes := make([]*big.Int, len(keys))
+	for i, key := range keys {
+		hashes[i] = hashStr(key)
+	}
+	done := make([]bool, len(keys))
+
+	for i := range keys {
+		if done[i] {
+			continue
+		}
+		done[i] = true
+		var owner Edge
+		if err := pos.FindSuccessorContext(ctx, hashes[i], &owner); err != nil {
+			errs[i] = pos.fail(dhterr.Wrap(op, "", dhterr.ErrLookup, err))
+			continue
+		}
+		groups[owner.Ip] = append(groups[owner.Ip], i)
+
+		client := pos.dialContext(ctx, owner.Ip)
+		if client == nil {
+			continue
+		}
+		var pre Edge
+		err := client.CallContext(ctx, "RPCNode.GetPredecessor", 0, &pre)
+		_ = client.Close()
+		if err != nil || pre.Ip == "" {
+			continue
+		}
+		for j := i + 1; j < len(keys); j++ {
+			if !done[j] && inRange(&pre.Id, &owner.Id, hashes[j]) {
+				done[j] = true
+				groups[owner.Ip] = append(groups[owner.Ip], j)
+			}
+		}
+	}
+	return groups
+}
+
+// batch sends one BatchInside per owner and spreads the replies back over the keys.
+// Keys an owner turned away with ErrNotOwner moved in a join, they are looked up and sent once more.
+func (pos *Node) batch(ctx context.Context, op string, bop BatchOp, kvs []KeyValue) ([]string, []error) {
+	vals := make([]string, len(kvs))
+	errs := make([]error, len(kvs))
+	todo := make([]int, len(kvs))
+	for i := range kvs {
+		todo[i] = i
+	}
+	pos.sendBatch(ctx, op, bop, kvs, todo, vals, errs)
+
+	var moved []int
+	for i, err := range errs {
+		if errors.Is(err, dhterr.ErrNotOwner) {
+			moved = append(moved, i)
+		}
+	}
+	if len(moved) > 0 {
+		pos.sendBatch(ctx, op, bop, kvs, moved, vals, errs)
+	}
+	return vals, errs
+}
+
+// sendBatch is one round of batch for the keys of kvs listed in todo.
+func (pos *Node) sendBatch(ctx context.Context, op string, bop BatchOp, kvs []KeyValue, todo []int, vals []string, errs []error) {
+	keys := make([]string, len(todo))
+	lookupErrs := make([]error, len(todo))
+	for k, i := range todo {
+		keys[k] = kvs[i].Key
+	}
+	groups := pos.groupByOwner(ctx, op, keys, lookupErrs)
+	for k, i := range todo {
+		errs[i] = lookupErrs[k]
+	}
+
+	for ip, idx := range groups {
+		args := BatchArgs{Op: bop, KVs: make([]KeyValue, len(idx)), W: pos.writeQuorum}
+		for k, j := range idx {
+			idx[k] = todo[j]
+			args.KVs[k] = kvs[todo[j]]
+		}
+
+		var reply BatchReply
+		var err error
+		client := pos.dialContext(ctx, ip)
+		if client == nil {
+			err = pos.fail(dhterr.FromContext(ctx, op, ip, dhterr.ErrDial))
+		} else {
+			err = client.CallContext(ctx, "RPCNode.BatchInside", &args, &reply)
+			_ = client.Close()
+			if err != nil {
+				err = pos.fail(dhterr.FromRPC(op, ip, err))
+			} else if len(reply.Errs) != len(idx) || len(reply.Vals) != len(idx) {
+				err = pos.fail(dhterr.New(op, ip, dhterr.ErrRPC))
+			}
+		}
+
+		for k, i := range idx {
+			if err != nil {
+				errs[i] = err
+			} else if reply.Errs[k] != "" {
+				errs[i] = dhterr.FromRPC(op, ip, rpc.ServerError(reply.Errs[k]))
+			} else {
+				vals[i] = reply.Vals[k]
+			}
+		}
+	}
+}
+
+// MultiPut stores every pair with one RPC per owner, errs[i] is the result of kvs[i].
+func (pos *Node) MultiPut(kvs []KeyValue) []error {
+	return pos.MultiPutContext(context.Background(), kvs)
+}
+
+// MultiPutContext is MultiPut giving up when ctx is done.
+func (pos *Node) MultiPutContext(ctx context.Context, kvs []KeyValue) []error {
+	_, errs := pos.batch(ctx, "MultiPut", BatchPut, kvs)
+	return errs
+}
+
+// MultiGet reads every key with one RPC per owner, a missing key gets ErrNotFound in errs.
+func (pos *Node) MultiGet(keys []string) ([]string, []error) {
+	return pos.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is MultiGet giving up when ctx is done.
+func (pos *Node) MultiGetContext(ctx context.Context, keys []string) ([]string, []error) {
+	kvs := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		kvs[i].Key = key
+	}
+	return pos.batch(ctx, "MultiGet", BatchGet, kvs)
+}
+
+// MultiDelete erases every key with one RPC per owner, a missing key gets ErrNotFound in errs.
+func (pos *Node) MultiDelete(keys []string) []error {
+	return pos.MultiDeleteContext(context.Background(), keys)
+}
+
+// MultiDeleteContext is MultiDelete giving up when ctx is done.
+func (pos *Node) MultiDeleteContext(ctx context.Context, keys []string) []error {
+	kvs := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		kvs[i].Key = key
+	}
+	_, errs := pos.batch(ctx, "MultiDelete", BatchDelete, kvs)
+	return errs
+}
@@ -0,0 +1,340 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"fmt"
+	"io"
+	"math/big"
+	"rpcpool"
+	"sort"
+	"strings"
+)
+
+// maxCheckedRing stops CheckRing on a successor chain that never comes back.
+const maxCheckedRing = 1 << 14
+
+type ViolationKind string
+
+const (
+	ViolationUnreachable ViolationKind = "unreachable"  // a successor list names a node that does not answer
+	ViolationNoSuccessor ViolationKind = "no-successor" // no entry of the successor list answers
+	ViolationOpen        ViolationKind = "open"         // the successors do not lead back to the start
+	ViolationPredecessor ViolationKind = "predecessor"  // the successor of a node names another node as its predecessor
+	ViolationOrder       ViolationKind = "order"        // a node of the ring lies between a node and its successor
+	ViolationOutside     ViolationKind = "outside"      // a node others route to answers but is not on the ring
+	ViolationPlacement   ViolationKind = "placement"    // a key is not kept by FindSuccessor(hash(key))
+	ViolationReplica     ViolationKind = "replica"      // the dataPre copy of a replica differs from the sto of its owner
+)
+
+// Violation is one inconsistency CheckRing found. Key is only set for placement and replica violations.
+type Violation struct {
+	Kind   ViolationKind
+	Node   string
+	Key    string
+	Detail string
+}
+
+func (pos Violation) String() string {
+	ret := string(pos.Kind) + " " + pos.Node
+	if pos.Key != "" {
+		ret += " key " + pos.Key
+	}
+	return ret + ": " + pos.Detail
+}
+
+// RingReport is what CheckRing saw. Ring lists the nodes from the start along the successors,
+// Closed tells whether the last one leads back to the start.
+type RingReport struct {
+	Ring       []NodeInfo
+	Closed     bool
+	Violations []Violation
+}
+
+// CheckRing crawls the ring from start along the successor lists and reports where it is inconsistent.
+// It checks that every successor names its node as predecessor, that the successors come back to start in
+// id order, that every key is kept by FindSuccessor(hash(key)) and that the replicas mirror the sto of
+// their owner. The ring keeps changing meanwhile, so a violation seen once may be a write or join in flight.
+// An error is only returned when start itself can not be inspected.
+func CheckRing(ctx context.Context, dial rpcpool.DialFunc, start string) (*RingReport, error) {
+	pool := rpcpool.New(dial, rpcpool.Options{})
+	defer pool.Close()
+	c := &checker{ctx: ctx, pool: pool, start: start, ret: new(RingReport)}
+
+	first, err := c.info(start)
+	if err != nil {
+		return nil, err
+	}
+	c.crawl(first)
+	c.checkOrder()
+	c.checkOutside()
+	c.checkData()
+	return c.ret, nil
+}
+
+type checker struct {
+	ctx   context.Context
+	pool  *rpcpool.Pool
+	start string
+	ret   *RingReport
+}
+
+func (pos *checker) call(op string, ip string, method string, args interface{}, reply interface{}) error {
+	client, err := pos.pool.GetContext(pos.ctx, ip)
+	if err != nil {
+		return dhterr.FromContext(pos.ctx, op, ip, dhterr.ErrDial)
+	}
+	err = client.CallContext(pos.ctx, method, args, reply)
+	_ = client.Close()
+	if err != nil {
+		return dhterr.FromRPC(op, ip, err)
+	}
+	return nil
+}
+
+func (pos *checker) info(ip string) (NodeInfo, error) {
+	var ret NodeInfo
+	err := pos.call("CheckRing", ip, "RPCNode.Info", 0, &ret)
+	return ret, err
+}
+
+func (pos *checker) report(kind ViolationKind, node string, key string, format string, a ...interface{}) {
+	pos.ret.Violations = append(pos.ret.Violations, Violation{kind, node, key, fmt.Sprintf(format, a...)})
+}
+
+// crawl follows the first successor that answers until the start comes round again.
+func (pos *checker) crawl(cur NodeInfo) {
+	seen := make(map[string]bool)
+	for {
+		pos.ret.Ring = append(pos.ret.Ring, cur)
+		seen[cur.Ip] = true
+
+		var next NodeInfo
+		found := false
+		for _, x := range cur.SucList {
+			if x.Ip == "" {
+				continue
+			}
+			if x.Ip == cur.Ip {
+				next, found = cur, true
+				break
+			}
+			info, err := pos.info(x.Ip)
+			if err == nil {
+				next, found = info, true
+				break
+			}
+			if pos.ctx.Err() != nil {
+				return
+			}
+			pos.report(ViolationUnreachable, cur.Ip, "", "successor %s: %v", x.Ip, err)
+		}
+		if !found {
+			pos.report(ViolationNoSuccessor, cur.Ip, "", "none of the %d successors answers", SucListLen)
+			return
+		}
+
+		if next.Pre.Ip != cur.Ip {
+			pos.report(ViolationPredecessor, next.Ip, "", "predecessor is %q, but %s names it as successor", next.Pre.Ip, cur.Ip)
+		}
+		switch {
+		case next.Ip == pos.start:
+			pos.ret.Closed = true
+			return
+		case seen[next.Ip]:
+			pos.report(ViolationOpen, cur.Ip, "", "successor %s was visited before, the ring does not come back to %s", next.Ip, pos.start)
+			return
+		case len(pos.ret.Ring) >= maxCheckedRing:
+			pos.report(ViolationOpen, cur.Ip, "", "gave up after %d nodes without coming back to %s", maxCheckedRing, pos.start)
+			return
+		}
+		cur = next
+	}
+}
+
+// checkOrder compares every successor crawled with the next node of the ring by id.
+func (pos *checker) checkOrder() {
+	ring := pos.ret.Ring
+	if len(ring) < 2 {
+		return
+	}
+	sorted := make([]NodeInfo, len(ring))
+	copy(sorted, ring)
+	sort.Slice(sorted, func(i, j int) bool {
+		return hexID(sorted[i].Id).Cmp(hexID(sorted[j].Id)) < 0
+	})
+	expect := make(map[string]string, len(sorted))
+	for i, x := range sorted {
+		expect[x.Ip] = sorted[(i+1)%len(sorted)].Ip
+	}
+	for i := 0; i+1 < len(ring); i++ {
+		if want := expect[ring[i].Ip]; ring[i+1].Ip != want {
+			pos.report(ViolationOrder, ring[i].Ip, "", "successor is %s, but %s lies between them", ring[i+1].Ip, want)
+		}
+	}
+}
+
+// checkOutside inspects the nodes the ring routes to without them being on it.
+func (pos *checker) checkOutside() {
+	on := make(map[string]bool, len(pos.ret.Ring))
+	for _, x := range pos.ret.Ring {
+		on[x.Ip] = true
+	}
+	known := make(map[string]string)
+	for _, x := range pos.ret.Ring {
+		for _, e := range append([]AdminEdge{x.Pre}, x.Finger...) {
+			if e.Ip != "" && !on[e.Ip] && known[e.Ip] == "" {
+				known[e.Ip] = x.Ip
+			}
+		}
+	}
+	ips := make([]string, 0, len(known))
+	for ip := range known {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		if _, err := pos.info(ip); err == nil {
+			pos.report(ViolationOutside, ip, "", "answers and %s routes to it, but it is not on the ring", known[ip])
+		}
+	}
+}
+
+// checkData asks the ring for the owner of every key and compares each replica with its owner.
+func (pos *checker) checkData() {
+	sto := make(map[string]map[string]Value, len(pos.ret.Ring))
+	pre := make(map[string]map[string]PreData, len(pos.ret.Ring))
+	for _, x := range pos.ret.Ring {
+		var dat map[string]Value
+		if err := pos.call("CheckRing", x.Ip, "RPCNode.GetData", 0, &dat); err != nil {
+			pos.report(ViolationUnreachable, x.Ip, "", "reading sto: %v", err)
+			continue
+		}
+		sto[x.Ip] = dat
+		var groups []PreData
+		if err := pos.call("CheckRing", x.Ip, "RPCNode.GetDataPre", 0, &groups); err != nil {
+			pos.report(ViolationUnreachable, x.Ip, "", "reading dataPre: %v", err)
+			continue
+		}
+		pre[x.Ip] = make(map[string]PreData, len(groups))
+		for _, g := range groups {
+			pre[x.Ip][g.Owner.Ip] = g
+		}
+	}
+
+	for _, x := range pos.ret.Ring {
+		for _, k := range sortedKeys(sto[x.Ip]) {
+			var owner Edge
+			if err := pos.call("CheckRing", pos.start, "RPCNode.FindSuccessor", hashStr(k), &owner); err != nil {
+				pos.report(ViolationPlacement, x.Ip, k, "FindSuccessor from %s: %v", pos.start, err)
+				continue
+			}
+			if owner.Ip != x.Ip {
+				pos.report(ViolationPlacement, x.Ip, k, "kept here, but FindSuccessor gives %s", owner.Ip)
+			}
+		}
+	}
+
+	for _, x := range pos.ret.Ring {
+		own, ok := sto[x.Ip]
+		if !ok {
+			continue
+		}
+		for _, ip := range replicaIps(x) {
+			groups, ok := pre[ip]
+			if !ok {
+				continue
+			}
+			copied := groups[x.Ip].Data
+			for _, k := range sortedKeys(own) {
+				v := own[k]
+				c, ok := copied[k]
+				switch {
+				case !ok:
+					pos.report(ViolationReplica, ip, k, "missing from the replica of %s", x.Ip)
+				case c.Ver != v.Ver || c.Deleted != v.Deleted:
+					pos.report(ViolationReplica, ip, k, "replica of %s has version %d by %s, the owner %d by %s", x.Ip, c.Ver.Time, c.Ver.Writer, v.Ver.Time, v.Ver.Writer)
+				}
+			}
+			for _, k := range sortedKeys(copied) {
+				if _, ok := own[k]; !ok {
+					pos.report(ViolationReplica, ip, k, "kept in the replica of %s, which does not have it", x.Ip)
+				}
+			}
+		}
+	}
+}
+
+// replicaIps are the successors x replicates its sto to, picked the same way as replicaTargets.
+func replicaIps(x NodeInfo) []string {
+	ret := make([]string, 0, x.Replicas-1)
+	seen := map[string]bool{"": true, hostOf(x.Ip): true}
+	for i := 0; i < len(x.SucList) && len(ret) < x.Replicas-1; i++ {
+		ip := x.SucList[i].Ip
+		if host := hostOf(ip); ip != "" && !seen[host] {
+			seen[host] = true
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+func sortedKeys(mp map[string]Value) []string {
+	ret := make([]string, 0, len(mp))
+	for k := range mp {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func hexID(s string) *big.Int {
+	ret, _ := new(big.Int).SetString(s, 16)
+	if ret == nil {
+		ret = new(big.Int)
+	}
+	return ret
+}
+
+// WriteDOT draws the ring for Graphviz: successors solid, predecessors dashed, fingers dotted and
+// nodes with a violation red. Fingers pointing at the same node are drawn once, labelled with the first index.
+func (pos *RingReport) WriteDOT(w io.Writer) error {
+	bad := make(map[string]bool)
+	for _, v := range pos.Violations {
+		bad[v.Node] = true
+	}
+	var b strings.Builder
+	b.WriteString("digraph chord {\n\tlayout=circo;\n\tnode [shape=box, fontname=monospace];\n")
+	for _, x := range pos.Ring {
+		id := x.Id
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		color := "black"
+		if bad[x.Ip] {
+			color = "red"
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q, color=%s];\n", x.Ip, fmt.Sprintf("%s\n%s\nsto %d, dataPre %d", x.Ip, id, x.Keys.Sto, x.Keys.DataPre), color)
+	}
+	for i, x := range pos.Ring {
+		if i+1 < len(pos.Ring) {
+			fmt.Fprintf(&b, "\t%q -> %q [label=suc];\n", x.Ip, pos.Ring[i+1].Ip)
+		} else if pos.Closed {
+			fmt.Fprintf(&b, "\t%q -> %q [label=suc];\n", x.Ip, pos.Ring[0].Ip)
+		}
+		if x.Pre.Ip != "" {
+			fmt.Fprintf(&b, "\t%q -> %q [style=dashed, color=gray, label=pre];\n", x.Ip, x.Pre.Ip)
+		}
+		drawn := map[string]bool{x.Ip: true}
+		for j, f := range x.Finger {
+			if f.Ip == "" || drawn[f.Ip] {
+				continue
+			}
+			drawn[f.Ip] = true
+			fmt.Fprintf(&b, "\t%q -> %q [style=dotted, color=blue, label=\"f%d\"];\n", x.Ip, f.Ip, j)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -1,10 +1,16 @@
 package chord
 
 import (
+	"context"
+	"dhterr"
+	"dhtlog"
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
+	"rpcpool"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,11 +25,6 @@ type Edge struct {
 	Id big.Int
 }
 
-type Storage struct {
-	data map[string]string
-	lock sync.Mutex // for multithreading
-}
-
 type Node struct {
 	finger  [Len]Edge
 	pre     Edge
@@ -31,20 +32,183 @@ type Node struct {
 	fixing  int
 	lock    sync.Mutex
 
-	sto     Storage
-	dataPre Storage
+	sto       Storage
+	strays    map[string]bool   // keys restored from the engine not yet checked against the predecessor, guarded by sto.lock
+	dataPre   Storage           // replicas of the keys owned by predecessors
+	preKeys   map[string]string // key -> ip of its owner, guarded by dataPre.lock
+	preOwners map[string]Edge   // predecessors dataPre holds keys for, guarded by dataPre.lock
+
+	replicas    int
+	lookup      LookupMode
+	readRepair  bool
+	readQuorum  int
+	writeQuorum int
+	repTargets  []string // successors sto was last replicated to
+	repDirty    bool
+	repLock     sync.Mutex
+
+	hints       map[string]map[string]Value // ip -> writes its replica missed, see hint
+	hintCount   int
+	hintLock    sync.Mutex
+	lastHandOff time.Time
 
 	Ip     string
 	id     big.Int
-	On     bool // 1 for on
-	inited bool
+	On     atomic.Bool // true while the node is running, Maintain stops when it is cleared
+	inited atomic.Bool
+
+	clock     int64 // last version time made or seen, see tick
+	lastSweep time.Time
+
+	antiEntropyPeriod time.Duration
+	lastAntiEntropy   time.Time
+
+	trans       Transport
+	keys        rpcpool.Keys
+	pool        *rpcpool.Pool
+	log         *dhtlog.Logger
+	metrics     *nodeMetrics
+	metricsAddr string
+	adminAddr   string
+}
+
+// Config holds the optional parts of a node, zero values fall back to the defaults.
+type Config struct {
+	Transport   Transport      // TCPTransport if nil
+	Logger      *dhtlog.Logger // dhtlog.Default() if nil
+	Replicas    int            // copies of every key including the owner's, DefaultReplicas if 0
+	Engine      Engine         // keeps the keys this node owns, a MemoryEngine if nil
+	Lookup      LookupMode     // how FindSuccessor walks the ring, LookupRecursive if zero
+	MetricsAddr string         // TCP address Serve offers /metrics on, none if empty
+	AdminAddr   string         // TCP address Serve offers the read-only /admin on, none if empty, may equal MetricsAddr
+	AntiEntropy time.Duration  // how often sto is compared with every replica, DefaultAntiEntropy if 0, never if negative
+	ReadRepair  bool           // reads compare the owner with its replicas and fix the copies that differ
+	WriteQuorum int            // copies a write waits for, the owner's included, see InsertKeyValQuorum
+	ReadQuorum  int            // copies a read compares, the owner's included, see QueryQuorum
+	PeerKey     []byte         // shared by the nodes of the ring, every RPC is authenticated when set, see Serve
+	ClientKey   []byte         // lets clients call ClientNode alone, only used together with PeerKey
 }
 
 func (pos *Node) Init(_ip string) {
+	pos.InitWithConfig(_ip, Config{})
+}
+
+func (pos *Node) InitWithConfig(_ip string, cfg Config) {
 	pos.Ip = _ip
 	pos.id = *hashStr(pos.Ip)
-	pos.sto.data = make(map[string]string)
-	pos.inited = false
+	pos.sto.eng = cfg.Engine
+	if pos.sto.eng == nil {
+		pos.sto.eng = NewMemoryEngine()
+	}
+	pos.dataPre.eng = NewMemoryEngine()
+	pos.preKeys = make(map[string]string)
+	pos.preOwners = make(map[string]Edge)
+	pos.hints = make(map[string]map[string]Value)
+	pos.inited.Store(false)
+
+	pos.lookup = cfg.Lookup
+	pos.readRepair = cfg.ReadRepair
+	pos.antiEntropyPeriod = cfg.AntiEntropy
+	if pos.antiEntropyPeriod == 0 {
+		pos.antiEntropyPeriod = DefaultAntiEntropy
+	}
+	pos.replicas = cfg.Replicas
+	if pos.replicas <= 0 {
+		pos.replicas = DefaultReplicas
+	}
+	if pos.replicas > SucListLen+1 {
+		pos.replicas = SucListLen + 1
+	}
+	pos.writeQuorum = pos.clampQuorum(cfg.WriteQuorum)
+	pos.readQuorum = pos.clampQuorum(cfg.ReadQuorum)
+
+	pos.trans = cfg.Transport
+	if pos.trans == nil {
+		pos.trans = TCPTransport{}
+	}
+	pos.metrics = newNodeMetrics(pos)
+	pos.metricsAddr = cfg.MetricsAddr
+	pos.adminAddr = cfg.AdminAddr
+	pos.keys = rpcpool.Keys{Peer: cfg.PeerKey, Client: cfg.ClientKey}
+	pos.pool = rpcpool.New(pos.peerDial(), rpcpool.Options{
+		Check:      checkClient,
+		Observe:    observer(pos.metrics.issued, pos.metrics.issuedSeconds),
+		DialFailed: func(string) { pos.metrics.dialFailures.Inc() },
+	})
+
+	pos.log = cfg.Logger
+	if pos.log == nil {
+		pos.log = dhtlog.Default()
+	}
+	pos.log = pos.log.With("node", pos.Ip).With("id", shortID(&pos.id))
+}
+
+// Listen opens the listener the RPC server of this node should accept on.
+// Closing it also drops the connections other nodes keep pooled to this node.
+func (pos *Node) Listen() (net.Listener, error) {
+	listen, err := pos.trans.Listen(pos.Ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpcpool.Track(listen), nil
+}
+
+// Ping checks whether ip is alive through the transport of this node.
+func (pos *Node) Ping(ip string) error {
+	client := pos.dial(ip)
+	if client == nil {
+		return dhterr.New("Ping", ip, dhterr.ErrDial)
+	}
+	var id big.Int
+	err := client.Call("RPCNode.GetID", 0, &id)
+	_ = client.Close()
+	if err != nil {
+		pos.pool.Invalidate(ip)
+		return dhterr.New("Ping", ip, dhterr.ErrDial)
+	}
+	return nil
+}
+
+// fail logs err together with the operation and peer it carries, then returns it.
+func (pos *Node) fail(err error, kv ...interface{}) error {
+	var e *dhterr.Error
+	if !errors.As(err, &e) {
+		pos.log.Warn("", err.Error(), kv...)
+		return err
+	}
+	if e.Addr != "" {
+		kv = append(kv, "peer", e.Addr)
+	}
+	if e.Remote != "" {
+		kv = append(kv, "remote", e.Remote)
+	} else if e.Err != nil {
+		kv = append(kv, "cause", e.Err)
+	}
+	pos.log.Warn(e.Op, e.Kind.Error(), kv...)
+	return err
+}
+
+// successor is sucList[0] read under the lock.
+func (pos *Node) successor() Edge {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	return pos.sucList[0]
+}
+
+// predecessor is pre read under the lock, its Ip is empty while there is none.
+func (pos *Node) predecessor() Edge {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	return pos.pre
+}
+
+// return pooled client to a given IP, nil when failed. Close gives it back to the pool.
+func (pos *Node) dial(ip string) *rpcpool.Client {
+	client, err := pos.pool.Get(ip)
+	if err != nil {
+		return nil
+	}
+	return client
 }
 
 func (pos *Node) GetID(_ *int, ret *big.Int) error {
@@ -64,7 +228,7 @@ func (pos *Node) ClosestPrecedingNode(id *big.Int) Edge {
 		}
 		if inRange(&pos.id, id, &pos.finger[i].Id) {
 			ret := pos.finger[i]
-			if Ping(ret.Ip) == nil {
+			if pos.Ping(ret.Ip) == nil {
 				pos.lock.Unlock()
 				return ret
 			} else {
@@ -80,217 +244,217 @@ func (pos *Node) ClosestPrecedingNode(id *big.Int) Edge {
 
 // return node ip for a query key.
 func (pos *Node) FindSuccessor(h *big.Int, ret *Edge) error {
-	if pos.FixList() != nil {
-		fmt.Print("Error(5):: All Successor has Failed.\n")
-		return errors.New("error(5):: All Successor has Failed")
+	return pos.FindSuccessorContext(context.Background(), h, ret)
+}
+
+// FindSuccessorContext is FindSuccessor giving up when ctx is done, a recursive lookup hands what is left of the deadline on to every hop.
+func (pos *Node) FindSuccessorContext(ctx context.Context, h *big.Int, ret *Edge) error {
+	start := time.Now()
+	if pos.lookup == LookupIterative {
+		var trace LookupTrace // the path is walked here anyway, keeping it gives the hop count
+		err := pos.findSuccessorIterative(ctx, h, ret, &trace)
+		pos.observeLookup(start, err, &trace)
+		return err
 	}
-	pos.lock.Lock()
-	client := Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
+	err := pos.findSuccessor(ctx, h, ret, nil)
+	pos.observeLookup(start, err, nil)
+	return err
+}
 
+// answerLookup serves a lookup handed on by another node, it is not counted as a lookup of this node.
+func (pos *Node) answerLookup(ctx context.Context, h *big.Int, ret *Edge) error {
+	if pos.lookup == LookupIterative {
+		return pos.findSuccessorIterative(ctx, h, ret, nil)
+	}
+	return pos.findSuccessor(ctx, h, ret, nil)
+}
+
+// observeLookup counts a lookup started at start, the hops are only known when trace is not nil.
+func (pos *Node) observeLookup(start time.Time, err error, trace *LookupTrace) {
+	pos.metrics.lookupSeconds.Observe(time.Since(start).Seconds(), pos.lookup.String(), result(err))
+	if trace != nil && err == nil {
+		pos.metrics.lookupHops.Observe(float64(trace.HopCount()), pos.lookup.String())
+	}
+}
+
+// findSuccessor is the recursive lookup, the hops after this node are appended to trace unless it is nil.
+func (pos *Node) findSuccessor(ctx context.Context, h *big.Int, ret *Edge, trace *LookupTrace) error {
+	if err := ctx.Err(); err != nil {
+		return pos.fail(dhterr.Wrap("FindSuccessor", "", dhterr.ErrCanceled, err))
+	}
+	if pos.FixList() != nil {
+		return pos.fail(dhterr.New("FindSuccessor", "", dhterr.ErrAllSuccessorsFailed))
+	}
+	suc := pos.successor()
+	client := pos.dialContext(ctx, suc.Ip)
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(91)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.FromContext(ctx, "FindSuccessor", suc.Ip, dhterr.ErrDial))
 	}
 	var sucID big.Int
-	err := client.Call("RPCNode.GetID", 0, &sucID)
+	err := client.CallContext(ctx, "RPCNode.GetID", 0, &sucID)
 	_ = client.Close()
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(99)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.FromRPC("FindSuccessor", suc.Ip, err))
 	}
 
 	if inRange(&pos.id, &sucID, h) {
-		*ret = pos.sucList[0]
+		*ret = suc
 		return nil
 	}
 
 	nxt := pos.ClosestPrecedingNode(h)
 	if nxt.Ip == "" && inRange(&pos.id, h, &sucID) { // chain query
-		nxt = pos.sucList[0]
+		nxt = suc
 	}
 
 	if nxt.Ip == "" { // failed
-		fmt.Print("Error(3):: Unable to Find Successor\n")
-		return errors.New("error(3):: Unable to Find Successor")
+		return pos.fail(dhterr.New("FindSuccessor", "", dhterr.ErrLookup))
 	}
 
-	client = Dial(nxt.Ip)
+	client = pos.dialContext(ctx, nxt.Ip)
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(119)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.FromContext(ctx, "FindSuccessor", nxt.Ip, dhterr.ErrDial))
 	}
+	pos.metrics.forwarded.Inc()
 
-	err = client.Call("RPCNode.FindSuccessor", h, ret)
+	if trace == nil {
+		var next Edge // a call given up may still write its reply
+		if err = client.CallContext(ctx, "RPCNode.FindSuccessorWithin", lookupArgs(ctx, h), &next); err == nil {
+			*ret = next
+		}
+	} else {
+		start := time.Now()
+		var next LookupTrace
+		err = client.CallContext(ctx, "RPCNode.TraceSuccessor", lookupArgs(ctx, h), &next)
+		if err != nil {
+			trace.Hops = append(trace.Hops, newHop(nxt, start, err))
+		} else {
+			trace.Hops = append(trace.Hops, next.Hops...)
+			*ret = next.Result
+		}
+	}
 	_ = client.Close()
 
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(128)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.FromRPC("FindSuccessor", nxt.Ip, err))
 	}
 
 	return nil
 }
 
-func (pos *Node) QueryInside(key string, ret *string) error {
-	var value string
+func (pos *Node) QueryInside(key string, ret *Value) error {
+	var value Value
 	var ok bool
 
 	pos.sto.lock.Lock()
-	value, ok = pos.sto.data[key]
+	value, ok = pos.sto.eng.Get(key)
 	pos.sto.lock.Unlock()
 
-	if ok {
+	if ok && value.live(time.Now().UnixNano()) {
 		*ret = value
 	} else {
-		return errors.New("error(0):: Value Not Found")
+		return dhterr.New("QueryInside", "", dhterr.ErrNotFound)
 	}
 	return nil
 }
 
 func (pos *Node) QueryVal(key string, ret *string) error {
-	var temp Edge
-	err := pos.FindSuccessor(hashStr(key), &temp) // fail when findNode returns node which does not store key.
-	if err != nil {
-		fmt.Print("Error(3):: Unable to Find Node for Query\n")
-		return errors.New("error(3):: Unable to Find Node for Query")
-	}
-
-	ip := temp.Ip
-	client := Dial(ip)
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(162)\n")
-		return errors.New("error(1):: Dial Connect Failure")
-	}
-
-	err = client.Call("RPCNode.QueryInside", key, &ret)
-	_ = client.Close()
+	return pos.QueryValContext(context.Background(), key, ret)
+}
 
+// QueryValContext is QueryVal giving up when ctx is done.
+func (pos *Node) QueryValContext(ctx context.Context, key string, ret *string) error {
+	var value Value
+	err := pos.QueryVersionedContext(ctx, key, &value)
 	if err != nil {
-		if err.Error() == "error(0):: Value Not Found" {
-			return err
-		}
-		fmt.Print("Error(2):: RPC Calling Failure.(173)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return err
 	}
-
+	*ret = value.Val
 	return nil
 }
 
+// QueryVersioned is QueryVal that also gives the version of the value.
+func (pos *Node) QueryVersioned(key string, ret *Value) error {
+	return pos.QueryVersionedContext(context.Background(), key, ret)
+}
+
+// QueryVersionedContext is QueryVersioned giving up when ctx is done.
+func (pos *Node) QueryVersionedContext(ctx context.Context, key string, ret *Value) error {
+	return pos.QueryQuorum(ctx, key, pos.readQuorum, ret)
+}
+
 type KeyValue struct {
 	Key string
 	Val string
+	TTL time.Duration // 0 keeps the key until it is erased
+	W   int           // write quorum, see InsertKeyValQuorum
 }
 
 func (pos *Node) EraseInside(key string, _ *int) error {
+	return pos.eraseInside(key, 0)
+}
+
+func (pos *Node) eraseInside(key string, w int) error {
+	if err := pos.checkQuorum("EraseInside", w); err != nil {
+		return err
+	}
 	pos.sto.lock.Lock()
-	if _, ok := pos.sto.data[key]; !ok {
+	if old, ok := pos.sto.eng.Get(key); !ok || !old.live(time.Now().UnixNano()) {
 		pos.sto.lock.Unlock()
-		fmt.Print("Error(0):: Value Not Found.\n")
-		return errors.New("error(0):: Value Not Found")
+		return pos.fail(dhterr.New("EraseInside", "", dhterr.ErrNotFound))
 	}
-	delete(pos.sto.data, key)
+	tomb := Value{Ver: pos.tick(), Deleted: true}
+	err := pos.sto.eng.Put(key, tomb)
 	pos.sto.lock.Unlock()
+	if err != nil {
+		return pos.fail(dhterr.Wrap("EraseInside", "", dhterr.ErrStorage, err))
+	}
 
 	// for force quit
 	if pos.FixList() != nil {
-		fmt.Print("Error(5):: All Successor has Failed.\n")
-		return errors.New("error(5):: All Successor has Failed")
-	}
-	pos.lock.Lock()
-	client := Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
-
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(205)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.New("EraseInside", "", dhterr.ErrAllSuccessorsFailed))
 	}
-
-	err := client.Call("RPCNode.RemoveDataPre", key, nil)
-	_ = client.Close()
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(212)\n")
-		return errors.New("error(2):: RPC Calling Failure")
-	}
-
-	return nil
+	return pos.replicateWrite("EraseInside", "RPCNode.InsertDataPre", &PreKeyValue{Edge{pos.Ip, pos.id}, key, tomb}, w)
 }
 
 func (pos *Node) EraseKey(key string) error {
-	var temp Edge
-	err := pos.FindSuccessor(hashStr(key), &temp)
-	if err != nil {
-		fmt.Print("Error(3):: Unable to Find Node for Insert.\n")
-		return errors.New("error(3):: Unable to Find Node for Insert")
-	}
-
-	ip := temp.Ip
-	client := Dial(ip)
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(230)\n")
-		return errors.New("error(1):: Dial Connect Failure")
-	}
-	err = client.Call("RPCNode.EraseInside", key, nil)
-	_ = client.Close()
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(236)\n")
-		return errors.New("error(2):: RPC Calling Failure")
-	}
+	return pos.EraseKeyContext(context.Background(), key)
+}
 
-	return nil
+// EraseKeyContext is EraseKey giving up when ctx is done.
+func (pos *Node) EraseKeyContext(ctx context.Context, key string) error {
+	return pos.EraseKeyQuorum(ctx, key, pos.writeQuorum)
 }
 
 func (pos *Node) InsertInside(kv KeyValue, _ *int) error {
+	if err := pos.checkQuorum("InsertInside", kv.W); err != nil {
+		return err
+	}
+	val := Value{Val: kv.Val, Ver: pos.tick()}
+	if kv.TTL > 0 {
+		val.Expire = val.Ver.Time + int64(kv.TTL)
+	}
 	pos.sto.lock.Lock()
-	pos.sto.data[kv.Key] = kv.Val
+	err := pos.sto.eng.Put(kv.Key, val)
 	pos.sto.lock.Unlock()
+	if err != nil {
+		return pos.fail(dhterr.Wrap("InsertInside", "", dhterr.ErrStorage, err))
+	}
 
 	// for force quit
 	if pos.FixList() != nil {
-		fmt.Print("Error(5):: All Successor has Failed.\n")
-		return errors.New("error(5):: All Successor has Failed")
+		return pos.fail(dhterr.New("InsertInside", "", dhterr.ErrAllSuccessorsFailed))
 	}
-	pos.lock.Lock()
-	client := Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
-
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(259)\n")
-		return errors.New("error(1):: Dial Connect Failure")
-	}
-
-	err := client.Call("RPCNode.InsertDataPre", kv, nil)
-	_ = client.Close()
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(265)\n")
-		return errors.New("error(2):: RPC Calling Failure")
-	}
-
-	return nil
+	return pos.replicateWrite("InsertInside", "RPCNode.InsertDataPre", &PreKeyValue{Edge{pos.Ip, pos.id}, kv.Key, val}, kv.W)
 }
 
 func (pos *Node) InsertKeyVal(key string, val string) error {
-	var temp Edge
-	err := pos.FindSuccessor(hashStr(key), &temp)
-	if err != nil {
-		fmt.Print("Error(3):: Unable to Find Node for Insert.\n")
-		return errors.New("error(3):: Unable to Find Node for Insert")
-	}
-
-	ip := temp.Ip
-	client := Dial(ip)
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(284)\n")
-		return errors.New("error(1):: Dial Connect Failure")
-	}
-	err = client.Call("RPCNode.InsertInside", KeyValue{key, val}, nil)
-	_ = client.Close()
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(289)\n")
-		return errors.New("error(2):: RPC Calling Failure")
-	}
+	return pos.InsertKeyValContext(context.Background(), key, val)
+}
 
-	return nil
+// InsertKeyValContext is InsertKeyVal giving up when ctx is done.
+func (pos *Node) InsertKeyValContext(ctx context.Context, key string, val string) error {
+	return pos.InsertKeyValQuorum(ctx, key, val, pos.writeQuorum)
 }
 
 func (pos *Node) CreateNetwork() error {
@@ -302,55 +466,81 @@ func (pos *Node) CreateNetwork() error {
 	}
 	pos.lock.Unlock()
 
-	pos.inited = true
+	pos.inited.Store(true)
 	return nil
 }
 
-func (pos *Node) MoveDataToPre(pr *big.Int, ret *map[string]string) error {
+func (pos *Node) MoveDataToPre(pr *Edge, ret *map[string]Value) error {
 	pos.sto.lock.Lock()
 	pos.dataPre.lock.Lock()
-	for k, v := range pos.sto.data {
-		if !inRange(pr, &pos.id, hashStr(k)) {
+	pos.sto.eng.Range(func(k string, v Value) bool {
+		if !inRange(&pr.Id, &pos.id, hashStr(k)) {
 			(*ret)[k] = v
 		}
+		return true
+	})
+	var err error
+	for k, v := range *ret {
+		_ = pos.dataPre.eng.Put(k, v)
+		pos.preKeys[k] = pr.Ip
+		if err == nil {
+			err = pos.sto.eng.Delete(k)
+		}
 	}
-	for k := range *ret {
-		pos.dataPre.data[k] = pos.sto.data[k]
-		delete(pos.sto.data, k)
-	}
+	pos.preOwners[pr.Ip] = *pr
 	pos.sto.lock.Unlock()
 	pos.dataPre.lock.Unlock()
+
+	pos.markDirty()
+	if err != nil {
+		return pos.fail(dhterr.Wrap("MoveDataToPre", "", dhterr.ErrStorage, err))
+	}
 	return nil
 }
 
-func (pos *Node) MoveDataFromPre(dat map[string]string, _ *int) error {
+func (pos *Node) MoveDataFromPre(dat PreData, _ *int) error {
+	var err error
 	pos.sto.lock.Lock()
 
-	for k, v := range dat {
-		pos.sto.data[k] = v
+	for k, v := range dat.Data {
+		pos.witness(v.Ver)
+		if _, err = pos.sto.merge(k, v); err != nil {
+			break
+		}
 	}
 
 	pos.sto.lock.Unlock()
+
+	if err != nil {
+		return pos.fail(dhterr.Wrap("MoveDataFromPre", "", dhterr.ErrStorage, err))
+	}
+	pos.DropDataPre(dat.Owner)
+	pos.markDirty()
 	return nil
 }
 
 func (pos *Node) JoinNetwork(ip string) error {
+	return pos.JoinNetworkContext(context.Background(), ip)
+}
+
+// JoinNetworkContext is JoinNetwork giving up when ctx is done.
+func (pos *Node) JoinNetworkContext(ctx context.Context, ip string) error {
+	restored := pos.sto.copy() // left in the engine by an earlier run
+
 	pos.lock.Lock()
-	client := Dial(ip)
+	client := pos.dialContext(ctx, ip)
 	pos.lock.Unlock()
 
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(341)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.FromContext(ctx, "JoinNetwork", ip, dhterr.ErrDial))
 	}
 
 	var ret Edge
 
-	err := client.Call("RPCNode.FindSuccessor", &pos.id, &ret)
+	err := client.CallContext(ctx, "RPCNode.FindSuccessorWithin", lookupArgs(ctx, &pos.id), &ret)
 	if err != nil {
 		_ = client.Close()
-		fmt.Print("Error(2):: RPC Calling Failure.(352)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.FromRPC("JoinNetwork", ip, err))
 	}
 
 	_ = pos.insertSuc(ret)
@@ -359,33 +549,40 @@ func (pos *Node) JoinNetwork(ip string) error {
 		t.Add(&pos.id, powTwo(int64(i)))
 		t.Mod(&t, mod)
 		var temp Edge
-		_ = pos.FindSuccessor(&t, &temp)
+		_ = pos.FindSuccessorContext(ctx, &t, &temp)
 
 		pos.lock.Lock()
 		pos.finger[i] = temp
 		pos.lock.Unlock()
 	}
 
-	pos.lock.Lock()
 	_ = client.Close()
-	client = Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
-
-	temp := make(map[string]string)
-	err = client.Call("RPCNode.MoveDataToPre", &pos.id, &temp)
+	suc := pos.successor()
+	client = pos.dialContext(ctx, suc.Ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "JoinNetwork", suc.Ip, dhterr.ErrDial))
+	}
+	temp := make(map[string]Value)
+	err = client.CallContext(ctx, "RPCNode.MoveDataToPre", &Edge{pos.Ip, pos.id}, &temp)
 	_ = client.Close()
 
+	if err != nil {
+		return pos.fail(dhterr.FromRPC("JoinNetwork", suc.Ip, err))
+	}
+
+	kept, pushed := pos.splitRestored(restored, temp, &suc.Id)
+
 	pos.sto.lock.Lock()
-	pos.sto.data = temp
+	err = pos.sto.replace(kept)
 	pos.sto.lock.Unlock()
+	pos.markDirty()
 
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(383)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.Wrap("JoinNetwork", "", dhterr.ErrStorage, err))
 	}
 
-	pos.inited = true
-	return nil
+	pos.inited.Store(true)
+	return pos.restore(pushed)
 }
 
 func (pos *Node) GetPredecessor(_ *int, ret *Edge) error {
@@ -395,46 +592,59 @@ func (pos *Node) GetPredecessor(_ *int, ret *Edge) error {
 	return nil
 }
 
+// Notify offers x as the predecessor of this node.
 func (pos *Node) Notify(x Edge, _ *int) error {
-	if pos.pre.Ip == "" {
-		pos.lock.Lock()
+	err := pos.notify(x)
+	outcome := "ignored"
+	pos.lock.Lock()
+	if err != nil {
+		outcome = "error"
+	} else if pos.pre.Ip == x.Ip {
+		outcome = "accepted"
+	}
+	pos.lock.Unlock()
+	pos.metrics.notify.Inc(outcome)
+	return err
+}
+
+func (pos *Node) notify(x Edge) error {
+	pos.lock.Lock()
+	pre := pos.pre
+	if pre.Ip == "" {
 		pos.pre = x
-		pos.lock.Unlock()
+	}
+	pos.lock.Unlock()
+
+	if pre.Ip == "" {
 
 		// for force quit
-		client := Dial(x.Ip)
+		client := pos.dial(x.Ip)
 		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(397)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.New("Notify", x.Ip, dhterr.ErrDial))
 		}
 
-		var temp map[string]string
+		var temp map[string]Value
 		err := client.Call("RPCNode.GetData", 0, &temp)
 		_ = client.Close()
 
 		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(416)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+			return pos.fail(dhterr.FromRPC("Notify", x.Ip, err))
 		}
 
-		pos.FillDataPre(temp)
+		pos.FillDataPre(PreData{x, temp})
+		go pos.handOffStrays(x)
 
 	} else {
-		pos.lock.Lock()
-		client := Dial(pos.pre.Ip)
-		pos.lock.Unlock()
-
+		client := pos.dial(pre.Ip)
 		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(418)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.New("Notify", pre.Ip, dhterr.ErrDial))
 		}
 
 		var preID big.Int
 		err := client.Call("RPCNode.GetID", 0, &preID)
 		_ = client.Close()
 		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(436)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+			return pos.fail(dhterr.FromRPC("Notify", pre.Ip, err))
 		}
 
 		if inRange(&preID, &pos.id, &x.Id) {
@@ -443,22 +653,21 @@ func (pos *Node) Notify(x Edge, _ *int) error {
 			pos.lock.Unlock()
 
 			// for force quit
-			client := Dial(x.Ip)
+			client := pos.dial(x.Ip)
 			if client == nil {
-				fmt.Print("Error(1):: Dial Connect Failure.(438)\n")
-				return errors.New("error(1):: Dial Connect Failure")
+				return pos.fail(dhterr.New("Notify", x.Ip, dhterr.ErrDial))
 			}
 
-			var temp map[string]string
+			var temp map[string]Value
 			err := client.Call("RPCNode.GetData", 0, &temp)
 			_ = client.Close()
 
 			if err != nil {
-				fmt.Print("Error(2):: RPC Calling Failure.(457)\n")
-				return errors.New("error(2):: RPC Calling Failure")
+				return pos.fail(dhterr.FromRPC("Notify", x.Ip, err))
 			}
 
-			pos.FillDataPre(temp)
+			pos.FillDataPre(PreData{x, temp})
+			go pos.handOffStrays(x)
 		}
 
 	}
@@ -467,27 +676,30 @@ func (pos *Node) Notify(x Edge, _ *int) error {
 }
 
 func (pos *Node) Stabilize() error {
+	err := pos.stabilize()
+	pos.metrics.stabilize.Inc(result(err))
+	return err
+}
+
+func (pos *Node) stabilize() error {
 	if pos.FixList() != nil {
-		fmt.Print("Error(5):: All Successor has Failed.\n")
-		return errors.New("error(5):: All Successor has Failed")
+		return pos.fail(dhterr.New("Stabilize", "", dhterr.ErrAllSuccessorsFailed))
 	}
-	pos.lock.Lock()
-	client := Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
-
+	suc := pos.successor()
+	client := pos.dial(suc.Ip)
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(469)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.New("Stabilize", suc.Ip, dhterr.ErrDial))
 	}
 
 	var ret Edge
 	err := client.Call("RPCNode.GetPredecessor", 0, &ret)
 	if err != nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(476)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		_ = client.Close()
+		return pos.fail(dhterr.FromRPC("Stabilize", suc.Ip, err))
 	}
 
-	if Ping(ret.Ip) != nil { // nil pre
+	if pos.Ping(ret.Ip) != nil { // nil pre
+		_ = client.Close()
 		return nil
 	}
 
@@ -495,47 +707,44 @@ func (pos *Node) Stabilize() error {
 	err = client.Call("RPCNode.GetID", 0, &sucID)
 	_ = client.Close()
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(498)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.FromRPC("Stabilize", suc.Ip, err))
 	}
 
 	if inRange(&pos.id, &sucID, &ret.Id) {
 		_ = pos.insertSuc(ret)
 	}
 
-	pos.lock.Lock()
-	client = Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
-
+	suc = pos.successor()
+	client = pos.dial(suc.Ip)
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(502)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.New("Stabilize", suc.Ip, dhterr.ErrDial))
 	}
 	err = client.Call("RPCNode.Notify", &Edge{pos.Ip, pos.id}, nil)
 	_ = client.Close()
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(517)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		return pos.fail(dhterr.FromRPC("Stabilize", suc.Ip, err))
 	}
 
 	return nil
 }
 
 func (pos *Node) FixFingers() error {
+	pos.lock.Lock() // Inspect reads fixing
 	pos.fixing = (pos.fixing + 1) % Len
+	fixing := pos.fixing
+	pos.lock.Unlock()
 
 	var adder big.Int
 	var ret Edge
 
-	err := pos.FindSuccessor(adder.Add(&pos.id, powTwo(int64(pos.fixing))), &ret)
+	err := pos.FindSuccessor(adder.Add(&pos.id, powTwo(int64(fixing))), &ret)
 
 	if err != nil {
-		fmt.Print("Error(3):: Unable to Find Successor.\n")
-		return errors.New("error(3):: Unable to Find Successor")
+		return pos.fail(dhterr.Wrap("FixFingers", "", dhterr.ErrLookup, err))
 	}
 
 	pos.lock.Lock()
-	pos.finger[pos.fixing] = ret
+	pos.finger[fixing] = ret
 	pos.lock.Unlock()
 
 	return nil
@@ -546,35 +755,20 @@ func (pos *Node) CheckPredecessor() error {
 	pip := pos.pre.Ip
 	pos.lock.Unlock()
 
-	if pip != "" && Ping(pip) != nil {
+	if pip != "" && pos.Ping(pip) != nil {
 		pos.MergeDataPre()
 
 		if pos.FixList() != nil {
-			fmt.Print("Error(5):: All Successor has Failed.\n")
-			return errors.New("error(5):: All Successor has Failed")
-		}
-		pos.lock.Lock()
-		client := Dial(pos.sucList[0].Ip)
-		pos.lock.Unlock()
-
-		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(555)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.New("CheckPredecessor", "", dhterr.ErrAllSuccessorsFailed))
 		}
-
-		pos.sto.lock.Lock()
-		temp := pos.sto.data
-		pos.sto.lock.Unlock()
-
-		err := client.Call("RPCNode.FillDataPre", temp, nil)
-		_ = client.Close()
-
-		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(573)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+		pos.markDirty()
+		if err := pos.replicate(); err != nil {
+			return err
 		}
 
+		pos.lock.Lock()
 		pos.pre.Ip = ""
+		pos.lock.Unlock()
 	}
 
 	return nil
@@ -586,10 +780,9 @@ func (pos *Node) MaintainSuccessorList() error {
 	pos.lock.Unlock()
 
 	if pip != "" && pip != pos.Ip {
-		client := Dial(pip)
+		client := pos.dial(pip)
 		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(584)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.New("MaintainSuccessorList", pip, dhterr.ErrDial))
 		}
 
 		var temp [SucListLen]Edge
@@ -603,8 +796,7 @@ func (pos *Node) MaintainSuccessorList() error {
 		_ = client.Close()
 
 		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(606)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+			return pos.fail(dhterr.FromRPC("MaintainSuccessorList", pip, err))
 		}
 
 	}
@@ -612,11 +804,15 @@ func (pos *Node) MaintainSuccessorList() error {
 }
 
 func (pos *Node) Maintain() {
-	for pos.On {
-		if pos.inited {
+	for pos.On.Load() {
+		if pos.inited.Load() {
 			_ = pos.CheckPredecessor()
 			_ = pos.Stabilize()
 			_ = pos.MaintainSuccessorList()
+			_ = pos.replicate()
+			pos.handOffHints()
+			pos.antiEntropy()
+			pos.sweep()
 		}
 		time.Sleep(maintainPeriod)
 	}
@@ -626,25 +822,28 @@ func (pos *Node) FixList() error {
 	pos.lock.Lock()
 	p := -1
 	for i := 0; i < SucListLen; i++ {
-		if Ping(pos.sucList[i].Ip) == nil {
+		if pos.Ping(pos.sucList[i].Ip) == nil {
 			p = i
 			break
 		}
 	}
 	if p == -1 {
-		pos.lock.Unlock()
-		fmt.Print("Pos = ", pos.Ip, " sucList = ")
+		ips := make([]string, SucListLen)
 		for i := 0; i < SucListLen; i++ {
-			fmt.Print(pos.sucList[i].Ip, " ")
+			ips[i] = pos.sucList[i].Ip
 		}
-		fmt.Print("\n")
-		return errors.New("error(5):: All Successor has Failed")
+		pos.lock.Unlock()
+		return pos.fail(dhterr.New("FixList", "", dhterr.ErrAllSuccessorsFailed), "sucList", ips)
 	} else {
 		var bak Edge
 		if p != -1 {
 			bak = pos.sucList[p]
 		}
 		flag := p != 0
+		if flag {
+			pos.metrics.repairs.Inc()
+			pos.metrics.dropped.Add(float64(p))
+		}
 
 		for i := 0; p < SucListLen; {
 			pos.sucList[i] = pos.sucList[p]
@@ -655,10 +854,9 @@ func (pos *Node) FixList() error {
 
 		if flag {
 			time.Sleep(maintainPeriod * 6 / 5) // wait for suc do mergeDataPre First.
-			client := Dial(bak.Ip)
+			client := pos.dial(bak.Ip)
 			if client == nil {
-				fmt.Print("Error(1):: Dial Connect Failure.(639)\n")
-				return errors.New("error(1):: Dial Connect Failure")
+				return pos.fail(dhterr.New("FixList", bak.Ip, dhterr.ErrDial))
 			}
 
 			// Notify.
@@ -666,8 +864,7 @@ func (pos *Node) FixList() error {
 			_ = client.Close()
 
 			if err != nil {
-				fmt.Print("Error(2):: RPC Calling Failure.(669)\n")
-				return errors.New("error(2):: RPC Calling Failure")
+				return pos.fail(dhterr.FromRPC("FixList", bak.Ip, err))
 			}
 		}
 		return nil
@@ -688,110 +885,78 @@ func (pos *Node) insertSuc(newSuc Edge) error {
 	pos.lock.Unlock()
 
 	// for force quit
-	client := Dial(newSuc.Ip)
-	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(678)\n")
-		return errors.New("error(1):: Dial Connect Failure")
-	}
-
-	pos.sto.lock.Lock()
-	temp := pos.sto.data
-	pos.sto.lock.Unlock()
-
-	err := client.Call("RPCNode.FillDataPre", temp, nil)
-	_ = client.Close()
-
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(705)\n")
-		return errors.New("error(2):: RPC Calling Failure")
-	}
-	return nil
+	return pos.replicate()
 }
 
 func (pos *Node) Quit() error {
+	return pos.QuitContext(context.Background())
+}
+
+// QuitContext is Quit giving up when ctx is done, the data not handed over yet stays with the replicas.
+func (pos *Node) QuitContext(ctx context.Context) error {
 	if pos.FixList() != nil {
-		fmt.Print("Error(5):: All Successor has Failed.\n")
-		return errors.New("error(5):: All Successor has Failed")
+		return pos.fail(dhterr.New("Quit", "", dhterr.ErrAllSuccessorsFailed))
 	}
 
-	if pos.sucList[0].Ip == pos.Ip { // self-ring
+	suc := pos.successor()
+	if suc.Ip == pos.Ip { // self-ring
 		return nil
 	}
 
-	pos.lock.Lock()
-	client := Dial(pos.sucList[0].Ip)
-	pos.lock.Unlock()
+	client := pos.dialContext(ctx, suc.Ip)
 
 	if client == nil {
-		fmt.Print("Error(1):: Dial Connect Failure.(673)\n")
-		return errors.New("error(1):: Dial Connect Failure")
+		return pos.fail(dhterr.FromContext(ctx, "Quit", suc.Ip, dhterr.ErrDial))
 	}
 
 	// move data
-	pos.sto.lock.Lock()
-	temp := pos.sto.data
-	pos.sto.lock.Unlock()
-	err := client.Call("RPCNode.MoveDataFromPre", temp, nil)
+	temp := PreData{Edge{pos.Ip, pos.id}, pos.sto.copy()}
+	err := client.CallContext(ctx, "RPCNode.MoveDataFromPre", &temp, nil)
 
 	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(737)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+		_ = client.Close()
+		return pos.fail(dhterr.FromRPC("Quit", suc.Ip, err))
 	}
 
-	// for force quit
-	pos.dataPre.lock.Lock()
-	temp2 := pos.dataPre.data
-	pos.dataPre.lock.Unlock()
-
-	err = client.Call("RPCNode.FillDataPre", temp2, nil)
-	_ = client.Close()
-
-	if err != nil {
-		fmt.Print("Error(2):: RPC Calling Failure.(750)\n")
-		return errors.New("error(2):: RPC Calling Failure")
+	// for force quit, hand the replicas of our predecessors over as well
+	for _, temp2 := range pos.preData() {
+		err = client.CallContext(ctx, "RPCNode.FillDataPre", &temp2, nil)
+		if err != nil {
+			_ = client.Close()
+			return pos.fail(dhterr.FromRPC("Quit", suc.Ip, err))
+		}
 	}
+	_ = client.Close()
 
-	if pos.pre.Ip != "" {
+	if pre := pos.predecessor(); pre.Ip != "" {
 		// notify pre
-		client = Dial(pos.pre.Ip)
-		fmt.Print(pos.pre.Ip, "\n")
+		client = pos.dialContext(ctx, pre.Ip)
+		pos.log.Debug("Quit", "notify predecessor", "pre", pre.Ip)
 		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(703)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.FromContext(ctx, "Quit", pre.Ip, dhterr.ErrDial))
 		}
 
-		pos.lock.Lock()
-		temp3 := pos.sucList[0]
-		pos.lock.Unlock()
-
-		err = client.Call("RPCNode.InsertSuc", &temp3, nil)
+		err = client.CallContext(ctx, "RPCNode.InsertSuc", &suc, nil)
 		_ = client.Close()
 
 		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(774)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+			return pos.fail(dhterr.FromRPC("Quit", pre.Ip, err))
 		}
 
 		// notify suc
-		client = Dial(pos.sucList[0].Ip)
+		client = pos.dialContext(ctx, suc.Ip)
 		if client == nil {
-			fmt.Print("Error(1):: Dial Connect Failure.(720)\n")
-			return errors.New("error(1):: Dial Connect Failure")
+			return pos.fail(dhterr.FromContext(ctx, "Quit", suc.Ip, dhterr.ErrDial))
 		}
 
-		pos.lock.Lock()
-		temp4 := pos.pre
-		pos.lock.Unlock()
-
-		err = client.Call("RPCNode.UpdatePrv", &temp4, nil)
+		err = client.CallContext(ctx, "RPCNode.UpdatePrv", &pre, nil)
 		_ = client.Close()
 
 		if err != nil {
-			fmt.Print("Error(2):: RPC Calling Failure.(793)\n")
-			return errors.New("error(2):: RPC Calling Failure")
+			return pos.fail(dhterr.FromRPC("Quit", suc.Ip, err))
 		}
 	}
-	pos.inited = false
+	pos.inited.Store(false)
 	return nil
 }
 
@@ -805,36 +970,6 @@ func (pos *Node) CopySuccessorList(sucList *[SucListLen]Edge) {
 	pos.lock.Unlock()
 }
 
-func (pos *Node) InsertDataPre(kv KeyValue) {
-	pos.dataPre.lock.Lock()
-	pos.dataPre.data[kv.Key] = kv.Val
-	pos.dataPre.lock.Unlock()
-}
-
-func (pos *Node) RemoveDataPre(key string) {
-	pos.dataPre.lock.Lock()
-	if _, ok := pos.dataPre.data[key]; ok {
-		delete(pos.dataPre.data, key)
-	}
-	pos.dataPre.lock.Unlock()
-}
-
-func (pos *Node) MergeDataPre() {
-	pos.dataPre.lock.Lock()
-	pos.sto.lock.Lock()
-	for key, value := range pos.dataPre.data {
-		pos.sto.data[key] = value
-	}
-	pos.dataPre.lock.Unlock()
-	pos.sto.lock.Unlock()
-}
-
-func (pos *Node) FillDataPre(mp map[string]string) {
-	pos.dataPre.lock.Lock()
-	pos.dataPre.data = mp
-	pos.dataPre.lock.Unlock()
-}
-
 func (pos *Node) PrintLink() {
-	fmt.Print("Pos = ", pos.Ip, " Suc = ", pos.sucList[0].Ip, " Pre = ", pos.pre.Ip, "\n")
+	fmt.Print("Pos = ", pos.Ip, " Suc = ", pos.successor().Ip, " Pre = ", pos.predecessor().Ip, "\n")
 }
@@ -0,0 +1,1506 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"rpcpool"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testNodeSize  = 30
+	testPutSize   = 300
+	testQuitSize  = 5
+	testSleepTime = 100 * time.Millisecond
+)
+
+type testNode struct {
+	node       *Node
+	rpcSrv     *RPCNode
+	server     *rpc.Server
+	maintained chan struct{} // closed when the running Maintain returns
+}
+
+func newTestNode(t *testing.T, cfg Config, ip string) *testNode {
+	var ret testNode
+	ret.node = new(Node)
+	ret.node.InitWithConfig(ip, cfg)
+	ret.rpcSrv = &RPCNode{Data: ret.node}
+
+	server := rpc.NewServer()
+	ret.server = server
+	if err := server.Register(ret.rpcSrv); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(&ClientNode{Data: ret.node}); err != nil {
+		t.Fatal(err)
+	}
+	listen, err := ret.node.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret.rpcSrv.Listen = listen
+	ret.node.On.Store(true)
+
+	go ret.node.Serve(server, listen)
+	ret.maintain()
+	return &ret
+}
+
+func (pos *testNode) maintain() {
+	done := make(chan struct{})
+	pos.maintained = done
+	go func() {
+		pos.node.Maintain()
+		close(done)
+	}()
+}
+
+// pause stops Maintain and waits for its round to end, the test has the node to itself until resume.
+func (pos *testNode) pause() {
+	pos.node.On.Store(false)
+	<-pos.maintained
+}
+
+func (pos *testNode) resume() {
+	pos.node.On.Store(true)
+	pos.maintain()
+}
+
+func (pos *testNode) quit() {
+	pos.node.On.Store(false)
+	_ = pos.node.Quit()
+	_ = pos.rpcSrv.Listen.Close()
+}
+
+func (pos *testNode) forceQuit() {
+	pos.node.On.Store(false)
+	_ = pos.rpcSrv.Listen.Close()
+}
+
+// newTestRing starts size nodes on a fresh MemoryTransport and joins them into one ring.
+func newTestRing(t *testing.T, cfg Config, size int) []*testNode {
+	cfg.Transport = NewMemoryTransport()
+	nodes := make([]*testNode, size)
+	for i := 0; i < size; i++ {
+		nodes[i] = newTestNode(t, cfg, "node-"+strconv.Itoa(i))
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.forceQuit()
+		}
+	})
+
+	_ = nodes[0].node.CreateNetwork()
+	for i := 1; i < size; i++ {
+		if err := nodes[i].node.JoinNetwork(nodes[rand.Intn(i)].node.Ip); err != nil {
+			t.Fatalf("node %d failed to join: %v", i, err)
+		}
+		time.Sleep(testSleepTime)
+	}
+	time.Sleep(testSleepTime * 10)
+	return nodes
+}
+
+func TestMemoryRing(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize)
+
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(rand.Int())
+		if err := nodes[rand.Intn(testNodeSize)].node.InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	alive := nodes
+	for i := 0; i < testQuitSize; i++ {
+		id := rand.Intn(len(alive))
+		alive[id].quit()
+		alive = append(alive[:id:id], alive[id+1:]...)
+		time.Sleep(testSleepTime * 5)
+	}
+
+	for key, val := range kv {
+		var ret string
+		if err := alive[rand.Intn(len(alive))].node.QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s: got %q, %v, want %q", key, ret, err, val)
+		}
+	}
+
+	for key := range kv {
+		if err := alive[rand.Intn(len(alive))].node.EraseKey(key); err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		var ret string
+		if err := alive[rand.Intn(len(alive))].node.QueryVal(key, &ret); !errors.Is(err, dhterr.ErrNotFound) {
+			t.Fatalf("get deleted key %s: got %v, want %v", key, err, dhterr.ErrNotFound)
+		}
+	}
+}
+
+func TestReplicationSurvivesAdjacentFailures(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Replicas: 3}, testNodeSize/2)
+
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(rand.Int())
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	time.Sleep(testSleepTime * 5)
+
+	// force quit a node together with its successor
+	first := rand.Intn(len(nodes))
+	second := -1
+	for i, n := range nodes {
+		if n.node.Ip == nodes[first].node.successor().Ip {
+			second = i
+		}
+	}
+	nodes[first].forceQuit()
+	nodes[second].forceQuit()
+	time.Sleep(testSleepTime * 20)
+
+	alive := make([]*testNode, 0, len(nodes))
+	for i, n := range nodes {
+		if i != first && i != second {
+			alive = append(alive, n)
+		}
+	}
+	for key, val := range kv {
+		var ret string
+		if err := alive[rand.Intn(len(alive))].node.QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s: got %q, %v, want %q", key, ret, err, val)
+		}
+	}
+}
+
+func TestRestartFromDisk(t *testing.T) {
+	const size = 5
+	dirs := make([]string, size)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+	}
+	start := func() []*testNode {
+		trans := NewMemoryTransport()
+		nodes := make([]*testNode, size)
+		for i := range nodes {
+			eng, err := OpenDiskEngine(dirs[i], false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes[i] = newTestNode(t, Config{Transport: trans, Engine: eng}, "node-"+strconv.Itoa(i))
+		}
+		_ = nodes[0].node.CreateNetwork()
+		for i := 1; i < size; i++ {
+			if err := nodes[i].node.JoinNetwork(nodes[0].node.Ip); err != nil {
+				t.Fatalf("node %d failed to join: %v", i, err)
+			}
+			time.Sleep(testSleepTime * 5)
+		}
+		time.Sleep(testSleepTime * 10)
+		return nodes
+	}
+	stop := func(nodes []*testNode) {
+		for _, n := range nodes {
+			n.forceQuit()
+			_ = n.node.Close()
+		}
+	}
+
+	nodes := start()
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(rand.Int())
+		if err := nodes[rand.Intn(size)].node.InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	stop(nodes)
+
+	nodes = start()
+	defer stop(nodes)
+	for key, val := range kv {
+		var ret string
+		if err := nodes[rand.Intn(size)].node.QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s after restart: got %q, %v, want %q", key, ret, err, val)
+		}
+	}
+}
+
+func TestDeleteSurvivesOwnerFailure(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	for i := 0; i < testPutSize/3; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, "old"); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, "new"); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		if i%2 == 0 {
+			if err := nodes[rand.Intn(len(nodes))].node.EraseKey(key); err != nil {
+				t.Fatalf("delete %s: %v", key, err)
+			}
+		}
+	}
+
+	victim := rand.Intn(len(nodes))
+	nodes[victim].forceQuit()
+	alive := append(nodes[:victim:victim], nodes[victim+1:]...)
+	time.Sleep(testSleepTime * 20)
+
+	for i := 0; i < testPutSize/3; i++ {
+		key := "key-" + strconv.Itoa(i)
+		var ret Value
+		err := alive[rand.Intn(len(alive))].node.QueryVersioned(key, &ret)
+		if i%2 == 0 {
+			if !errors.Is(err, dhterr.ErrNotFound) {
+				t.Fatalf("deleted key %s came back: %+v, %v", key, ret, err)
+			}
+		} else if err != nil || ret.Val != "new" || ret.Ver.Time == 0 {
+			t.Fatalf("get %s: got %+v, %v, want the newest value", key, ret, err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	_ = nodes[0].node.EraseKey("key-0")
+	delete(kv, "key-0")
+
+	seen := make(map[string]bool)
+	var last *big.Int
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > testPutSize {
+			t.Fatal("scan does not finish")
+		}
+		page, next, err := nodes[rand.Intn(len(nodes))].node.Scan(cursor, 7)
+		if err != nil {
+			t.Fatalf("scan from %q: %v", cursor, err)
+		}
+		for _, x := range page {
+			if h := hashStr(x.Key); last != nil && h.Cmp(last) <= 0 {
+				t.Fatalf("scan is out of hash order at %s", x.Key)
+			} else {
+				last = h
+			}
+			if seen[x.Key] || kv[x.Key] != x.Val {
+				t.Fatalf("scan returned %s=%s, seen before: %v", x.Key, x.Val, seen[x.Key])
+			}
+			seen[x.Key] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != len(kv) {
+		t.Fatalf("scan returned %d keys, want %d", len(seen), len(kv))
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	trans := NewVirtualTransport(NewMemoryTransport())
+	weights := []float64{1, 1, 2, 0.5}
+	hosts := make([]*Host, len(weights))
+	for i, w := range weights {
+		h, err := NewHost("host-"+strconv.Itoa(i), HostConfig{Config: Config{Transport: trans}, Weight: w})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		hosts[i] = h
+	}
+	t.Cleanup(func() {
+		for _, h := range hosts {
+			h.ForceQuit()
+		}
+	})
+
+	if err := hosts[0].Create(); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hosts[1:] {
+		if err := h.Join(hosts[0].Nodes[0].Ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(testSleepTime * 10)
+
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(rand.Int())
+		if err := hosts[rand.Intn(len(hosts))].Nodes[0].InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	dist, err := hosts[1].Nodes[0].Distribution()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + dist.String())
+	positions, share := 0, 0.0
+	for i, h := range dist.Hosts {
+		if want := VirtualCount(weights[i]); h.Positions != want {
+			t.Errorf("%s has %d positions, want %d", h.Host, h.Positions, want)
+		}
+		positions += h.Positions
+		share += h.RingShare
+	}
+	if dist.Keys != testPutSize || len(dist.Hosts) != len(weights) || share < 0.999 || share > 1.001 {
+		t.Fatalf("got %d keys on %d hosts covering %.3f of the ring", dist.Keys, len(dist.Hosts), share)
+	}
+
+	if err := hosts[2].Quit(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testSleepTime * 10)
+	for key, val := range kv {
+		var ret string
+		if err := hosts[rand.Intn(2)].Nodes[0].QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s: got %q, %v, want %q", key, ret, err, val)
+		}
+	}
+
+	// replicas are on other hosts, so losing a whole machine loses no key
+	hosts[1].ForceQuit()
+	time.Sleep(testSleepTime * 20)
+	alive := []*Host{hosts[0], hosts[3]}
+	for key, val := range kv {
+		var ret string
+		if err := alive[rand.Intn(2)].Nodes[0].QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s after %s failed: got %q, %v, want %q", key, hosts[1].Ip, ret, err, val)
+		}
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+	pick := func() *Node {
+		return nodes[rand.Intn(len(nodes))].node
+	}
+
+	if err := pick().PutIfAbsent("lock", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pick().PutIfAbsent("lock", "b"); !errors.Is(err, dhterr.ErrConflict) {
+		t.Fatalf("second PutIfAbsent: got %v, want %v", err, dhterr.ErrConflict)
+	}
+	if err := pick().DeleteIfEquals("lock", "b"); !errors.Is(err, dhterr.ErrConflict) {
+		t.Fatalf("DeleteIfEquals with another value: got %v, want %v", err, dhterr.ErrConflict)
+	}
+	if err := pick().DeleteIfEquals("lock", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pick().CompareAndSwap("lock", "a", "b"); !errors.Is(err, dhterr.ErrNotFound) {
+		t.Fatalf("CompareAndSwap on a deleted key: got %v, want %v", err, dhterr.ErrNotFound)
+	}
+
+	// concurrent increments through compare-and-swap lose nothing
+	const workers, rounds = 8, 10
+	_ = pick().InsertKeyVal("counter", "0")
+	done := make(chan error)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < rounds; {
+				var cur string
+				if err := pick().QueryVal("counter", &cur); err != nil {
+					done <- err
+					return
+				}
+				n, _ := strconv.Atoi(cur)
+				err := pick().CompareAndSwap("counter", cur, strconv.Itoa(n+1))
+				if err == nil {
+					i++
+				} else if !errors.Is(err, dhterr.ErrConflict) {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replica follows, the value survives the owner
+	var owner Edge
+	_ = pick().FindSuccessor(hashStr("counter"), &owner)
+	alive := nodes[:0:0]
+	for _, n := range nodes {
+		if n.node.Ip == owner.Ip {
+			n.forceQuit()
+		} else {
+			alive = append(alive, n)
+		}
+	}
+	time.Sleep(testSleepTime * 20)
+	var ret string
+	if err := alive[rand.Intn(len(alive))].node.QueryVal("counter", &ret); err != nil || ret != strconv.Itoa(workers*rounds) {
+		t.Fatalf("counter after owner failure: got %q, %v, want %d", ret, err, workers*rounds)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+	const ttl = 2 * time.Second
+
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.PutWithTTL(key, "short", ttl); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	_ = nodes[0].node.InsertKeyVal("forever", "long")
+
+	// hand some keys over before they expire
+	nodes[len(nodes)-1].quit()
+	nodes[len(nodes)-2].quit()
+	alive := nodes[:len(nodes)-2]
+	var ret Value
+	if err := alive[0].node.QueryVersioned("key-0", &ret); err != nil || ret.Expire == 0 {
+		t.Fatalf("get key-0 before expiry: got %+v, %v", ret, err)
+	}
+
+	// conditional writes set the expiry they are given, a swap without one clears it
+	if err := alive[0].node.PutIfAbsentWithTTL("lease", "a", ttl); err != nil {
+		t.Fatalf("put lease: %v", err)
+	}
+	if err := alive[1].node.CompareAndSwapWithTTL("lease", "a", "b", ttl); err != nil {
+		t.Fatalf("swap lease: %v", err)
+	}
+	if err := alive[0].node.QueryVersioned("lease", &ret); err != nil || ret.Val != "b" || ret.Expire == 0 {
+		t.Fatalf("get lease before expiry: got %+v, %v", ret, err)
+	}
+	if err := alive[0].node.PutWithTTL("kept", "a", ttl); err != nil {
+		t.Fatalf("put kept: %v", err)
+	}
+	if err := alive[1].node.CompareAndSwap("kept", "a", "b"); err != nil {
+		t.Fatalf("swap kept: %v", err)
+	}
+	if err := alive[0].node.QueryVersioned("kept", &ret); err != nil || ret.Val != "b" || ret.Expire != 0 {
+		t.Fatalf("get kept after a swap without ttl: got %+v, %v", ret, err)
+	}
+	if err := alive[0].node.CompareAndSwapWithTTL("kept", "b", "c", 0); !errors.Is(err, dhterr.ErrBadArgument) {
+		t.Fatalf("swap with no ttl: got %v, want %v", err, dhterr.ErrBadArgument)
+	}
+
+	time.Sleep(ttl + 2*sweepPeriod)
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		var val string
+		if err := alive[rand.Intn(len(alive))].node.QueryVal(key, &val); !errors.Is(err, dhterr.ErrNotFound) {
+			t.Fatalf("get %s after expiry: got %q, %v", key, val, err)
+		}
+		for _, n := range alive {
+			for _, sto := range []*Storage{&n.node.sto, &n.node.dataPre} {
+				if _, ok := sto.copy()[key]; ok {
+					t.Fatalf("%s still holds expired %s", n.node.Ip, key)
+				}
+			}
+		}
+	}
+	var val string
+	if err := alive[0].node.QueryVal("forever", &val); err != nil || val != "long" {
+		t.Fatalf("get forever: got %q, %v", val, err)
+	}
+	if err := alive[0].node.QueryVal("lease", &val); !errors.Is(err, dhterr.ErrNotFound) {
+		t.Fatalf("get lease after expiry: got %q, %v", val, err)
+	}
+	if err := alive[0].node.QueryVal("kept", &val); err != nil || val != "b" {
+		t.Fatalf("get kept: got %q, %v", val, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	kvs := make([]KeyValue, testPutSize)
+	keys := make([]string, testPutSize+1)
+	for i := range kvs {
+		kvs[i] = KeyValue{Key: "key-" + strconv.Itoa(i), Val: "val-" + strconv.Itoa(i)}
+		keys[i] = kvs[i].Key
+	}
+	keys[testPutSize] = "missing"
+
+	for i, err := range nodes[0].node.MultiPut(kvs) {
+		if err != nil {
+			t.Fatalf("put %s: %v", kvs[i].Key, err)
+		}
+	}
+	vals, errs := nodes[1].node.MultiGet(keys)
+	for i := range kvs {
+		if errs[i] != nil || vals[i] != kvs[i].Val {
+			t.Fatalf("get %s: got %q, %v, want %q", keys[i], vals[i], errs[i], kvs[i].Val)
+		}
+	}
+	if !errors.Is(errs[testPutSize], dhterr.ErrNotFound) {
+		t.Fatalf("get missing key: got %v, want %v", errs[testPutSize], dhterr.ErrNotFound)
+	}
+
+	errs = nodes[2].node.MultiDelete(keys)
+	for i := range kvs {
+		if errs[i] != nil {
+			t.Fatalf("delete %s: %v", keys[i], errs[i])
+		}
+		var ret string
+		if err := nodes[3].node.QueryVal(keys[i], &ret); !errors.Is(err, dhterr.ErrNotFound) {
+			t.Fatalf("get deleted key %s: got %v, want %v", keys[i], err, dhterr.ErrNotFound)
+		}
+	}
+	if !errors.Is(errs[testPutSize], dhterr.ErrNotFound) {
+		t.Fatalf("delete missing key: got %v, want %v", errs[testPutSize], dhterr.ErrNotFound)
+	}
+
+	// a node turns away the keys it does not own, as when a joining node took them
+	var owner Edge
+	if err := nodes[0].node.FindSuccessor(hashStr("stray"), &owner); err != nil {
+		t.Fatal(err)
+	}
+	other := nodes[0].node
+	if other.Ip == owner.Ip {
+		other = nodes[1].node
+	}
+	var reply BatchReply
+	if err := other.BatchInside(BatchArgs{Op: BatchPut, KVs: []KeyValue{{Key: "stray", Val: "val"}}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := dhterr.FromRPC("BatchInside", other.Ip, rpc.ServerError(reply.Errs[0])); !errors.Is(err, dhterr.ErrNotOwner) {
+		t.Fatalf("batch to a node not owning the key: got %v, want %v", err, dhterr.ErrNotOwner)
+	}
+	var val Value
+	if err := other.QueryInside("stray", &val); err == nil {
+		t.Fatalf("a node not owning the key stored %+v", val)
+	}
+}
+
+func TestIterativeLookupSkipsDeadHops(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Lookup: LookupIterative, Replicas: 3}, testNodeSize)
+
+	kv := make(map[string]string)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		kv[key] = "val-" + strconv.Itoa(rand.Int())
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, kv[key]); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	time.Sleep(testSleepTime * 5)
+
+	// lookups right after the failures, before the ring repairs itself
+	// no two victims are neighbours, so every key keeps a replica
+	dead := make(map[string]bool)
+	for len(dead) < testQuitSize {
+		n := nodes[rand.Intn(len(nodes))].node
+		if !dead[n.Ip] && !dead[n.successor().Ip] && !dead[n.predecessor().Ip] {
+			dead[n.Ip] = true
+		}
+	}
+	var alive []*testNode
+	for _, n := range nodes {
+		if dead[n.node.Ip] {
+			n.forceQuit()
+		} else {
+			alive = append(alive, n)
+		}
+	}
+	for i := 0; i < testPutSize; i++ {
+		var ret Edge
+		if err := alive[rand.Intn(len(alive))].node.FindSuccessor(hashStr(strconv.Itoa(rand.Int())), &ret); err != nil {
+			t.Fatalf("lookup with dead hops: %v", err)
+		}
+	}
+
+	time.Sleep(testSleepTime * 20)
+	for key, val := range kv {
+		var ret string
+		if err := alive[rand.Intn(len(alive))].node.QueryVal(key, &ret); err != nil || ret != val {
+			t.Fatalf("get %s: got %q, %v, want %q", key, ret, err, val)
+		}
+	}
+}
+
+// refusingNode answers pings but turns every Notify down.
+type refusingNode struct{}
+
+func (pos *refusingNode) GetID(_ int, ret *big.Int) error {
+	ret.Set(hashStr("refusing"))
+	return nil
+}
+
+func (pos *refusingNode) Notify(_ *Edge, _ *int) error {
+	return dhterr.New("Notify", "", dhterr.ErrSetup)
+}
+
+func TestPrecedingNodesNotifyFails(t *testing.T) {
+	trans := NewMemoryTransport()
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCNode", &refusingNode{}); err != nil {
+		t.Fatal(err)
+	}
+	listen, err := trans.Listen("refusing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Accept(listen)
+
+	// the first successor is dead, the next one refuses to take the node as its predecessor
+	var n Node
+	n.InitWithConfig("node", Config{Transport: trans})
+	refusing := Edge{"refusing", *hashStr("refusing")}
+	n.sucList[0] = Edge{"dead", *hashStr("dead")}
+	for i := 1; i < SucListLen; i++ {
+		n.sucList[i] = refusing
+	}
+
+	var ret LookupStep
+	if err := n.PrecedingNodes(&refusing.Id, &ret); err != nil {
+		t.Fatalf("hop after a failed Notify: %v", err)
+	}
+	if !ret.Done || len(ret.Next) != 1 || ret.Next[0].Ip != refusing.Ip {
+		t.Fatalf("got %+v, want the refusing successor", ret)
+	}
+
+	// with no successor left the hop fails
+	_ = listen.Close()
+	n.pool.Invalidate(refusing.Ip)
+	err = n.PrecedingNodes(&refusing.Id, &ret)
+	if !errors.Is(err, dhterr.ErrAllSuccessorsFailed) {
+		t.Fatalf("hop with every successor dead: got %v, want %v", err, dhterr.ErrAllSuccessorsFailed)
+	}
+}
+
+func TestTraceLookup(t *testing.T) {
+	for _, mode := range []LookupMode{LookupRecursive, LookupIterative} {
+		nodes := newTestRing(t, Config{Lookup: mode}, testNodeSize)
+		time.Sleep(testSleepTime * 20) // fingers
+
+		hops := 0
+		for i := 0; i < testPutSize; i++ {
+			from := nodes[rand.Intn(len(nodes))].node
+			h := hashStr(strconv.Itoa(rand.Int()))
+			var trace LookupTrace
+			if err := from.TraceSuccessor(h, &trace); err != nil {
+				t.Fatalf("mode %d: trace: %v", mode, err)
+			}
+			var want Edge
+			if err := from.FindSuccessor(h, &want); err != nil || want.Ip != trace.Result.Ip {
+				t.Fatalf("mode %d: traced %s, found %s, %v", mode, trace.Result.Ip, want.Ip, err)
+			}
+			if len(trace.Hops) == 0 || trace.Hops[0].Node.Ip != from.Ip || len(trace.Failures()) != 0 {
+				t.Fatalf("mode %d: bad path from %s: %+v", mode, from.Ip, trace.Hops)
+			}
+			hops += trace.HopCount()
+		}
+		mean := float64(hops) / testPutSize
+		t.Logf("mode %d: %.2f hops on average", mode, mean)
+		if mean > math.Log2(testNodeSize) {
+			t.Fatalf("mode %d: %.2f hops on average, want O(log N)", mode, mean)
+		}
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+	node := nodes[0].node
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := node.InsertKeyValContext(ctx, "key", "val"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	var val string
+	if err := nodes[1].node.QueryValContext(ctx, "key", &val); err != nil || val != "val" {
+		t.Fatalf("get: got %q, %v", val, err)
+	}
+
+	done, stop := context.WithCancel(context.Background())
+	stop()
+	if err := node.QueryValContext(done, "key", &val); !errors.Is(err, dhterr.ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("get with a canceled context: %v", err)
+	}
+
+	// a node that reads requests but never answers
+	listen, err := node.trans.Listen("hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	short, cancelShort := context.WithTimeout(context.Background(), testSleepTime)
+	defer cancelShort()
+	start := time.Now()
+	client := node.dialContext(short, "hang")
+	if client == nil {
+		t.Fatal("dial of the hanging node failed")
+	}
+	err = client.CallContext(short, "RPCNode.GetID", 0, new(big.Int))
+	_ = client.Close()
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > testSleepTime*5 {
+		t.Fatalf("call to a hanging node: %v after %v", err, time.Since(start))
+	}
+
+	// the budget reaches the next hop, which gives up at once when it is spent
+	var far Edge
+	for _, n := range nodes {
+		if n.node.Ip != node.Ip && n.node.Ip != node.successor().Ip {
+			far = Edge{n.node.Ip, n.node.id}
+		}
+	}
+	client = node.dial(far.Ip)
+	var ret Edge
+	err = client.Call("RPCNode.FindSuccessorWithin", &LookupArgs{H: node.id, Budget: 1}, &ret)
+	_ = client.Close()
+	if !errors.Is(dhterr.FromRPC("FindSuccessor", far.Ip, err), dhterr.ErrCanceled) {
+		t.Fatalf("lookup with a spent budget: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	addr := freeAddr(t)
+	watched := newTestNode(t, Config{Transport: nodes[0].node.trans, MetricsAddr: addr}, "node-watched")
+	t.Cleanup(watched.forceQuit)
+	if err := watched.node.JoinNetwork(nodes[0].node.Ip); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testSleepTime * 10)
+
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := watched.node.InsertKeyVal(key, key); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		var ret string
+		if err := watched.node.QueryVal(key, &ret); err != nil || ret != key {
+			t.Fatalf("get %s: got %q, %v", key, ret, err)
+		}
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	watched.node.sto.lock.Lock()
+	stored := watched.node.sto.eng.Len()
+	watched.node.sto.lock.Unlock()
+	for _, want := range []string{
+		"# TYPE chord_rpc_served_total counter",
+		`chord_rpc_served_total{method="RPCNode.GetID",result="ok"} `,
+		`chord_rpc_issued_total{method="RPCNode.QueryInside",result="ok"} `,
+		`chord_rpc_issued_seconds_bucket{method="RPCNode.InsertInside",le="+Inf"} `,
+		`chord_lookup_seconds_count{mode="recursive",result="ok"} `,
+		`chord_stabilize_total{result="ok"} `,
+		`chord_notify_total{result="accepted"} `,
+		`chord_keys{store="dataPre"} `,
+		`chord_keys{store="sto"} ` + strconv.Itoa(stored) + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if lookups := watched.node.metrics.lookupSeconds.Count("recursive", "ok"); lookups < 2*testPutSize {
+		t.Errorf("counted %d lookups, want at least %d", lookups, 2*testPutSize)
+	}
+	if t.Failed() {
+		t.Log(text)
+	}
+
+	victim := rand.Intn(len(nodes))
+	nodes[victim].forceQuit()
+	time.Sleep(testSleepTime * 10)
+	repairs := watched.node.metrics.repairs.Value()
+	for i, n := range nodes {
+		if i != victim {
+			repairs += n.node.metrics.repairs.Value()
+		}
+	}
+	if repairs == 0 {
+		t.Errorf("no successor list repair counted after a node failed")
+	}
+}
+
+// freeAddr finds a local TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Close()
+	return free.Addr().String()
+}
+
+func TestAdmin(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	addr := freeAddr(t)
+	watched := newTestNode(t, Config{Transport: nodes[0].node.trans, MetricsAddr: addr, AdminAddr: addr}, "node-watched")
+	t.Cleanup(watched.forceQuit)
+	if err := watched.node.JoinNetwork(nodes[0].node.Ip); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testSleepTime * 10)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, key); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	resp, err := http.Get("http://" + addr + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info NodeInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Ip != watched.node.Ip || info.Id != watched.node.id.Text(16) || !info.On {
+		t.Errorf("got node %s %s on=%v, want %s %s", info.Ip, info.Id, info.On, watched.node.Ip, watched.node.id.Text(16))
+	}
+	if len(info.Finger) != Len || len(info.SucList) != SucListLen {
+		t.Errorf("got %d fingers and %d successors, want %d and %d", len(info.Finger), len(info.SucList), Len, SucListLen)
+	}
+	if info.Pre.Ip == "" || info.SucList[0].Ip == "" {
+		t.Fatalf("got pre %q and successor %q, want both set", info.Pre.Ip, info.SucList[0].Ip)
+	}
+	for _, n := range nodes {
+		if n.node.Ip == info.SucList[0].Ip {
+			if pre := n.node.Inspect().Pre; pre.Ip != watched.node.Ip {
+				t.Errorf("successor %s has predecessor %s, want %s", n.node.Ip, pre.Ip, watched.node.Ip)
+			}
+		}
+	}
+	stored := 0
+	for _, n := range append(nodes, watched) {
+		stored += n.node.Inspect().Keys.Sto
+	}
+	if stored != testPutSize || info.Keys.Sto != watched.node.Inspect().Keys.Sto {
+		t.Errorf("ring holds %d keys, want %d; admin reported %d for the node", stored, testPutSize, info.Keys.Sto)
+	}
+
+	resp, err = http.Post("http://"+addr+"/admin", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics on the shared listener got status %d", resp.StatusCode)
+	}
+}
+
+func TestClientRPC(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+
+	entry := nodes[rand.Intn(len(nodes))].node
+	client, err := entry.trans.Dial(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		args := &ClientArgs{Key: key, Val: "val-" + key, Budget: time.Second}
+		if err := client.Call("ClientNode.Put", args, nil); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		var val Value
+		if err := client.Call("ClientNode.Get", args, &val); err != nil || val.Val != args.Val {
+			t.Fatalf("get %s: got %q, %v, want %q", key, val.Val, err, args.Val)
+		}
+
+		var trace LookupTrace
+		if err := client.Call("ClientNode.Lookup", args, &trace); err != nil {
+			t.Fatalf("lookup %s: %v", key, err)
+		}
+		var owner Edge
+		if err := entry.FindSuccessor(hashStr(key), &owner); err != nil || owner.Ip != trace.Result.Ip {
+			t.Fatalf("lookup %s: got owner %s, FindSuccessor gives %s, %v", key, trace.Result.Ip, owner.Ip, err)
+		}
+
+		if err := client.Call("ClientNode.Delete", args, nil); err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		err = client.Call("ClientNode.Get", args, &val)
+		if err = dhterr.FromRPC("Get", entry.Ip, err); !errors.Is(err, dhterr.ErrNotFound) {
+			t.Fatalf("get deleted key %s: got %v, want %v", key, err, dhterr.ErrNotFound)
+		}
+	}
+
+	var info NodeInfo
+	if err := client.Call("RPCNode.Info", 0, &info); err != nil || info.Ip != entry.Ip {
+		t.Fatalf("info: got %q, %v, want %q", info.Ip, err, entry.Ip)
+	}
+}
+
+func TestCheckRing(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{}, testNodeSize/3)
+	for i := 0; i < testPutSize/3; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, key); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	entry := nodes[0].node
+	report, err := CheckRing(context.Background(), entry.trans.Dial, entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Closed || len(report.Ring) != len(nodes) {
+		t.Fatalf("crawled %d nodes, closed=%v, want %d and closed", len(report.Ring), report.Closed, len(nodes))
+	}
+	for _, v := range report.Violations {
+		t.Errorf("stable ring: %v", v)
+	}
+
+	// keep a key away from its owner and lose one replica
+	var owner Edge
+	if err := entry.FindSuccessor(hashStr("key-0"), &owner); err != nil {
+		t.Fatal(err)
+	}
+	var stray, owned *Node
+	for _, n := range nodes {
+		if n.node.Ip == owner.Ip {
+			owned = n.node
+		} else if stray == nil {
+			stray = n.node
+		}
+	}
+	val := Value{Val: "stray", Ver: stray.tick()}
+	stray.sto.lock.Lock()
+	_ = stray.sto.eng.Put("key-0", val)
+	stray.sto.lock.Unlock()
+
+	lost := "key-0"
+	var replica *Node
+	for _, n := range nodes {
+		if n.node.Ip == owned.replicaTargets()[0] {
+			replica = n.node
+		}
+	}
+	replica.dataPre.lock.Lock()
+	_ = replica.dataPre.eng.Delete(lost)
+	delete(replica.preKeys, lost)
+	replica.dataPre.lock.Unlock()
+
+	report, err = CheckRing(context.Background(), entry.trans.Dial, entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var placement, missing bool
+	for _, v := range report.Violations {
+		placement = placement || v.Kind == ViolationPlacement && v.Node == stray.Ip && v.Key == "key-0"
+		missing = missing || v.Kind == ViolationReplica && v.Node == replica.Ip && v.Key == lost
+	}
+	if !placement || !missing {
+		t.Errorf("got violations %v, want key-0 misplaced on %s and %s missing on %s", report.Violations, stray.Ip, lost, replica.Ip)
+	}
+
+	var dot strings.Builder
+	if err := report.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(dot.String(), "[label=suc]"); !strings.HasPrefix(dot.String(), "digraph") || n != len(nodes) {
+		t.Errorf("got %d successor edges in\n%s", n, dot.String())
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Replicas: 3, AntiEntropy: -1}, testNodeSize/3)
+	for i := 0; i < testPutSize; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, key); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	owner := nodes[rand.Intn(len(nodes))].node
+	own := owner.sto.copy()
+	if len(own) < 3 {
+		t.Skipf("owner %s only got %d keys", owner.Ip, len(own))
+	}
+	var keys []string
+	for k := range own {
+		keys = append(keys, k)
+	}
+	var replica *Node
+	for _, n := range nodes {
+		if n.node.Ip == owner.replicaTargets()[1] {
+			replica = n.node
+		}
+	}
+
+	// the replica loses one key, misses a write to another, keeps a key the owner dropped
+	// and has a newer version of a third the owner missed
+	stale, newer := own[keys[1]], own[keys[2]]
+	stale.Ver.Time--
+	newer.Val, newer.Ver = "newer", replica.tick()
+	replica.dataPre.lock.Lock()
+	_ = replica.dataPre.eng.Delete(keys[0])
+	delete(replica.preKeys, keys[0])
+	_ = replica.dataPre.eng.Put(keys[1], stale)
+	_ = replica.dataPre.eng.Put(keys[2], newer)
+	_ = replica.dataPre.eng.Put("dropped", own[keys[0]])
+	replica.preKeys["dropped"] = owner.Ip
+	replica.dataPre.lock.Unlock()
+
+	stats, err := owner.AntiEntropy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (AntiEntropyStats{Pushed: 2, Pulled: 1, Dropped: 1}); stats != want {
+		t.Errorf("first round moved %+v, want %+v", stats, want)
+	}
+	if stats, err = owner.AntiEntropy(); err != nil || stats != (AntiEntropyStats{Pushed: 1}) {
+		// the newer value is only pushed to the nearest replica by the second round
+		t.Errorf("second round moved %+v, %v, want the pulled key pushed once", stats, err)
+	}
+	if stats, err = owner.AntiEntropy(); err != nil || stats != (AntiEntropyStats{}) {
+		t.Errorf("third round moved %+v, %v, want nothing", stats, err)
+	}
+
+	var ret string
+	if err := owner.QueryVal(keys[2], &ret); err != nil || ret != "newer" {
+		t.Errorf("get %s: got %q, %v, want the newer value pulled from the replica", keys[2], ret, err)
+	}
+	report, err := CheckRing(context.Background(), owner.trans.Dial, owner.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range report.Violations {
+		t.Errorf("after anti-entropy: %v", v)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Replicas: 3, ReadRepair: true, AntiEntropy: -1}, testNodeSize/3)
+	entry := nodes[rand.Intn(len(nodes))].node
+	if err := entry.InsertKeyVal("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	var owner Edge
+	if err := entry.FindSuccessor(hashStr("key"), &owner); err != nil {
+		t.Fatal(err)
+	}
+	var own *Node
+	for _, n := range nodes {
+		if n.node.Ip == owner.Ip {
+			own = n.node
+		}
+	}
+	targets := own.replicaTargets()
+	replicas := make([]*Node, len(targets))
+	for i, ip := range targets {
+		for _, n := range nodes {
+			if n.node.Ip == ip {
+				replicas[i] = n.node
+			}
+		}
+	}
+
+	// the nearest replica got a write the owner lost, the other one lost the key
+	newer := Value{Val: "new", Ver: replicas[0].tick()}
+	replicas[0].InsertDataPre(PreKeyValue{Edge{own.Ip, own.id}, "key", newer})
+	replicas[1].dataPre.lock.Lock()
+	_ = replicas[1].dataPre.eng.Delete("key")
+	delete(replicas[1].preKeys, "key")
+	replicas[1].dataPre.lock.Unlock()
+
+	// the read answers with the owner's copy alone, not waiting for the replica holding back
+	replicas[1].dataPre.lock.Lock()
+	done := make(chan error, 1)
+	go func() {
+		var ret string
+		done <- entry.QueryVal("key", &ret)
+	}()
+	select {
+	case err := <-done:
+		replicas[1].dataPre.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		replicas[1].dataPre.lock.Unlock()
+		t.Fatal("get waited for every replica")
+	}
+
+	// the repair went on in the background, once every replica answered
+	time.Sleep(testSleepTime)
+	var ret string
+	if err := entry.QueryVal("key", &ret); err != nil || ret != "new" {
+		t.Fatalf("get: got %q, %v, want the newest copy", ret, err)
+	}
+	var val Value
+	if err := own.QueryInside("key", &val); err != nil || val.Ver != newer.Ver {
+		t.Errorf("owner has %+v, %v after the read, want %+v", val, err, newer)
+	}
+	var c ReplicaValue
+	_ = replicas[1].QueryDataPre("key", &c)
+	if !c.Ok || c.Val.Ver != newer.Ver {
+		t.Errorf("replica %s has %+v after the read, want %+v", replicas[1].Ip, c, newer)
+	}
+
+	// a newer tombstone on a replica hides the key
+	replicas[1].InsertDataPre(PreKeyValue{Edge{own.Ip, own.id}, "key", Value{Ver: replicas[1].tick(), Deleted: true}})
+	_ = entry.QueryVal("key", &ret)
+	time.Sleep(testSleepTime)
+	err := entry.QueryVal("key", &ret)
+	if err = dhterr.FromRPC("QueryVal", "", err); !errors.Is(err, dhterr.ErrNotFound) {
+		t.Errorf("get after a delete the owner missed: got %q, %v, want %v", ret, err, dhterr.ErrNotFound)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Replicas: 3, AntiEntropy: -1}, testNodeSize/3)
+	entry := nodes[rand.Intn(len(nodes))].node
+	ctx := context.Background()
+
+	if err := entry.InsertKeyValQuorum(ctx, "key", "val", 3); err != nil {
+		t.Fatal(err)
+	}
+	var owner Edge
+	if err := entry.FindSuccessor(hashStr("key"), &owner); err != nil {
+		t.Fatal(err)
+	}
+	byIp := make(map[string]*testNode)
+	for _, n := range nodes {
+		byIp[n.node.Ip] = n
+	}
+	ownNode := byIp[owner.Ip]
+	own := ownNode.node
+	targets := own.replicaTargets()
+	for _, ip := range targets {
+		var c ReplicaValue
+		_ = byIp[ip].node.QueryDataPre("key", &c)
+		if !c.Ok || c.Val.Val != "val" {
+			t.Errorf("replica %s has %+v once a write to all 3 copies returned", ip, c)
+		}
+	}
+	if err := entry.InsertKeyValQuorum(ctx, "key", "val", 4); !errors.Is(err, dhterr.ErrBadArgument) {
+		t.Errorf("write quorum above the replicas: got %v, want %v", err, dhterr.ErrBadArgument)
+	}
+
+	// keep the owner from noticing the replica is gone
+	ownNode.pause()
+	defer ownNode.resume()
+	byIp[targets[1]].forceQuit()
+
+	err := own.InsertInside(KeyValue{Key: "key", Val: "new", W: 3}, nil)
+	if !errors.Is(err, dhterr.ErrQuorum) {
+		t.Errorf("write to 3 copies with one replica gone: got %v, want %v", err, dhterr.ErrQuorum)
+	}
+	if err := own.InsertInside(KeyValue{Key: "key", Val: "new", W: 2}, nil); err != nil {
+		t.Errorf("write to 2 copies with one replica gone: %v", err)
+	}
+
+	// conditional and batched writes wait for their quorum as well
+	err = own.CondInside(CondWrite{Op: CondEquals, Key: "key", Old: "new", New: "cas", W: 3}, nil)
+	if !errors.Is(err, dhterr.ErrQuorum) {
+		t.Errorf("swap on 3 copies with one replica gone: got %v, want %v", err, dhterr.ErrQuorum)
+	}
+	if err := own.CondInside(CondWrite{Op: CondEquals, Key: "key", Old: "cas", New: "new", W: 2}, nil); err != nil {
+		t.Errorf("swap on 2 copies with one replica gone: %v", err)
+	}
+	if err := own.CondInside(CondWrite{Op: CondAbsent, Key: "other", New: "val", W: 4}, nil); !errors.Is(err, dhterr.ErrBadArgument) {
+		t.Errorf("conditional write quorum above the replicas: got %v, want %v", err, dhterr.ErrBadArgument)
+	}
+	// the batch is applied all the same, the missed quorum is told per key
+	var reply BatchReply
+	if err := own.BatchInside(BatchArgs{Op: BatchPut, KVs: []KeyValue{{Key: "key", Val: "batch"}}, W: 3}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := dhterr.FromRPC("BatchInside", own.Ip, rpc.ServerError(reply.Errs[0])); !errors.Is(err, dhterr.ErrQuorum) {
+		t.Errorf("batch on 3 copies with one replica gone: got %v, want %v", err, dhterr.ErrQuorum)
+	}
+	if err := own.BatchInside(BatchArgs{Op: BatchPut, KVs: []KeyValue{{Key: "key", Val: "new"}}, W: 2}, &reply); err != nil || reply.Errs[0] != "" {
+		t.Errorf("batch on 2 copies with one replica gone: %v, %q", err, reply.Errs[0])
+	}
+	if err := own.BatchInside(BatchArgs{Op: BatchDelete, KVs: []KeyValue{{Key: "key"}}, W: 4}, &reply); !errors.Is(err, dhterr.ErrBadArgument) {
+		t.Errorf("batch quorum above the replicas: got %v, want %v", err, dhterr.ErrBadArgument)
+	}
+	var val Value
+	if err := own.QueryRepaired(ctx, "key", 3, &val); !errors.Is(err, dhterr.ErrQuorum) {
+		t.Errorf("read of 3 copies with one replica gone: got %v, want %v", err, dhterr.ErrQuorum)
+	}
+	if err := own.QueryRepaired(ctx, "key", 2, &val); err != nil || val.Val != "new" {
+		t.Errorf("read of 2 copies with one replica gone: got %q, %v, want %q", val.Val, err, "new")
+	}
+
+	client, err := own.trans.Dial(own.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Call("ClientNode.Get", &ClientArgs{Key: "key", R: 4}, &val)
+	if err = dhterr.FromRPC("Get", own.Ip, err); !errors.Is(err, dhterr.ErrBadArgument) {
+		t.Errorf("client read quorum above the replicas: got %v, want %v", err, dhterr.ErrBadArgument)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestRing(t, Config{Replicas: 3, AntiEntropy: -1}, testNodeSize/3)
+	byIp := make(map[string]*testNode)
+	for _, n := range nodes {
+		byIp[n.node.Ip] = n
+	}
+	ownNode := nodes[rand.Intn(len(nodes))]
+	own := ownNode.node
+	// a dead successor is dropped before the write is sent, the replica after it only gets a hint
+	replica := byIp[own.replicaTargets()[1]]
+
+	// keep the owner from noticing the replica is away
+	ownNode.pause()
+	handOff := func() {
+		own.lastHandOff = time.Time{}
+		own.handOffHints()
+	}
+	hasKey := func(n *Node, key string) bool {
+		var c ReplicaValue
+		_ = n.QueryDataPre(key, &c)
+		return c.Ok
+	}
+
+	_ = replica.rpcSrv.Listen.Close()
+	if err := own.InsertInside(KeyValue{Key: "back", Val: "val"}, nil); err != nil {
+		t.Fatalf("write with the replica away: %v", err)
+	}
+	if n := own.Hints(); n != 1 {
+		t.Fatalf("got %d hints, want 1", n)
+	}
+	handOff()
+	if n := own.Hints(); n != 1 {
+		t.Fatalf("got %d hints while the replica is away, want 1", n)
+	}
+
+	listen, err := replica.node.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica.rpcSrv.Listen = listen
+	go replica.node.Serve(replica.server, listen)
+	handOff()
+	if n := own.Hints(); n != 0 || !hasKey(replica.node, "back") {
+		t.Fatalf("got %d hints and the key on the replica %v once it is back, want 0 and true", n, hasKey(replica.node, "back"))
+	}
+
+	// the replica goes for good, the hint goes to the successor taking its place
+	_ = replica.rpcSrv.Listen.Close()
+	if err := own.InsertInside(KeyValue{Key: "gone", Val: "val"}, nil); err != nil {
+		t.Fatalf("write with the replica gone: %v", err)
+	}
+	ownNode.resume()
+	replica.forceQuit()
+	for i := 0; i < 50 && own.Hints() > 0; i++ {
+		time.Sleep(testSleepTime)
+	}
+	next := own.replicaTargets()[1]
+	if n := own.Hints(); n != 0 || next == replica.node.Ip || !hasKey(byIp[next].node, "gone") {
+		t.Errorf("got %d hints and the key on the new replica %s %v, want 0 and true", n, next, hasKey(byIp[next].node, "gone"))
+	}
+}
+
+func TestHintsWithoutTargets(t *testing.T) {
+	nodes := newTestRing(t, Config{Replicas: 3, AntiEntropy: -1}, 1)
+	own := nodes[0].node
+	nodes[0].pause()
+	handOff := func() {
+		own.lastHandOff = time.Time{}
+		own.handOffHints()
+	}
+
+	// the replica the hint was kept for left and no other node is there to take it
+	own.hint("gone", &PreKeyValue{Edge{own.Ip, own.id}, "key", Value{Val: "val", Ver: own.tick()}})
+	handOff()
+	if n := own.Hints(); n != 1 {
+		t.Fatalf("got %d hints with no replica to hand them to, want 1", n)
+	}
+
+	// a node joins, it gets the hint
+	other := newTestNode(t, Config{Replicas: 3, AntiEntropy: -1, Transport: own.trans}, "other")
+	t.Cleanup(other.forceQuit)
+	if err := other.node.JoinNetwork(own.Ip); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].resume()
+	for i := 0; i < 50 && len(own.replicaTargets()) == 0; i++ {
+		time.Sleep(testSleepTime)
+	}
+	nodes[0].pause()
+	handOff()
+	var c ReplicaValue
+	_ = other.node.QueryDataPre("key", &c)
+	if n := own.Hints(); n != 0 || !c.Ok {
+		t.Errorf("got %d hints and the key on the new node %v, want 0 and true", n, c.Ok)
+	}
+}
+
+func TestAuthenticatedRPC(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	cfg := Config{PeerKey: []byte("peer secret"), ClientKey: []byte("client secret")}
+	nodes := newTestRing(t, cfg, testNodeSize/6)
+
+	// the ring only forms when the nodes authenticate each other
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[rand.Intn(len(nodes))].node.InsertKeyVal(key, "val-"+key); err != nil {
+			t.Fatalf("insert %s: %v", key, err)
+		}
+		var ret string
+		if err := nodes[rand.Intn(len(nodes))].node.QueryVal(key, &ret); err != nil || ret != "val-"+key {
+			t.Fatalf("query %s: got %q, %v", key, ret, err)
+		}
+	}
+
+	entry := nodes[rand.Intn(len(nodes))].node
+	trans := entry.trans.(ConnTransport)
+
+	// a caller skipping the handshake is never answered
+	plain, err := trans.Dial(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var id big.Int
+		done <- plain.Call("RPCNode.GetID", 0, &id)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("unauthenticated call succeeded")
+		}
+	case <-time.After(time.Second):
+	}
+	_ = plain.Close()
+
+	for _, x := range []struct {
+		role rpcpool.Role
+		key  string
+	}{
+		{rpcpool.RolePeer, "guess"},
+		{rpcpool.RolePeer, "client secret"}, // the client key is no peer key
+		{rpcpool.RoleClient, "peer secret"},
+	} {
+		if _, err := rpcpool.AuthDial(trans.DialConn, x.role, []byte(x.key))(entry.Ip); !errors.Is(err, rpcpool.ErrAuth) {
+			t.Errorf("role %d with key %q: got %v, want %v", x.role, x.key, err, rpcpool.ErrAuth)
+		}
+	}
+
+	client, err := rpcpool.AuthDial(trans.DialConn, rpcpool.RoleClient, cfg.ClientKey)(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	args := &ClientArgs{Key: "client-key", Val: "client-val", Budget: time.Second}
+	if err := client.Call("ClientNode.Put", args, nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	var val Value
+	if err := client.Call("ClientNode.Get", args, &val); err != nil || val.Val != args.Val {
+		t.Fatalf("get: got %q, %v, want %q", val.Val, err, args.Val)
+	}
+
+	// maintenance RPCs are turned away, the connection stays usable
+	err = client.Call("RPCNode.FillDataPre", &PreData{Edge{"evil", *big.NewInt(1)}, map[string]Value{}}, nil)
+	if err = dhterr.FromRPC("FillDataPre", entry.Ip, err); !errors.Is(err, dhterr.ErrDenied) {
+		t.Fatalf("FillDataPre as client: got %v, want %v", err, dhterr.ErrDenied)
+	}
+	var info NodeInfo
+	if err := client.Call("RPCNode.Info", 0, &info); !errors.Is(dhterr.FromRPC("Info", entry.Ip, err), dhterr.ErrDenied) {
+		t.Fatalf("Info as client: got %v, want %v", err, dhterr.ErrDenied)
+	}
+	if err := client.Call("ClientNode.Ping", 0, nil); err != nil {
+		t.Fatalf("ping after a denied call: %v", err)
+	}
+
+	peer, err := rpcpool.AuthDial(trans.DialConn, rpcpool.RolePeer, cfg.PeerKey)(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Call("RPCNode.Info", 0, &info); err != nil || info.Ip != entry.Ip {
+		t.Fatalf("Info as peer: got %q, %v, want %q", info.Ip, err, entry.Ip)
+	}
+}
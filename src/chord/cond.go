@@ -0,0 +1,157 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"errors"
+	"time"
+)
+
+type CondOp int
+
+const (
+	CondAbsent       CondOp = iota // put New when the key has no value
+	CondEquals                     // put New when the value is Old
+	CondDeleteEquals               // delete when the value is Old
+)
+
+// CondWrite is a write the owner only applies when its condition holds.
+// New replaces the value together with its expiry, it is kept for TTL or until it is erased when TTL is 0.
+type CondWrite struct {
+	Op  CondOp
+	Key string
+	Old string
+	New string
+	TTL time.Duration
+	W   int // write quorum, see InsertKeyValQuorum
+}
+
+// CondInside checks and applies w under the storage lock, so no other write of the key comes in between.
+// A missing key fails with ErrNotFound, a different value with ErrConflict.
+func (pos *Node) CondInside(w CondWrite, _ *int) error {
+	if err := pos.checkQuorum("CondInside", w.W); err != nil {
+		return err
+	}
+	pos.sto.lock.Lock()
+	cur, ok := pos.sto.eng.Get(w.Key)
+	ok = ok && cur.live(time.Now().UnixNano())
+
+	var err error
+	switch {
+	case w.Op > CondDeleteEquals || w.Op < CondAbsent:
+		err = dhterr.New("CondInside", "", dhterr.ErrBadArgument)
+	case w.Op == CondAbsent && ok:
+		err = dhterr.New("CondInside", "", dhterr.ErrConflict)
+	case w.Op != CondAbsent && !ok:
+		err = dhterr.New("CondInside", "", dhterr.ErrNotFound)
+	case w.Op != CondAbsent && cur.Val != w.Old:
+		err = dhterr.New("CondInside", "", dhterr.ErrConflict)
+	}
+	if err != nil {
+		pos.sto.lock.Unlock()
+		return err
+	}
+
+	val := Value{Val: w.New, Ver: pos.tick()}
+	if w.TTL > 0 {
+		val.Expire = val.Ver.Time + int64(w.TTL)
+	}
+	if w.Op == CondDeleteEquals {
+		val = Value{Ver: val.Ver, Deleted: true}
+	}
+	err = pos.sto.eng.Put(w.Key, val)
+	pos.sto.lock.Unlock()
+	if err != nil {
+		return pos.fail(dhterr.Wrap("CondInside", "", dhterr.ErrStorage, err))
+	}
+
+	// for force quit
+	if pos.FixList() != nil {
+		return pos.fail(dhterr.New("CondInside", "", dhterr.ErrAllSuccessorsFailed))
+	}
+	return pos.replicateWrite("CondInside", "RPCNode.InsertDataPre", &PreKeyValue{Edge{pos.Ip, pos.id}, w.Key, val}, w.W)
+}
+
+// condWrite sends w to the owner of its key.
+func (pos *Node) condWrite(ctx context.Context, op string, w CondWrite) error {
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(w.Key), &temp)
+	if err != nil {
+		return pos.fail(dhterr.Wrap(op, "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, op, ip, dhterr.ErrDial))
+	}
+	err = client.CallContext(ctx, "RPCNode.CondInside", &w, nil)
+	_ = client.Close()
+
+	if err != nil {
+		err = dhterr.FromRPC(op, ip, err)
+		if errors.Is(err, dhterr.ErrNotFound) || errors.Is(err, dhterr.ErrConflict) {
+			return err
+		}
+		return pos.fail(err)
+	}
+
+	return nil
+}
+
+// PutIfAbsent stores val unless key already has a value, then it fails with ErrConflict.
+func (pos *Node) PutIfAbsent(key string, val string) error {
+	return pos.PutIfAbsentContext(context.Background(), key, val)
+}
+
+// PutIfAbsentContext is PutIfAbsent giving up when ctx is done.
+func (pos *Node) PutIfAbsentContext(ctx context.Context, key string, val string) error {
+	return pos.condWrite(ctx, "PutIfAbsent", CondWrite{CondAbsent, key, "", val, 0, pos.writeQuorum})
+}
+
+// PutIfAbsentWithTTL is PutIfAbsent keeping val for ttl, see PutWithTTL.
+func (pos *Node) PutIfAbsentWithTTL(key string, val string, ttl time.Duration) error {
+	return pos.PutIfAbsentWithTTLContext(context.Background(), key, val, ttl)
+}
+
+// PutIfAbsentWithTTLContext is PutIfAbsentWithTTL giving up when ctx is done.
+func (pos *Node) PutIfAbsentWithTTLContext(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return dhterr.New("PutIfAbsentWithTTL", "", dhterr.ErrBadArgument)
+	}
+	return pos.condWrite(ctx, "PutIfAbsentWithTTL", CondWrite{CondAbsent, key, "", val, ttl, pos.writeQuorum})
+}
+
+// CompareAndSwap replaces the value of key by new when it is old.
+// Like InsertKeyVal, new is kept until it is erased, an expiry old had is cleared; see CompareAndSwapWithTTL.
+func (pos *Node) CompareAndSwap(key string, old string, new string) error {
+	return pos.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+// CompareAndSwapContext is CompareAndSwap giving up when ctx is done.
+func (pos *Node) CompareAndSwapContext(ctx context.Context, key string, old string, new string) error {
+	return pos.condWrite(ctx, "CompareAndSwap", CondWrite{CondEquals, key, old, new, 0, pos.writeQuorum})
+}
+
+// CompareAndSwapWithTTL is CompareAndSwap keeping new for ttl, counted from when the owner swaps it in.
+func (pos *Node) CompareAndSwapWithTTL(key string, old string, new string, ttl time.Duration) error {
+	return pos.CompareAndSwapWithTTLContext(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLContext is CompareAndSwapWithTTL giving up when ctx is done.
+func (pos *Node) CompareAndSwapWithTTLContext(ctx context.Context, key string, old string, new string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return dhterr.New("CompareAndSwapWithTTL", "", dhterr.ErrBadArgument)
+	}
+	return pos.condWrite(ctx, "CompareAndSwapWithTTL", CondWrite{CondEquals, key, old, new, ttl, pos.writeQuorum})
+}
+
+// DeleteIfEquals deletes key when its value is old.
+func (pos *Node) DeleteIfEquals(key string, old string) error {
+	return pos.DeleteIfEqualsContext(context.Background(), key, old)
+}
+
+// DeleteIfEqualsContext is DeleteIfEquals giving up when ctx is done.
+func (pos *Node) DeleteIfEqualsContext(ctx context.Context, key string, old string) error {
+	return pos.condWrite(ctx, "DeleteIfEquals", CondWrite{CondDeleteEquals, key, old, "", 0, pos.writeQuorum})
+}
@@ -0,0 +1,56 @@
+package chord
+
+import (
+	"context"
+	"math/big"
+	"rpcpool"
+	"time"
+)
+
+// LookupArgs carries a lookup of H to the next hop. Budget is what is left of the caller's deadline, 0 for none.
+// It is sent as a remaining time rather than a deadline, so the clocks of the nodes need not agree.
+type LookupArgs struct {
+	H      big.Int
+	Budget time.Duration
+}
+
+func lookupArgs(ctx context.Context, h *big.Int) *LookupArgs {
+	return &LookupArgs{H: *h, Budget: budget(ctx)}
+}
+
+// budget is what is left of the deadline of ctx, 0 for none.
+func budget(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if ret := time.Until(deadline); ret > 0 {
+		return ret
+	}
+	return 1 // spent, the next hop gives up at once
+}
+
+// withBudget makes the context a hop works under from the budget its caller sent.
+func withBudget(budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), budget)
+}
+
+// detach is ctx kept alive after its caller cancels it, its deadline still holds.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
+}
+
+// dialContext is dial giving up when ctx is done.
+func (pos *Node) dialContext(ctx context.Context, ip string) *rpcpool.Client {
+	client, err := pos.pool.GetContext(ctx, ip)
+	if err != nil {
+		return nil
+	}
+	return client
+}
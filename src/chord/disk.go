@@ -0,0 +1,324 @@
+package chord
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFile      = "wal"
+	snapshotFile = "snapshot"
+	compactAfter = 4096 // wal records before a snapshot is considered
+
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+var errBadRecord = errors.New("chord: bad wal record")
+
+// DiskEngine keeps every pair in memory and makes it durable with a write-ahead log under dir.
+// The log is folded into a snapshot once it grows larger than the data it describes.
+type DiskEngine struct {
+	dir     string
+	data    map[string]Value
+	wal     logFile
+	size    int64 // bytes of whole records in wal, a failed write is cut back to it
+	records int   // records in wal
+	sync    bool  // fsync after every write
+	broken  error // set when a failed write could not be cut off, every later write fails with it
+}
+
+// logFile is what DiskEngine needs of its log, an *os.File outside of tests.
+type logFile interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// OpenDiskEngine loads the snapshot and replays the log found in dir, creating dir if needed.
+// With sync set every write is flushed to disk before it returns, otherwise only Close and snapshots flush.
+func OpenDiskEngine(dir string, sync bool) (*DiskEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ret := &DiskEngine{dir: dir, data: make(map[string]Value), sync: sync}
+	if err := ret.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ret.wal = wal
+	if err := ret.replay(); err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (pos *DiskEngine) loadSnapshot() error {
+	file, err := os.Open(filepath.Join(pos.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return gob.NewDecoder(bufio.NewReader(file)).Decode(&pos.data)
+}
+
+// replay applies the log on top of the snapshot.
+// A torn record at the tail, left by a crash in the middle of a write, is cut off.
+// A bad record with more of the log after it fails with errBadRecord and leaves the log alone.
+func (pos *DiskEngine) replay() error {
+	reader := bufio.NewReader(pos.wal)
+	var good int64
+	for {
+		op, kv, n, err := readRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == errBadRecord {
+			if _, more := reader.Peek(1); more == io.EOF {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		pos.apply(op, kv.Key, kv.Val)
+		pos.records++
+		good += n
+	}
+	if err := pos.wal.Truncate(good); err != nil {
+		return err
+	}
+	pos.size = good
+	_, err := pos.wal.Seek(good, io.SeekStart)
+	return err
+}
+
+func (pos *DiskEngine) apply(op byte, key string, val Value) {
+	if op == opPut {
+		pos.data[key] = val
+	} else {
+		delete(pos.data, key)
+	}
+}
+
+// a record is op, key, value, version time, writer, tombstone flag and expiry, then the crc32 of all of them.
+// Strings are prefixed with their uvarint length.
+func encodeRecord(op byte, key string, val Value) []byte {
+	buf := make([]byte, 0, 2+6*binary.MaxVarintLen64+len(key)+len(val.Val)+len(val.Ver.Writer)+4)
+	buf = append(buf, op)
+	buf = appendString(buf, key)
+	buf = appendString(buf, val.Val)
+	buf = binary.AppendVarint(buf, val.Ver.Time)
+	buf = appendString(buf, val.Ver.Writer)
+	if val.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendVarint(buf, val.Expire)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// recordReader keeps the bytes it reads, so the checksum can be verified.
+type recordReader struct {
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func (pos *recordReader) ReadByte() (byte, error) {
+	c, err := pos.reader.ReadByte()
+	if err == nil {
+		pos.buf = append(pos.buf, c)
+	}
+	return c, err
+}
+
+func (pos *recordReader) string() (string, error) {
+	size, err := binary.ReadUvarint(pos)
+	if err != nil {
+		return "", err
+	}
+	if size > 1<<30 {
+		return "", errBadRecord
+	}
+	ret := make([]byte, size)
+	if _, err := io.ReadFull(pos.reader, ret); err != nil {
+		return "", err
+	}
+	pos.buf = append(pos.buf, ret...)
+	return string(ret), nil
+}
+
+func readRecord(reader *bufio.Reader) (op byte, kv VersionedKV, n int64, err error) {
+	rec := recordReader{reader: reader}
+	if op, err = rec.ReadByte(); err != nil {
+		return
+	}
+	if op != opPut && op != opDelete {
+		err = errBadRecord
+		return
+	}
+	if kv.Key, err = rec.string(); err != nil {
+		return
+	}
+	if kv.Val.Val, err = rec.string(); err != nil {
+		return
+	}
+	if kv.Val.Ver.Time, err = binary.ReadVarint(&rec); err != nil {
+		return
+	}
+	if kv.Val.Ver.Writer, err = rec.string(); err != nil {
+		return
+	}
+	var deleted byte
+	if deleted, err = rec.ReadByte(); err != nil {
+		return
+	}
+	kv.Val.Deleted = deleted == 1
+	if kv.Val.Expire, err = binary.ReadVarint(&rec); err != nil {
+		return
+	}
+
+	var sum [4]byte
+	if _, err = io.ReadFull(reader, sum[:]); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(rec.buf) {
+		err = errBadRecord
+		return
+	}
+	return op, kv, int64(len(rec.buf) + 4), nil
+}
+
+// write logs a record before applying it. A record that fails half way is cut off the log again,
+// else replay would stop at it and lose every record written after.
+func (pos *DiskEngine) write(op byte, key string, val Value) error {
+	if pos.broken != nil {
+		return pos.broken
+	}
+	rec := encodeRecord(op, key, val)
+	_, err := pos.wal.Write(rec)
+	if err == nil && pos.sync {
+		err = pos.wal.Sync()
+	}
+	if err != nil {
+		pos.cut()
+		return err
+	}
+	pos.apply(op, key, val)
+	pos.size += int64(len(rec))
+	pos.records++
+	if pos.records > compactAfter && pos.records > 2*len(pos.data) {
+		return pos.Snapshot()
+	}
+	return nil
+}
+
+// cut drops whatever a failed write left behind the last whole record.
+func (pos *DiskEngine) cut() {
+	err := pos.wal.Truncate(pos.size)
+	if err == nil {
+		_, err = pos.wal.Seek(pos.size, io.SeekStart)
+	}
+	if err != nil {
+		pos.broken = err
+	}
+}
+
+// Snapshot writes the whole data set next to the log and empties the log.
+// A crash in between leaves a log that is replayed on top of the new snapshot, which changes nothing.
+func (pos *DiskEngine) Snapshot() error {
+	tmp := filepath.Join(pos.dir, snapshotFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = gob.NewEncoder(writer).Encode(pos.data)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(pos.dir, snapshotFile))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(pos.dir); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	if err := pos.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := pos.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	pos.size = 0
+	pos.records = 0
+	return nil
+}
+
+func (pos *DiskEngine) Get(key string) (Value, bool) {
+	val, ok := pos.data[key]
+	return val, ok
+}
+
+func (pos *DiskEngine) Put(key string, val Value) error {
+	return pos.write(opPut, key, val)
+}
+
+func (pos *DiskEngine) Delete(key string) error {
+	if _, ok := pos.data[key]; !ok {
+		return nil
+	}
+	return pos.write(opDelete, key, Value{})
+}
+
+func (pos *DiskEngine) Range(f func(key string, val Value) bool) {
+	for k, v := range pos.data {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (pos *DiskEngine) Len() int {
+	return len(pos.data)
+}
+
+func (pos *DiskEngine) Close() error {
+	err := pos.wal.Sync()
+	if cerr := pos.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package chord
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDiskEngineReplay(t *testing.T) {
+	dir := t.TempDir()
+	eng, err := OpenDiskEngine(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*compactAfter; i++ { // crosses a snapshot
+		key := "key-" + strconv.Itoa(i%100)
+		if err := eng.Put(key, Value{Val: strconv.Itoa(i), Ver: Version{int64(i), "node"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = eng.Put("key-1", Value{Val: "last", Ver: Version{1 << 40, "node"}})
+	_ = eng.Delete("key-0")
+	if err := eng.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn record at the tail of the log
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := encodeRecord(opPut, "key-1", Value{Val: "torn"})
+	_, _ = wal.Write(record[:len(record)-2])
+	_ = wal.Close()
+
+	eng, err = OpenDiskEngine(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	if eng.Len() != 99 {
+		t.Fatalf("got %d keys after replay, want 99", eng.Len())
+	}
+	if _, ok := eng.Get("key-0"); ok {
+		t.Fatal("deleted key-0 came back")
+	}
+	if val, _ := eng.Get("key-1"); val.Val != "last" || val.Ver.Time != 1<<40 {
+		t.Fatalf("got key-1 = %+v after replay", val)
+	}
+	if err := eng.Put("key-0", Value{Val: "again"}); err != nil { // the log is writable after the cut
+		t.Fatal(err)
+	}
+
+	// a write stopping half way is cut off, the records after it replay
+	short := &shortLog{logFile: eng.wal, fail: true}
+	eng.wal = short
+	if err := eng.Put("key-2", Value{Val: "short"}); err != errShortLog {
+		t.Fatalf("short write: got %v, want %v", err, errShortLog)
+	}
+	if val, _ := eng.Get("key-2"); val.Val == "short" {
+		t.Fatal("short write was applied")
+	}
+	short.fail = false
+	if err := eng.Put("key-3", Value{Val: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eng, err = OpenDiskEngine(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	if val, _ := eng.Get("key-2"); val.Val == "short" {
+		t.Fatal("short write came back after replay")
+	}
+	for key, want := range map[string]string{"key-0": "again", "key-3": "after"} {
+		if val, _ := eng.Get(key); val.Val != want {
+			t.Fatalf("got %s = %q after replay, want %q", key, val.Val, want)
+		}
+	}
+
+	// the engine gives up when the short write can not be cut off either
+	short = &shortLog{logFile: eng.wal, fail: true, stuck: true}
+	eng.wal = short
+	if err := eng.Put("key-4", Value{Val: "short"}); err != errShortLog {
+		t.Fatalf("short write: got %v, want %v", err, errShortLog)
+	}
+	short.fail, short.stuck = false, false
+	if err := eng.Put("key-5", Value{Val: "after"}); err != errShortLog {
+		t.Fatalf("write after a failed cut: got %v, want %v", err, errShortLog)
+	}
+}
+
+func TestDiskEngineCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	eng, err := OpenDiskEngine(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := eng.Put("key-"+strconv.Itoa(i), Value{Val: strconv.Itoa(i), Ver: Version{int64(i), "node"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := eng.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one flipped bit in the middle of the log, the records after it are still good
+	path := filepath.Join(dir, walFile)
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log[len(log)/2] ^= 1
+	if err := os.WriteFile(path, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if eng, err := OpenDiskEngine(dir, false); err != errBadRecord {
+		if err == nil {
+			_ = eng.Close()
+		}
+		t.Fatalf("open a corrupt log: got %v, want %v", err, errBadRecord)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, log) {
+		t.Fatalf("open a corrupt log changed it from %d to %d bytes", len(log), len(after))
+	}
+}
+
+var errShortLog = errors.New("short write")
+
+// shortLog writes half of a record and fails while fail is set, and can not truncate while stuck is.
+type shortLog struct {
+	logFile
+	fail  bool
+	stuck bool
+}
+
+func (pos *shortLog) Write(p []byte) (int, error) {
+	if !pos.fail {
+		return pos.logFile.Write(p)
+	}
+	n, _ := pos.logFile.Write(p[:len(p)/2])
+	return n, errShortLog
+}
+
+func (pos *shortLog) Truncate(size int64) error {
+	if pos.stuck {
+		return errShortLog
+	}
+	return pos.logFile.Truncate(size)
+}
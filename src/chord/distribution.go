@@ -0,0 +1,140 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRingWalk bounds the walks around the ring, a broken ring must not keep them going forever.
+const maxRingWalk = 1 << 16
+
+// Load is what one ring position holds.
+type Load struct {
+	Self Edge
+	Pre  Edge
+	Suc  Edge
+	Keys int // live keys in sto
+}
+
+func (pos *Node) GetLoad(_ int, ret *Load) error {
+	pos.lock.Lock()
+	ret.Self = Edge{pos.Ip, pos.id}
+	ret.Pre = pos.pre
+	ret.Suc = pos.sucList[0]
+	pos.lock.Unlock()
+
+	ret.Keys = 0
+	now := time.Now().UnixNano()
+	pos.sto.lock.Lock()
+	pos.sto.eng.Range(func(_ string, v Value) bool {
+		if v.live(now) {
+			ret.Keys++
+		}
+		return true
+	})
+	pos.sto.lock.Unlock()
+	return nil
+}
+
+// HostLoad sums the ring positions of one host.
+type HostLoad struct {
+	Host      string
+	Positions int
+	Keys      int
+	RingShare float64 // part of the hash space the host owns
+	KeyShare  float64
+}
+
+// Distribution is the key load of a ring, one line per host.
+type Distribution struct {
+	Hosts []HostLoad
+	Keys  int
+}
+
+// Distribution walks the ring through successors and reports how the keys are spread over the hosts.
+func (pos *Node) Distribution() (Distribution, error) {
+	return pos.DistributionContext(context.Background())
+}
+
+// DistributionContext is Distribution giving up when ctx is done.
+func (pos *Node) DistributionContext(ctx context.Context) (Distribution, error) {
+	var ret Distribution
+	hosts := make(map[string]*HostLoad)
+	total := new(big.Float).SetInt(mod)
+
+	ip := pos.Ip
+	for i := 0; i < maxRingWalk; i++ {
+		client := pos.dialContext(ctx, ip)
+		if client == nil {
+			return ret, pos.fail(dhterr.FromContext(ctx, "Distribution", ip, dhterr.ErrDial))
+		}
+		var load Load
+		err := client.CallContext(ctx, "RPCNode.GetLoad", 0, &load)
+		_ = client.Close()
+		if err != nil {
+			return ret, pos.fail(dhterr.FromRPC("Distribution", ip, err))
+		}
+
+		h, ok := hosts[hostOf(load.Self.Ip)]
+		if !ok {
+			h = &HostLoad{Host: hostOf(load.Self.Ip)}
+			hosts[h.Host] = h
+		}
+		h.Positions++
+		h.Keys += load.Keys
+		ret.Keys += load.Keys
+		if load.Pre.Ip != "" {
+			arc := distance(&load.Pre.Id, &load.Self.Id)
+			if arc.Sign() == 0 { // alone on the ring
+				arc.Set(mod)
+			}
+			share, _ := new(big.Float).Quo(new(big.Float).SetInt(arc), total).Float64()
+			h.RingShare += share
+		}
+
+		ip = load.Suc.Ip
+		if ip == pos.Ip || ip == "" {
+			break
+		}
+	}
+
+	for _, h := range hosts {
+		if ret.Keys > 0 {
+			h.KeyShare = float64(h.Keys) / float64(ret.Keys)
+		}
+		ret.Hosts = append(ret.Hosts, *h)
+	}
+	sort.Slice(ret.Hosts, func(i, j int) bool {
+		return ret.Hosts[i].Host < ret.Hosts[j].Host
+	})
+	return ret, nil
+}
+
+// Imbalance is the most keys on one host over the mean, 1 is a perfect spread.
+func (pos Distribution) Imbalance() float64 {
+	if len(pos.Hosts) == 0 || pos.Keys == 0 {
+		return 0
+	}
+	most := 0
+	for _, h := range pos.Hosts {
+		if h.Keys > most {
+			most = h.Keys
+		}
+	}
+	return float64(most) * float64(len(pos.Hosts)) / float64(pos.Keys)
+}
+
+func (pos Distribution) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-24s %9s %8s %8s %8s\n", "host", "positions", "keys", "keys%", "ring%")
+	for _, h := range pos.Hosts {
+		fmt.Fprintf(&b, "%-24s %9d %8d %7.2f%% %7.2f%%\n", h.Host, h.Positions, h.Keys, h.KeyShare*100, h.RingShare*100)
+	}
+	fmt.Fprintf(&b, "%d keys on %d hosts, imbalance %.2f\n", pos.Keys, len(pos.Hosts), pos.Imbalance())
+	return b.String()
+}
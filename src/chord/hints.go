@@ -0,0 +1,124 @@
+package chord
+
+import (
+	"time"
+)
+
+// hints are handed off at most this often.
+const hintPeriod = 500 * time.Millisecond
+
+// maxHints bounds the writes kept for replicas that are away, past it the oldest replica's hints are dropped
+// and left to anti-entropy.
+const maxHints = 1 << 16
+
+// hint keeps a write a replica could not be reached for, the newest value of every key it missed.
+func (pos *Node) hint(ip string, args interface{}) {
+	var kv map[string]Value
+	switch x := args.(type) {
+	case *PreKeyValue:
+		kv = map[string]Value{x.Key: x.Val}
+	case *PreData:
+		kv = x.Data
+	default:
+		pos.markDirty()
+		return
+	}
+
+	pos.hintLock.Lock()
+	defer pos.hintLock.Unlock()
+	if pos.hints[ip] == nil {
+		pos.hints[ip] = make(map[string]Value)
+	}
+	for k, v := range kv {
+		old, ok := pos.hints[ip][k]
+		if !ok {
+			pos.hintCount++
+		}
+		if !ok || v.Ver.Newer(old.Ver) {
+			pos.hints[ip][k] = v
+		}
+	}
+	for pos.hintCount > maxHints {
+		var most string
+		for x := range pos.hints {
+			if most == "" || len(pos.hints[x]) > len(pos.hints[most]) {
+				most = x
+			}
+		}
+		pos.hintCount -= len(pos.hints[most])
+		delete(pos.hints, most)
+		pos.metrics.hintsDropped.Inc()
+	}
+}
+
+// Hints returns how many writes are waiting for their replica.
+func (pos *Node) Hints() int {
+	pos.hintLock.Lock()
+	defer pos.hintLock.Unlock()
+	return pos.hintCount
+}
+
+// handOffHints delivers the writes kept for replicas that are back when the period is up.
+// Hints for a replica that is no longer a target go to the current targets instead,
+// which may have the writes already, replicas keep the newer value anyway. They are kept while there are none.
+func (pos *Node) handOffHints() {
+	now := time.Now()
+	if now.Sub(pos.lastHandOff) < hintPeriod {
+		return
+	}
+	pos.lastHandOff = now
+
+	pos.hintLock.Lock()
+	pending := make(map[string]map[string]Value, len(pos.hints))
+	for ip, kv := range pos.hints {
+		pending[ip] = make(map[string]Value, len(kv))
+		for k, v := range kv {
+			pending[ip][k] = v
+		}
+	}
+	pos.hintLock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	targets := pos.replicaTargets()
+	self := Edge{pos.Ip, pos.id}
+	for ip, kv := range pending {
+		to := []string{ip}
+		if !contains(targets, ip) {
+			to = targets
+		}
+		delivered := len(to) > 0
+		for _, x := range to {
+			delivered = delivered && pos.deliverHint(x, &PreData{self, kv})
+		}
+		if !delivered {
+			continue
+		}
+
+		// keys written again since the copy was taken stay
+		pos.hintLock.Lock()
+		for k, v := range kv {
+			if cur, ok := pos.hints[ip][k]; ok && cur.Ver == v.Ver {
+				delete(pos.hints[ip], k)
+				pos.hintCount--
+			}
+		}
+		if len(pos.hints[ip]) == 0 {
+			delete(pos.hints, ip)
+		}
+		pos.hintLock.Unlock()
+		pos.metrics.hintsDelivered.Add(float64(len(kv)))
+	}
+}
+
+// deliverHint sends hinted writes to ip, a replica still away is not logged again.
+func (pos *Node) deliverHint(ip string, dat *PreData) bool {
+	client := pos.dial(ip)
+	if client == nil {
+		return false
+	}
+	err := client.Call("RPCNode.InsertDataPreBatch", dat, nil)
+	_ = client.Close()
+	return err == nil
+}
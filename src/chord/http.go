@@ -0,0 +1,51 @@
+package chord
+
+import (
+	"net"
+	"net/http"
+)
+
+// httpRoutes groups the HTTP handlers of a node by the address they are offered on,
+// handlers given the same address share one listener.
+type httpRoutes map[string]*http.ServeMux
+
+func (pos httpRoutes) handle(addr string, path string, h http.Handler) {
+	if addr == "" {
+		return
+	}
+	if pos[addr] == nil {
+		pos[addr] = http.NewServeMux()
+	}
+	pos[addr].Handle(path, h)
+}
+
+// listen starts one server per address. On failure the servers already started are closed.
+func (pos httpRoutes) listen() ([]*http.Server, error) {
+	var ret []*http.Server
+	for addr, mux := range pos {
+		srv, err := listenHTTP(addr, mux)
+		if err != nil {
+			closeHTTP(ret)
+			return nil, err
+		}
+		ret = append(ret, srv)
+	}
+	return ret, nil
+}
+
+// listenHTTP serves h on a TCP listener of addr in the background. Close the server to stop it.
+func listenHTTP(addr string, h http.Handler) (*http.Server, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go func() { _ = srv.Serve(listen) }()
+	return srv, nil
+}
+
+func closeHTTP(servers []*http.Server) {
+	for _, srv := range servers {
+		_ = srv.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"errors"
+	"math/big"
+	"time"
+)
+
+type LookupMode int
+
+const (
+	LookupRecursive LookupMode = iota // every hop forwards the lookup to the next one
+	LookupIterative                   // the originator asks every hop for the next one itself
+)
+
+const (
+	stepCandidates = 4   // preceding nodes a hop suggests, the later ones are tried when the first is dead
+	maxHops        = Len // a lookup going further than this is looping
+)
+
+// LookupStep is the answer of one hop of an iterative lookup.
+// When Done is set Next holds the successor of the key, otherwise the nodes to ask next, closest first.
+type LookupStep struct {
+	Done bool
+	Next []Edge
+}
+
+// PrecedingNodes answers one hop of an iterative lookup of h, it is served as RPCNode.ClosestPrecedingNode.
+// Only a dead successor list fails the hop. A new successor turning down the Notify of FixList
+// is left to stabilize, the hop still answers with it.
+func (pos *Node) PrecedingNodes(h *big.Int, ret *LookupStep) error {
+	if err := pos.FixList(); errors.Is(err, dhterr.ErrAllSuccessorsFailed) {
+		return pos.fail(dhterr.New("PrecedingNodes", "", dhterr.ErrAllSuccessorsFailed))
+	}
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+
+	suc := pos.sucList[0]
+	if inRange(&pos.id, &suc.Id, h) {
+		ret.Done = true
+		ret.Next = []Edge{suc}
+		return nil
+	}
+
+	ret.Done = false
+	ret.Next = ret.Next[:0]
+	seen := map[string]bool{"": true, pos.Ip: true}
+	add := func(x Edge) {
+		if !seen[x.Ip] && inRange(&pos.id, h, &x.Id) {
+			seen[x.Ip] = true
+			ret.Next = append(ret.Next, x)
+		}
+	}
+	for i := Len - 1; i >= 0 && len(ret.Next) < stepCandidates; i-- {
+		add(pos.finger[i])
+	}
+	// successors always make progress, they are the last resort
+	for i := 0; i < SucListLen; i++ {
+		add(pos.sucList[i])
+	}
+	return nil
+}
+
+// step asks x for the next hop towards h.
+func (pos *Node) step(ctx context.Context, x Edge, h *big.Int, ret *LookupStep) error {
+	if x.Ip == pos.Ip {
+		return pos.PrecedingNodes(h, ret)
+	}
+	client := pos.dialContext(ctx, x.Ip)
+	if client == nil {
+		return dhterr.FromContext(ctx, "FindSuccessor", x.Ip, dhterr.ErrDial)
+	}
+	err := client.CallContext(ctx, "RPCNode.ClosestPrecedingNode", h, ret)
+	_ = client.Close()
+	if err != nil {
+		if ctx.Err() == nil { // the connection is fine when the call was only given up
+			pos.pool.Invalidate(x.Ip)
+		}
+		return dhterr.FromRPC("FindSuccessor", x.Ip, err)
+	}
+	return nil
+}
+
+// findSuccessorIterative drives the lookup of h from this node, every node asked is appended to trace unless it is nil.
+// A hop that fails is skipped for the next candidate it was listed with, or for those of earlier hops.
+func (pos *Node) findSuccessorIterative(ctx context.Context, h *big.Int, ret *Edge, trace *LookupTrace) error {
+	cands := []Edge{{pos.Ip, pos.id}}
+	tried := make(map[string]bool)
+
+	for hop := 0; hop < maxHops; hop++ {
+		if err := ctx.Err(); err != nil {
+			return pos.fail(dhterr.Wrap("FindSuccessor", "", dhterr.ErrCanceled, err))
+		}
+		var step LookupStep
+		found := false
+		for len(cands) > 0 && !found {
+			x := cands[0]
+			cands = cands[1:]
+			if tried[x.Ip] {
+				continue
+			}
+			tried[x.Ip] = true
+			start := time.Now()
+			err := pos.step(ctx, x, h, &step)
+			if trace != nil {
+				trace.Hops = append(trace.Hops, newHop(x, start, err))
+			}
+			if err != nil && ctx.Err() != nil {
+				return pos.fail(dhterr.Wrap("FindSuccessor", "", dhterr.ErrCanceled, ctx.Err()))
+			}
+			if err != nil {
+				pos.log.Debug("FindSuccessor", "hop failed, trying the next candidate", "peer", x.Ip, "cause", err)
+				continue
+			}
+			found = true
+		}
+		if !found {
+			return pos.fail(dhterr.New("FindSuccessor", "", dhterr.ErrLookup))
+		}
+		if step.Done {
+			*ret = step.Next[0]
+			return nil
+		}
+		cands = append(step.Next, cands...)
+	}
+	return pos.fail(dhterr.New("FindSuccessor", "", dhterr.ErrLookup))
+}
@@ -0,0 +1,133 @@
+package chord
+
+import (
+	"dhtmetrics"
+	"net"
+	"net/http"
+	"net/rpc"
+	"rpcpool"
+	"time"
+)
+
+// nodeMetrics are the counters of one node, served in the Prometheus text format.
+type nodeMetrics struct {
+	reg *dhtmetrics.Registry
+
+	served        *dhtmetrics.Counter
+	servedSeconds *dhtmetrics.Histogram
+	issued        *dhtmetrics.Counter
+	issuedSeconds *dhtmetrics.Histogram
+	dialFailures  *dhtmetrics.Counter
+
+	lookupSeconds *dhtmetrics.Histogram
+	lookupHops    *dhtmetrics.Histogram
+	forwarded     *dhtmetrics.Counter
+
+	stabilize *dhtmetrics.Counter
+	notify    *dhtmetrics.Counter
+	repairs   *dhtmetrics.Counter
+	dropped   *dhtmetrics.Counter
+
+	antiEntropy     *dhtmetrics.Counter
+	antiEntropyKeys *dhtmetrics.Counter
+	readRepairs     *dhtmetrics.Counter
+	quorumFailures  *dhtmetrics.Counter
+	hintsDelivered  *dhtmetrics.Counter
+	hintsDropped    *dhtmetrics.Counter
+	authRejected    *dhtmetrics.Counter
+}
+
+func newNodeMetrics(pos *Node) *nodeMetrics {
+	reg := dhtmetrics.NewRegistry()
+	ret := &nodeMetrics{
+		reg: reg,
+
+		served:        reg.Counter("chord_rpc_served_total", "RPCs answered by this node.", "method", "result"),
+		servedSeconds: reg.Histogram("chord_rpc_served_seconds", "Time spent answering RPCs.", dhtmetrics.DefBuckets, "method"),
+		issued:        reg.Counter("chord_rpc_issued_total", "RPCs sent by this node.", "method", "result"),
+		issuedSeconds: reg.Histogram("chord_rpc_issued_seconds", "Time until RPCs sent by this node were answered.", dhtmetrics.DefBuckets, "method"),
+		dialFailures:  reg.Counter("chord_dial_failures_total", "Connections to other nodes that could not be opened."),
+
+		lookupSeconds: reg.Histogram("chord_lookup_seconds", "Time FindSuccessor took on this node.", dhtmetrics.DefBuckets, "mode", "result"),
+		lookupHops:    reg.Histogram("chord_lookup_hops", "Nodes answering a lookup after the first, only known to iterative and traced lookups.", dhtmetrics.LinearBuckets(0, 1, 16), "mode"),
+		forwarded:     reg.Counter("chord_lookup_forwarded_total", "Recursive lookups this node handed on to the next hop."),
+
+		stabilize: reg.Counter("chord_stabilize_total", "Stabilize rounds by outcome.", "result"),
+		notify:    reg.Counter("chord_notify_total", "Notify calls received, accepted when the caller is the predecessor afterwards.", "result"),
+		repairs:   reg.Counter("chord_successor_repairs_total", "Times dead entries were dropped from the head of the successor list."),
+		dropped:   reg.Counter("chord_successor_dropped_total", "Dead successors dropped from the successor list."),
+
+		antiEntropy:     reg.Counter("chord_anti_entropy_total", "Anti-entropy rounds with one replica by outcome.", "result"),
+		antiEntropyKeys: reg.Counter("chord_anti_entropy_keys_total", "Keys anti-entropy pushed to replicas, pulled from them or dropped on them.", "dir"),
+		readRepairs:     reg.Counter("chord_read_repairs_total", "Stale copies read repair fixed, on the owner itself or on a replica.", "target"),
+		hintsDelivered:  reg.Counter("chord_hints_delivered_total", "Writes handed off to a replica that was away or to the successor that took its place."),
+		hintsDropped:    reg.Counter("chord_hints_dropped_total", "Times the hints of a replica were dropped because too many were kept."),
+		authRejected:    reg.Counter("chord_auth_rejected_total", "Connections that failed to authenticate and client requests to maintenance RPCs."),
+		quorumFailures:  reg.Counter("chord_quorum_failures_total", "Reads and writes owned by this node that fewer copies than their quorum answered.", "op"),
+	}
+
+	reg.GaugeFunc("chord_hints", "Writes waiting for a replica that could not be reached.", func() float64 {
+		return float64(pos.Hints())
+	})
+	reg.GaugeVecFunc("chord_keys", "Entries kept by this node, sto for the keys it owns and dataPre for the replicas of its predecessors.", "store", func() map[string]float64 {
+		pos.sto.lock.Lock()
+		sto := pos.sto.eng.Len()
+		pos.sto.lock.Unlock()
+		pos.dataPre.lock.Lock()
+		pre := pos.dataPre.eng.Len()
+		pos.dataPre.lock.Unlock()
+		return map[string]float64{"sto": float64(sto), "dataPre": float64(pre)}
+	})
+	return ret
+}
+
+// observer counts the calls of one side of an RPC by method and result.
+func observer(count *dhtmetrics.Counter, seconds *dhtmetrics.Histogram) rpcpool.ObserveFunc {
+	return func(method string, elapsed time.Duration, err error) {
+		count.Inc(method, result(err))
+		seconds.Observe(elapsed.Seconds(), method)
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (pos LookupMode) String() string {
+	if pos == LookupIterative {
+		return "iterative"
+	}
+	return "recursive"
+}
+
+// Metrics serves the metrics of this node in the Prometheus text format.
+func (pos *Node) Metrics() http.Handler {
+	return pos.metrics.reg
+}
+
+// Serve answers the RPCs registered on server over l until l is closed, counting them in the metrics of this node.
+// The listeners of Config.MetricsAddr and Config.AdminAddr, if any, run meanwhile.
+// With Config.PeerKey set, callers that do not authenticate are turned away and clients may call ClientNode alone.
+func (pos *Node) Serve(server *rpc.Server, l net.Listener) {
+	routes := make(httpRoutes)
+	routes.handle(pos.metricsAddr, "/metrics", pos.Metrics())
+	routes.handle(pos.adminAddr, "/admin", pos.Admin())
+	servers, err := routes.listen()
+	if err != nil {
+		pos.log.Warn("Serve", "http listener failed", "metrics", pos.metricsAddr, "admin", pos.adminAddr, "cause", err)
+	}
+	defer closeHTTP(servers)
+
+	rpcpool.ServeWith(server, l, rpcpool.ServeOptions{
+		Observe: observer(pos.metrics.served, pos.metrics.servedSeconds),
+		Keys:    pos.keys,
+		Client:  []string{"ClientNode"},
+		Rejected: func(addr string, err error) {
+			pos.metrics.authRejected.Inc()
+			pos.log.Warn("Serve", "caller rejected", "peer", addr, "cause", err)
+		},
+	})
+}
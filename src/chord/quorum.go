@@ -0,0 +1,171 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"errors"
+)
+
+// Quorums count copies of a key, the owner's included, so they range from 1 to the replicas of the ring.
+// A write quorum of 0 only waits for the owner, the replicas are written one after the other and the ones away get
+// a hint.
+
+// EraseArgs carries a delete to the owner of Key, W is the write quorum.
+type EraseArgs struct {
+	Key string
+	W   int
+}
+
+func (pos *Node) clampQuorum(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > pos.replicas {
+		return pos.replicas
+	}
+	return n
+}
+
+// quorum is n, or def when n is 0.
+func (pos *Node) quorum(n int, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+func (pos *Node) checkQuorum(op string, n int) error {
+	if n < 0 || n > pos.replicas {
+		return dhterr.New(op, "", dhterr.ErrBadArgument)
+	}
+	return nil
+}
+
+// replicateWrite sends a write the owner stored to every replica target at once and returns when w copies are
+// stored. Replicas still being written then finish in the background, the ones that fail get a hint.
+func (pos *Node) replicateWrite(op string, method string, args interface{}, w int) error {
+	if w == 0 {
+		pos.fanOut(op, method, args)
+		return nil
+	}
+	targets := pos.replicaTargets()
+	acks := make(chan error, len(targets))
+	for _, ip := range targets {
+		go func(ip string) {
+			err := pos.callReplica(op, ip, method, args)
+			if err != nil {
+				pos.hint(ip, args)
+			}
+			acks <- err
+		}(ip)
+	}
+
+	stored := 1
+	var last error
+	for i := 0; i < len(targets) && stored < w; i++ {
+		if err := <-acks; err != nil {
+			last = err
+		} else {
+			stored++
+		}
+	}
+	if stored < w {
+		pos.metrics.quorumFailures.Inc("write")
+		return pos.fail(dhterr.Wrap(op, "", dhterr.ErrQuorum, last), "stored", stored, "quorum", w)
+	}
+	return nil
+}
+
+// InsertKeyValQuorum is InsertKeyValContext returning once w copies are stored, 0 for the default rule.
+// A write that misses its quorum is not undone, the copies that stored it keep it.
+func (pos *Node) InsertKeyValQuorum(ctx context.Context, key string, val string, w int) error {
+	if err := pos.checkQuorum("InsertKeyVal", w); err != nil {
+		return err
+	}
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(key), &temp)
+	if err != nil {
+		return pos.fail(dhterr.Wrap("InsertKeyVal", "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "InsertKeyVal", ip, dhterr.ErrDial))
+	}
+	err = client.CallContext(ctx, "RPCNode.InsertInside", KeyValue{Key: key, Val: val, W: w}, nil)
+	_ = client.Close()
+	if err != nil {
+		return pos.fail(dhterr.FromRPC("InsertKeyVal", ip, err))
+	}
+
+	return nil
+}
+
+// EraseQuorum is EraseInside returning once w copies of the tombstone are stored.
+func (pos *Node) EraseQuorum(args EraseArgs, _ *int) error {
+	return pos.eraseInside(args.Key, args.W)
+}
+
+// EraseKeyQuorum is EraseKeyContext returning once w copies are erased, 0 for the default rule.
+func (pos *Node) EraseKeyQuorum(ctx context.Context, key string, w int) error {
+	if err := pos.checkQuorum("EraseKey", w); err != nil {
+		return err
+	}
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(key), &temp)
+	if err != nil {
+		return pos.fail(dhterr.Wrap("EraseKey", "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "EraseKey", ip, dhterr.ErrDial))
+	}
+	err = client.CallContext(ctx, "RPCNode.EraseQuorum", &EraseArgs{key, w}, nil)
+	_ = client.Close()
+	if err != nil {
+		return pos.fail(dhterr.FromRPC("EraseKey", ip, err))
+	}
+
+	return nil
+}
+
+// QueryQuorum is QueryVersionedContext answering the newest of r copies, 0 for the owner's alone.
+// Reads of more than one copy go through QueryRepaired, so the copies found stale are fixed.
+func (pos *Node) QueryQuorum(ctx context.Context, key string, r int, ret *Value) error {
+	if err := pos.checkQuorum("QueryVal", r); err != nil {
+		return err
+	}
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(key), &temp) // fail when findNode returns node which does not store key.
+	if err != nil {
+		return pos.fail(dhterr.Wrap("QueryVal", "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "QueryVal", ip, dhterr.ErrDial))
+	}
+
+	var value Value // a call given up may still write its reply
+	if pos.readRepair || r > 1 {
+		err = client.CallContext(ctx, "RPCNode.QueryRepaired", &ReadArgs{key, budget(ctx), r}, &value)
+	} else {
+		err = client.CallContext(ctx, "RPCNode.QueryInside", key, &value)
+	}
+	_ = client.Close()
+
+	if err != nil {
+		err = dhterr.FromRPC("QueryVal", ip, err)
+		if errors.Is(err, dhterr.ErrNotFound) {
+			return err
+		}
+		return pos.fail(err)
+	}
+
+	*ret = value
+	return nil
+}
@@ -0,0 +1,133 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"time"
+)
+
+// ReadArgs carries a read to the owner of Key, R is the read quorum.
+// Budget is what is left of the caller's deadline, 0 for none.
+type ReadArgs struct {
+	Key    string
+	Budget time.Duration
+	R      int
+}
+
+// ReplicaValue is the copy of a key a replica holds, Ok is false when it has none.
+type ReplicaValue struct {
+	Val Value
+	Ok  bool
+}
+
+// QueryDataPre answers the copy of key dataPre holds, tombstones and expired values included.
+func (pos *Node) QueryDataPre(key string, ret *ReplicaValue) error {
+	pos.dataPre.lock.Lock()
+	ret.Val, ret.Ok = pos.dataPre.eng.Get(key)
+	pos.dataPre.lock.Unlock()
+	return nil
+}
+
+// QueryRepaired is QueryInside comparing the value of the owner with the copies of the replicas.
+// All replicas are asked at once and the newest of the first r copies, the owner's included, is answered.
+// The copies found stale are fixed in the background, which with read repair on waits for the other replicas too.
+func (pos *Node) QueryRepaired(ctx context.Context, key string, r int, ret *Value) error {
+	if err := pos.checkQuorum("QueryRepaired", r); err != nil {
+		return err
+	}
+	pos.sto.lock.Lock()
+	own, ok := pos.sto.eng.Get(key)
+	pos.sto.lock.Unlock()
+
+	type answer struct {
+		ip  string
+		c   ReplicaValue
+		err error
+	}
+	// the replicas not waited for answer to the background after this returns
+	callCtx, cancel := detach(ctx)
+	targets := pos.replicaTargets()
+	answers := make(chan answer, len(targets))
+	for _, ip := range targets {
+		go func(ip string) {
+			client := pos.dialContext(callCtx, ip)
+			if client == nil {
+				answers <- answer{ip, ReplicaValue{}, dhterr.FromContext(callCtx, "QueryRepaired", ip, dhterr.ErrDial)}
+				return
+			}
+			var c ReplicaValue
+			err := client.CallContext(callCtx, "RPCNode.QueryDataPre", key, &c)
+			_ = client.Close()
+			answers <- answer{ip, c, err}
+		}(ip)
+	}
+
+	newest, found := own, ok
+	copies := make(map[string]ReplicaValue)
+	pending := len(targets)
+	take := func(a answer) {
+		pending--
+		if a.err != nil {
+			return
+		}
+		copies[a.ip] = a.c
+		if a.c.Ok && (!found || a.c.Val.Ver.Newer(newest.Ver)) {
+			newest, found = a.c.Val, true
+		}
+	}
+wait:
+	for pending > 0 && 1+len(copies) < r {
+		select {
+		case a := <-answers:
+			take(a)
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	val, hit, answered := newest, found, 1+len(copies)
+
+	go func() {
+		defer cancel()
+		for pos.readRepair && pending > 0 {
+			take(<-answers)
+		}
+		if found {
+			pos.repairRead(key, newest, own, ok, copies)
+		}
+	}()
+
+	if answered < r {
+		pos.metrics.quorumFailures.Inc("read")
+		return pos.fail(dhterr.New("QueryRepaired", "", dhterr.ErrQuorum), "answered", answered, "quorum", r)
+	}
+	if !hit || !val.live(time.Now().UnixNano()) {
+		return dhterr.New("QueryRepaired", "", dhterr.ErrNotFound)
+	}
+	*ret = val
+	return nil
+}
+
+// repairRead writes newest to the owner and the replicas whose copy is missing or older.
+func (pos *Node) repairRead(key string, newest Value, own Value, ok bool, copies map[string]ReplicaValue) {
+	if !ok || newest.Ver.Newer(own.Ver) {
+		pos.witness(newest.Ver)
+		pos.sto.lock.Lock()
+		_, err := pos.sto.merge(key, newest)
+		pos.sto.lock.Unlock()
+		if err != nil {
+			_ = pos.fail(dhterr.Wrap("readRepair", "", dhterr.ErrStorage, err))
+			return
+		}
+		pos.metrics.readRepairs.Inc("owner")
+	}
+
+	kv := &PreKeyValue{Edge{pos.Ip, pos.id}, key, newest}
+	for ip, c := range copies {
+		if c.Ok && !newest.Ver.Newer(c.Val.Ver) {
+			continue
+		}
+		if pos.callReplica("readRepair", ip, "RPCNode.InsertDataPre", kv) == nil {
+			pos.metrics.readRepairs.Inc("replica")
+		}
+	}
+}
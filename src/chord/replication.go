@@ -0,0 +1,258 @@
+package chord
+
+import (
+	"dhterr"
+	"math/big"
+	"sort"
+)
+
+// DefaultReplicas keeps every key on its owner plus the successor's dataPre.
+const DefaultReplicas = 2
+
+// PreData is the replica of the keys one predecessor owns.
+type PreData struct {
+	Owner Edge
+	Data  map[string]Value
+}
+
+type PreKeyValue struct {
+	Owner Edge
+	Key   string
+	Val   Value
+}
+
+// replicaTargets returns the successors holding replicas of sto, nearest first.
+// Every copy is on another host, virtual nodes sharing a machine with the owner or an earlier replica are skipped.
+func (pos *Node) replicaTargets() []string {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+
+	ret := make([]string, 0, pos.replicas-1)
+	seen := map[string]bool{"": true, hostOf(pos.Ip): true}
+	for i := 0; i < SucListLen && len(ret) < pos.replicas-1; i++ {
+		ip := pos.sucList[i].Ip
+		if host := hostOf(ip); ip != "" && !seen[host] {
+			seen[host] = true
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// markDirty makes the next replicate push the whole sto again.
+func (pos *Node) markDirty() {
+	pos.repLock.Lock()
+	pos.repDirty = true
+	pos.repLock.Unlock()
+}
+
+// replicate brings the replica targets up to date when they changed or sto was moved in bulk.
+// New targets get the whole sto, the others only the keys anti-entropy finds different.
+// Successors that are no longer targets are told to drop their copy.
+func (pos *Node) replicate() error {
+	targets := pos.replicaTargets()
+
+	pos.repLock.Lock()
+	old := pos.repTargets
+	if !pos.repDirty && sameList(old, targets) {
+		pos.repLock.Unlock()
+		return nil
+	}
+	pos.repTargets = targets
+	pos.repDirty = false
+	pos.repLock.Unlock()
+
+	self := Edge{pos.Ip, pos.id}
+	dat := PreData{self, pos.sto.copy()}
+	var ret error
+	for _, ip := range targets {
+		var err error
+		if contains(old, ip) {
+			_, err = pos.syncReplica(ip)
+		} else {
+			err = pos.callReplica("replicate", ip, "RPCNode.FillDataPre", &dat)
+		}
+		if err != nil {
+			pos.markDirty()
+			if ret == nil {
+				ret = err
+			}
+		}
+	}
+	for _, ip := range old {
+		if !contains(targets, ip) {
+			_ = pos.callReplica("replicate", ip, "RPCNode.DropDataPre", &self)
+		}
+	}
+	return ret
+}
+
+// callReplica sends one replication RPC to ip.
+func (pos *Node) callReplica(op string, ip string, method string, args interface{}) error {
+	client := pos.dial(ip)
+	if client == nil {
+		return pos.fail(dhterr.New(op, ip, dhterr.ErrDial))
+	}
+	err := client.Call(method, args, nil)
+	_ = client.Close()
+	if err != nil {
+		return pos.fail(dhterr.FromRPC(op, ip, err))
+	}
+	return nil
+}
+
+// fanOut sends a write to every replica target, the ones that can not be reached get a hint, see handOffHints.
+func (pos *Node) fanOut(op string, method string, args interface{}) {
+	for _, ip := range pos.replicaTargets() {
+		if err := pos.callReplica(op, ip, method, args); err != nil {
+			pos.hint(ip, args)
+		}
+	}
+}
+
+// InsertDataPre stores one write of a predecessor, deletes arrive as tombstones.
+func (pos *Node) InsertDataPre(kv PreKeyValue) {
+	pos.witness(kv.Val.Ver)
+	pos.dataPre.lock.Lock()
+	if changed, _ := pos.dataPre.merge(kv.Key, kv.Val); changed {
+		pos.preKeys[kv.Key] = kv.Owner.Ip
+	}
+	pos.preOwners[kv.Owner.Ip] = kv.Owner
+	pos.dataPre.lock.Unlock()
+}
+
+// FillDataPre replaces the replica of one predecessor, a newer value already here is kept.
+func (pos *Node) FillDataPre(dat PreData) {
+	pos.dataPre.lock.Lock()
+	for k, owner := range pos.preKeys {
+		if _, ok := dat.Data[k]; !ok && owner == dat.Owner.Ip {
+			_ = pos.dataPre.eng.Delete(k)
+			delete(pos.preKeys, k)
+		}
+	}
+	for k, v := range dat.Data {
+		pos.witness(v.Ver)
+		if changed, _ := pos.dataPre.merge(k, v); changed {
+			pos.preKeys[k] = dat.Owner.Ip
+		}
+	}
+	pos.preOwners[dat.Owner.Ip] = dat.Owner
+	pos.dataPre.lock.Unlock()
+}
+
+// DropDataPre forgets the replica of a predecessor that no longer replicates to this node.
+func (pos *Node) DropDataPre(owner Edge) {
+	pos.dataPre.lock.Lock()
+	pos.dropOwner(owner.Ip)
+	delete(pos.preOwners, owner.Ip)
+	pos.dataPre.lock.Unlock()
+}
+
+// dataPre.lock must be held.
+func (pos *Node) dropOwner(ip string) {
+	for k, owner := range pos.preKeys {
+		if owner == ip {
+			_ = pos.dataPre.eng.Delete(k)
+			delete(pos.preKeys, k)
+		}
+	}
+}
+
+// preData splits dataPre by owner.
+func (pos *Node) preData() []PreData {
+	pos.dataPre.lock.Lock()
+	groups := make(map[string]*PreData, len(pos.preOwners))
+	for ip, owner := range pos.preOwners {
+		groups[ip] = &PreData{owner, make(map[string]Value)}
+	}
+	for k, owner := range pos.preKeys {
+		groups[owner].Data[k], _ = pos.dataPre.eng.Get(k)
+	}
+	pos.dataPre.lock.Unlock()
+
+	ret := make([]PreData, 0, len(groups))
+	for _, g := range groups {
+		ret = append(ret, *g)
+	}
+	return ret
+}
+
+// MergeDataPre takes over the replicas of predecessors that are gone.
+// Owners are visited from the nearest one backwards, the first one alive still owns everything before it.
+func (pos *Node) MergeDataPre() {
+	pos.dataPre.lock.Lock()
+	owners := make([]Edge, 0, len(pos.preOwners))
+	for _, owner := range pos.preOwners {
+		if owner.Ip != pos.Ip {
+			owners = append(owners, owner)
+		}
+	}
+	pos.dataPre.lock.Unlock()
+
+	sort.Slice(owners, func(i, j int) bool {
+		return distance(&owners[i].Id, &pos.id).Cmp(distance(&owners[j].Id, &pos.id)) < 0
+	})
+	dead := make(map[string]bool)
+	for _, owner := range owners {
+		if pos.Ping(owner.Ip) == nil {
+			break
+		}
+		dead[owner.Ip] = true
+	}
+	if len(dead) == 0 {
+		return
+	}
+
+	var err error
+	pos.dataPre.lock.Lock()
+	pos.sto.lock.Lock()
+	for k, owner := range pos.preKeys {
+		if dead[owner] {
+			val, _ := pos.dataPre.eng.Get(k)
+			if _, err = pos.sto.merge(k, val); err != nil {
+				break
+			}
+			_ = pos.dataPre.eng.Delete(k)
+			delete(pos.preKeys, k)
+		}
+	}
+	if err == nil {
+		for ip := range dead {
+			delete(pos.preOwners, ip)
+		}
+	}
+	pos.dataPre.lock.Unlock()
+	pos.sto.lock.Unlock()
+
+	if err != nil {
+		_ = pos.fail(dhterr.Wrap("MergeDataPre", "", dhterr.ErrStorage, err))
+	}
+	pos.markDirty()
+}
+
+// clockwise distance from x to y on the ring.
+func distance(x *big.Int, y *big.Int) *big.Int {
+	ret := new(big.Int).Sub(y, x)
+	return ret.Mod(ret, mod)
+}
+
+func sameList(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
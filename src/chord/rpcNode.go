@@ -3,6 +3,7 @@ package chord
 import (
 	"math/big"
 	"net"
+	"time"
 )
 
 // Node used in RPC Calls
@@ -27,20 +28,67 @@ func (pos *RPCNode) FindSuccessor(h *big.Int, ret *Edge) error {
 	return pos.Data.FindSuccessor(h, ret)
 }
 
-func (pos *RPCNode) QueryInside(key string, ret *string) error {
+// FindSuccessorWithin is FindSuccessor under the deadline budget of the hop before.
+func (pos *RPCNode) FindSuccessorWithin(args *LookupArgs, ret *Edge) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.answerLookup(ctx, &args.H, ret)
+}
+
+func (pos *RPCNode) TraceSuccessor(args *LookupArgs, ret *LookupTrace) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.traceSuccessor(ctx, &args.H, ret)
+}
+
+func (pos *RPCNode) QueryInside(key string, ret *Value) error {
 	return pos.Data.QueryInside(key, ret)
 }
 
+func (pos *RPCNode) QueryRepaired(args *ReadArgs, ret *Value) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.QueryRepaired(ctx, args.Key, args.R, ret)
+}
+
+func (pos *RPCNode) QueryDataPre(key string, ret *ReplicaValue) error {
+	return pos.Data.QueryDataPre(key, ret)
+}
+
+func (pos *RPCNode) ClosestPrecedingNode(h *big.Int, ret *LookupStep) error {
+	return pos.Data.PrecedingNodes(h, ret)
+}
+
+func (pos *RPCNode) ScanInside(args *ScanArgs, ret *ScanPage) error {
+	return pos.Data.ScanInside(*args, ret)
+}
+
 func (pos *RPCNode) EraseInside(key string, _ *int) error {
 	return pos.Data.EraseInside(key, nil)
 }
 
+func (pos *RPCNode) EraseQuorum(args *EraseArgs, _ *int) error {
+	return pos.Data.EraseQuorum(*args, nil)
+}
+
 func (pos *RPCNode) InsertInside(kv KeyValue, _ *int) error {
 	return pos.Data.InsertInside(kv, nil)
 }
 
-func (pos *RPCNode) MoveDataFromPre(dat map[string]string, _ *int) error {
-	return pos.Data.MoveDataFromPre(dat, nil)
+func (pos *RPCNode) CondInside(w *CondWrite, _ *int) error {
+	return pos.Data.CondInside(*w, nil)
+}
+
+func (pos *RPCNode) BatchInside(args *BatchArgs, ret *BatchReply) error {
+	return pos.Data.BatchInside(*args, ret)
+}
+
+func (pos *RPCNode) MergeInside(kv VersionedKV, _ *int) error {
+	return pos.Data.MergeInside(kv, nil)
+}
+
+func (pos *RPCNode) MoveDataFromPre(dat *PreData, _ *int) error {
+	return pos.Data.MoveDataFromPre(*dat, nil)
 }
 
 func (pos *RPCNode) GetPredecessor(_ *int, ret *Edge) error {
@@ -51,7 +99,7 @@ func (pos *RPCNode) Notify(x *Edge, _ *int) error {
 	return pos.Data.Notify(*x, nil)
 }
 
-func (pos *RPCNode) MoveDataToPre(pr *big.Int, ret *map[string]string) error {
+func (pos *RPCNode) MoveDataToPre(pr *Edge, ret *map[string]Value) error {
 	return pos.Data.MoveDataToPre(pr, ret)
 }
 
@@ -69,29 +117,113 @@ func (pos *RPCNode) UpdatePrv(newPre *Edge, _ *int) error {
 
 // for forcequit
 
-func (pos *RPCNode) InsertDataPre(kv KeyValue, _ *int) error {
-	pos.Data.InsertDataPre(kv)
+func (pos *RPCNode) InsertDataPre(kv *PreKeyValue, _ *int) error {
+	pos.Data.InsertDataPre(*kv)
+	return nil
+}
+
+func (pos *RPCNode) InsertDataPreBatch(dat *PreData, _ *int) error {
+	pos.Data.InsertDataPreBatch(*dat)
 	return nil
 }
 
-func (pos *RPCNode) RemoveDataPre(key string, _ *int) error {
-	pos.Data.RemoveDataPre(key)
+func (pos *RPCNode) GetData(_ int, ret *map[string]Value) error {
+	*ret = pos.Data.sto.copy()
 	return nil
 }
 
-func (pos *RPCNode) GetData(_ int, ret *map[string]string) error {
-	pos.Data.sto.lock.Lock()
-	*ret = pos.Data.sto.data
-	pos.Data.sto.lock.Unlock()
+// GetDataPre returns dataPre split by the predecessor owning the keys.
+func (pos *RPCNode) GetDataPre(_ int, ret *[]PreData) error {
+	*ret = pos.Data.preData()
 	return nil
 }
 
-func (pos *RPCNode) FillDataPre(mp map[string]string, _ *int) error {
-	pos.Data.FillDataPre(mp)
+func (pos *RPCNode) FillDataPre(dat *PreData, _ *int) error {
+	pos.Data.FillDataPre(*dat)
 	return nil
 }
 
+func (pos *RPCNode) MerkleHashes(args *MerkleArgs, ret *[]MerkleHash) error {
+	return pos.Data.MerkleHashes(*args, ret)
+}
+
+func (pos *RPCNode) MerkleLeaves(args *MerkleArgs, ret *map[string]Value) error {
+	return pos.Data.MerkleLeaves(*args, ret)
+}
+
+func (pos *RPCNode) DropDataPreKeys(dat *PreVersions, _ *int) error {
+	pos.Data.DropDataPreKeys(*dat)
+	return nil
+}
+
+func (pos *RPCNode) DropDataPre(owner *Edge, _ *int) error {
+	pos.Data.DropDataPre(*owner)
+	return nil
+}
+
+func (pos *RPCNode) GetLoad(_ int, ret *Load) error {
+	return pos.Data.GetLoad(0, ret)
+}
+
 func (pos *RPCNode) CopySuccessorList(sucList *[SucListLen]Edge, _ *int) error {
 	pos.Data.CopySuccessorList(sucList)
 	return nil
 }
+
+// ClientNode is the service clients outside the ring call, the node reached runs the operation on their behalf.
+// It is registered next to RPCNode, with Config.ClientKey set it is the only service a client may call,
+// RPCNode is left to the nodes of the ring and operators holding Config.PeerKey.
+type ClientNode struct {
+	Data *Node
+}
+
+// ClientArgs carries the request of a client, Val is only read by Put.
+// Budget is what is left of the client's deadline, 0 for none.
+// W and R are the quorums of writes and reads, the ones the node was configured with if 0.
+type ClientArgs struct {
+	Key    string
+	Val    string
+	Budget time.Duration
+	W      int
+	R      int
+}
+
+func (pos *ClientNode) Put(args *ClientArgs, _ *int) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.InsertKeyValQuorum(ctx, args.Key, args.Val, pos.Data.quorum(args.W, pos.Data.writeQuorum))
+}
+
+func (pos *ClientNode) Get(args *ClientArgs, ret *Value) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.QueryQuorum(ctx, args.Key, pos.Data.quorum(args.R, pos.Data.readQuorum), ret)
+}
+
+func (pos *ClientNode) Delete(args *ClientArgs, _ *int) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.EraseKeyQuorum(ctx, args.Key, pos.Data.quorum(args.W, pos.Data.writeQuorum))
+}
+
+// Lookup traces the lookup of the owner of args.Key, the owner is ret.Result.
+func (pos *ClientNode) Lookup(args *ClientArgs, ret *LookupTrace) error {
+	ctx, cancel := withBudget(args.Budget)
+	defer cancel()
+	return pos.Data.TraceKeyContext(ctx, args.Key, ret)
+}
+
+func (pos *ClientNode) Ping(_ int, _ *int) error {
+	return nil
+}
+
+// Info is RPCNode.Info for clients, the view it gives is read-only.
+func (pos *ClientNode) Info(_ int, ret *NodeInfo) error {
+	*ret = pos.Data.Inspect()
+	return nil
+}
+
+func (pos *RPCNode) Info(_ int, ret *NodeInfo) error {
+	*ret = pos.Data.Inspect()
+	return nil
+}
@@ -0,0 +1,125 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// ScanArgs asks a node for its keys hashed after From, From is -1 to start at the beginning of the ring.
+type ScanArgs struct {
+	From  big.Int
+	Limit int
+}
+
+// ScanPage holds keys in hash order, Next is the position to continue after and Done is set at the end of the ring.
+type ScanPage struct {
+	KVs  []KeyValue
+	Next big.Int
+	Done bool
+}
+
+// ScanInside returns the live keys of this node hashed in (From, id], or in (From, top of the ring] when From is past id.
+func (pos *Node) ScanInside(args ScanArgs, ret *ScanPage) error {
+	top := new(big.Int).Sub(mod, big.NewInt(1))
+	end := &pos.id
+	if args.From.Cmp(&pos.id) >= 0 {
+		end = top
+	}
+
+	type entry struct {
+		hash *big.Int
+		kv   KeyValue
+	}
+	var found []entry
+	now := time.Now().UnixNano()
+	pos.sto.lock.Lock()
+	pos.sto.eng.Range(func(k string, v Value) bool {
+		h := hashStr(k)
+		if v.live(now) && h.Cmp(&args.From) > 0 && h.Cmp(end) <= 0 {
+			found = append(found, entry{h, KeyValue{Key: k, Val: v.Val}})
+		}
+		return true
+	})
+	pos.sto.lock.Unlock()
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].hash.Cmp(found[j].hash) < 0
+	})
+
+	ret.KVs = ret.KVs[:0]
+	if args.Limit > 0 && len(found) > args.Limit {
+		for _, e := range found[:args.Limit] {
+			ret.KVs = append(ret.KVs, e.kv)
+		}
+		ret.Next.Set(found[args.Limit-1].hash)
+		ret.Done = false
+		return nil
+	}
+	for _, e := range found {
+		ret.KVs = append(ret.KVs, e.kv)
+	}
+	ret.Next.Set(end)
+	ret.Done = end == top
+	return nil
+}
+
+// Scan lists up to limit live keys of the ring in hash order, walking the owners from the position in cursor.
+// Start with an empty cursor and pass the returned one to continue, an empty cursor comes back after the last key.
+// Keys written or moved between nodes during a scan may be missed.
+func (pos *Node) Scan(cursor string, limit int) ([]KeyValue, string, error) {
+	return pos.ScanContext(context.Background(), cursor, limit)
+}
+
+// ScanContext is Scan giving up when ctx is done, the cursor returned with the error continues the scan.
+func (pos *Node) ScanContext(ctx context.Context, cursor string, limit int) ([]KeyValue, string, error) {
+	var from big.Int
+	if cursor == "" {
+		from.SetInt64(-1)
+	} else if _, ok := from.SetString(cursor, 16); !ok || from.Sign() < 0 || from.Cmp(mod) >= 0 {
+		return nil, "", dhterr.New("Scan", "", dhterr.ErrBadArgument)
+	}
+	if limit <= 0 {
+		return nil, "", dhterr.New("Scan", "", dhterr.ErrBadArgument)
+	}
+
+	var ret []KeyValue
+	for len(ret) < limit {
+		h := new(big.Int).Add(&from, big.NewInt(1))
+		h.Mod(h, mod)
+		var owner Edge
+		if err := pos.FindSuccessorContext(ctx, h, &owner); err != nil {
+			return ret, cursorOf(&from), pos.fail(dhterr.Wrap("Scan", "", dhterr.ErrLookup, err))
+		}
+
+		client := pos.dialContext(ctx, owner.Ip)
+		if client == nil {
+			return ret, cursorOf(&from), pos.fail(dhterr.FromContext(ctx, "Scan", owner.Ip, dhterr.ErrDial))
+		}
+		var page ScanPage
+		err := client.CallContext(ctx, "RPCNode.ScanInside", &ScanArgs{from, limit - len(ret)}, &page)
+		_ = client.Close()
+		if err != nil {
+			return ret, cursorOf(&from), pos.fail(dhterr.FromRPC("Scan", owner.Ip, err))
+		}
+
+		ret = append(ret, page.KVs...)
+		if page.Done {
+			return ret, "", nil
+		}
+		if page.Next.Cmp(&from) <= 0 { // stale routing, never go backwards
+			return ret, cursorOf(&from), pos.fail(dhterr.New("Scan", owner.Ip, dhterr.ErrLookup))
+		}
+		from.Set(&page.Next)
+	}
+	return ret, cursorOf(&from), nil
+}
+
+// cursorOf is the cursor continuing after from, empty before the first key.
+func cursorOf(from *big.Int) string {
+	if from.Sign() < 0 {
+		return ""
+	}
+	return from.Text(16)
+}
@@ -0,0 +1,168 @@
+package chord
+
+import (
+	"math/big"
+	"sync"
+)
+
+// Engine keeps the key/value pairs of a Storage.
+// Calls are serialized by Storage.lock, so an Engine needs no locking of its own.
+type Engine interface {
+	Get(key string) (Value, bool)
+	Put(key string, val Value) error
+	Delete(key string) error
+	Range(f func(key string, val Value) bool) // stops when f returns false
+	Len() int
+	Close() error
+}
+
+type Storage struct {
+	eng  Engine
+	lock sync.Mutex // for multithreading
+}
+
+// copy returns every pair in the storage.
+func (pos *Storage) copy() map[string]Value {
+	pos.lock.Lock()
+	ret := make(map[string]Value, pos.eng.Len())
+	pos.eng.Range(func(k string, v Value) bool {
+		ret[k] = v
+		return true
+	})
+	pos.lock.Unlock()
+	return ret
+}
+
+// replace makes mp the whole content of the storage, lock must be held.
+func (pos *Storage) replace(mp map[string]Value) error {
+	var stale []string
+	pos.eng.Range(func(k string, _ Value) bool {
+		if _, ok := mp[k]; !ok {
+			stale = append(stale, k)
+		}
+		return true
+	})
+	for _, k := range stale {
+		if err := pos.eng.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k, v := range mp {
+		if err := pos.eng.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitRestored decides where the keys a restarted node came up with go on join.
+// The newer of the restored value and the one handed over by the successor wins, keys past the successor are
+// merged back into the ring, the rest stay here until the predecessor is known, see handOffStrays.
+func (pos *Node) splitRestored(restored map[string]Value, fresh map[string]Value, sucID *big.Int) (kept map[string]Value, pushed map[string]Value) {
+	kept = make(map[string]Value, len(fresh)+len(restored))
+	pushed = make(map[string]Value)
+	strays := make(map[string]bool)
+	for k, v := range restored {
+		pos.witness(v.Ver)
+		if f, ok := fresh[k]; ok && !v.Ver.Newer(f.Ver) {
+			continue
+		}
+		if sucID.Cmp(&pos.id) != 0 && inRange(&pos.id, sucID, hashStr(k)) {
+			pushed[k] = v
+		} else {
+			kept[k] = v
+			strays[k] = true
+		}
+	}
+	for k, v := range fresh {
+		pos.witness(v.Ver)
+		if _, ok := kept[k]; !ok {
+			kept[k] = v
+		}
+	}
+
+	pos.sto.lock.Lock()
+	pos.strays = strays
+	pos.sto.lock.Unlock()
+	return kept, pushed
+}
+
+// restore merges kv into the ring, values the ring has a newer version of are left alone.
+func (pos *Node) restore(kv map[string]Value) error {
+	var ret error
+	for k, v := range kv {
+		if err := pos.MergeKeyVal(VersionedKV{k, v}); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// handOffStrays moves restored keys that belong before the new predecessor pre to their owners.
+func (pos *Node) handOffStrays(pre Edge) {
+	moved := make(map[string]Value)
+	pos.sto.lock.Lock()
+	for k := range pos.strays {
+		if inRange(&pre.Id, &pos.id, hashStr(k)) {
+			continue
+		}
+		if v, ok := pos.sto.eng.Get(k); ok {
+			moved[k] = v
+			_ = pos.sto.eng.Delete(k)
+		}
+	}
+	pos.strays = nil
+	pos.sto.lock.Unlock()
+
+	if len(moved) == 0 {
+		return
+	}
+	pos.markDirty()
+	_ = pos.restore(moved)
+}
+
+// Close releases the pooled connections and the storage engine, the node can not be used afterwards.
+func (pos *Node) Close() error {
+	pos.pool.Close()
+	pos.sto.lock.Lock()
+	defer pos.sto.lock.Unlock()
+	return pos.sto.eng.Close()
+}
+
+// MemoryEngine keeps everything in a map and loses it on restart.
+type MemoryEngine map[string]Value
+
+func NewMemoryEngine() MemoryEngine {
+	return make(MemoryEngine)
+}
+
+func (pos MemoryEngine) Get(key string) (Value, bool) {
+	val, ok := pos[key]
+	return val, ok
+}
+
+func (pos MemoryEngine) Put(key string, val Value) error {
+	pos[key] = val
+	return nil
+}
+
+func (pos MemoryEngine) Delete(key string) error {
+	delete(pos, key)
+	return nil
+}
+
+func (pos MemoryEngine) Range(f func(key string, val Value) bool) {
+	for k, v := range pos {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (pos MemoryEngine) Len() int {
+	return len(pos)
+}
+
+func (pos MemoryEngine) Close() error {
+	return nil
+}
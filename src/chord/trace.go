@@ -0,0 +1,101 @@
+package chord
+
+import (
+	"context"
+	"math/big"
+	"time"
+)
+
+// Hop is one node asked during a lookup.
+type Hop struct {
+	Node    Edge
+	Latency time.Duration // spent on the way to and at this node, the hops after it excluded
+	Err     string        // why the hop failed, empty when it answered
+}
+
+// LookupTrace is the path a lookup took, the node the lookup started at comes first.
+type LookupTrace struct {
+	Hops   []Hop
+	Result Edge
+}
+
+// HopCount is the number of nodes that answered, not counting the one the lookup started at.
+func (pos *LookupTrace) HopCount() int {
+	ret := 0
+	for i, x := range pos.Hops {
+		if i > 0 && x.Err == "" {
+			ret++
+		}
+	}
+	return ret
+}
+
+// Failures lists the hops that did not answer.
+func (pos *LookupTrace) Failures() []Hop {
+	var ret []Hop
+	for _, x := range pos.Hops {
+		if x.Err != "" {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// Latency is the time the whole lookup took.
+func (pos *LookupTrace) Latency() time.Duration {
+	var ret time.Duration
+	for _, x := range pos.Hops {
+		ret += x.Latency
+	}
+	return ret
+}
+
+func newHop(x Edge, start time.Time, err error) Hop {
+	ret := Hop{Node: x, Latency: time.Since(start)}
+	if err != nil {
+		ret.Err = err.Error()
+	}
+	return ret
+}
+
+// TraceSuccessor is FindSuccessor that also records the path taken, ret.Result is the successor of h.
+// The trace holds the hops made before a failure as well.
+func (pos *Node) TraceSuccessor(h *big.Int, ret *LookupTrace) error {
+	return pos.TraceSuccessorContext(context.Background(), h, ret)
+}
+
+// TraceSuccessorContext is TraceSuccessor giving up when ctx is done.
+func (pos *Node) TraceSuccessorContext(ctx context.Context, h *big.Int, ret *LookupTrace) error {
+	start := time.Now()
+	err := pos.traceSuccessor(ctx, h, ret)
+	pos.observeLookup(start, err, ret)
+	return err
+}
+
+// traceSuccessor is TraceSuccessorContext without counting the lookup, it also serves the hops handed on by other nodes.
+func (pos *Node) traceSuccessor(ctx context.Context, h *big.Int, ret *LookupTrace) error {
+	ret.Hops = ret.Hops[:0]
+	if pos.lookup == LookupIterative {
+		return pos.findSuccessorIterative(ctx, h, &ret.Result, ret)
+	}
+
+	start := time.Now()
+	ret.Hops = append(ret.Hops, Hop{Node: Edge{pos.Ip, pos.id}})
+	err := pos.findSuccessor(ctx, h, &ret.Result, ret)
+	self := newHop(ret.Hops[0].Node, start, err)
+	for _, x := range ret.Hops[1:] {
+		self.Latency -= x.Latency
+	}
+	ret.Hops[0] = self
+	return err
+}
+
+// TraceKey traces the lookup of the node storing key.
+func (pos *Node) TraceKey(key string, ret *LookupTrace) error {
+	return pos.TraceSuccessorContext(context.Background(), hashStr(key), ret)
+}
+
+// TraceKeyContext is TraceKey giving up when ctx is done.
+func (pos *Node) TraceKeyContext(ctx context.Context, key string, ret *LookupTrace) error {
+	return pos.TraceSuccessorContext(ctx, hashStr(key), ret)
+}
@@ -0,0 +1,169 @@
+package chord
+
+import (
+	"dhterr"
+	"errors"
+	"net"
+	"net/rpc"
+	"rpcpool"
+	"sync"
+	"time"
+)
+
+// Transport decides how nodes reach each other.
+// TCPTransport is used by real networks, MemoryTransport keeps a whole ring inside one process.
+type Transport interface {
+	Listen(ip string) (net.Listener, error)
+	Dial(ip string) (*rpc.Client, error)
+}
+
+// ConnTransport also hands out the raw connections, VirtualTransport is built on one.
+type ConnTransport interface {
+	Transport
+	DialConn(ip string) (net.Conn, error)
+}
+
+// peerDial is the DialFunc of the pool, authenticating as a peer when Config.PeerKey is set,
+// which needs the raw connections of a ConnTransport.
+func (pos *Node) peerDial() rpcpool.DialFunc {
+	if len(pos.keys.Peer) == 0 {
+		return pos.trans.Dial
+	}
+	trans, ok := pos.trans.(ConnTransport)
+	if !ok {
+		return func(ip string) (*rpc.Client, error) {
+			return nil, dhterr.New("Dial", ip, dhterr.ErrSetup)
+		}
+	}
+	return rpcpool.AuthDial(trans.DialConn, rpcpool.RolePeer, pos.keys.Peer)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(ip string) (net.Listener, error) {
+	return net.Listen("tcp", ip)
+}
+
+func (pos TCPTransport) Dial(ip string) (*rpc.Client, error) {
+	conn, err := pos.DialConn(ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (TCPTransport) DialConn(ip string) (net.Conn, error) {
+	var err error
+	var conn net.Conn
+	for i := 1; i <= tryTime; i++ {
+		conn, err = net.Dial("tcp", ip)
+		if err != nil {
+			time.Sleep(waitTime)
+		} else {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// MemoryTransport connects nodes through net.Pipe, no port is bound and a missing node fails at once.
+type MemoryTransport struct {
+	listeners map[string]*chanListener
+	lock      sync.Mutex
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*chanListener)}
+}
+
+func (pos *MemoryTransport) Listen(ip string) (net.Listener, error) {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	if _, ok := pos.listeners[ip]; ok {
+		return nil, errors.New("memory transport: address " + ip + " already in use")
+	}
+	var l *chanListener
+	l = newChanListener(addr{"memory", ip}, func() {
+		pos.lock.Lock()
+		if pos.listeners[ip] == l {
+			delete(pos.listeners, ip)
+		}
+		pos.lock.Unlock()
+	})
+	pos.listeners[ip] = l
+	return l, nil
+}
+
+func (pos *MemoryTransport) Dial(ip string) (*rpc.Client, error) {
+	conn, err := pos.DialConn(ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (pos *MemoryTransport) DialConn(ip string) (net.Conn, error) {
+	pos.lock.Lock()
+	l, ok := pos.listeners[ip]
+	pos.lock.Unlock()
+	if !ok {
+		return nil, errors.New("memory transport: no node listening on " + ip)
+	}
+
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		_ = server.Close()
+		_ = client.Close()
+		return nil, errors.New("memory transport: node " + ip + " has closed")
+	}
+}
+
+type addr struct {
+	network string
+	s       string
+}
+
+func (pos addr) Network() string {
+	return pos.network
+}
+
+func (pos addr) String() string {
+	return pos.s
+}
+
+// chanListener hands out the connections sent to conns, onClose runs once when it is closed.
+type chanListener struct {
+	addr    addr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	onClose func()
+}
+
+func newChanListener(a addr, onClose func()) *chanListener {
+	return &chanListener{addr: a, conns: make(chan net.Conn), done: make(chan struct{}), onClose: onClose}
+}
+
+func (pos *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pos.conns:
+		return conn, nil
+	case <-pos.done:
+		return nil, errors.New(pos.addr.network + " transport: listener closed")
+	}
+}
+
+func (pos *chanListener) Close() error {
+	pos.once.Do(func() {
+		pos.onClose()
+		close(pos.done)
+	})
+	return nil
+}
+
+func (pos *chanListener) Addr() net.Addr {
+	return pos.addr
+}
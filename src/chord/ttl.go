@@ -0,0 +1,76 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"time"
+)
+
+// the sweeper runs at most this often, reads already hide expired keys in between.
+const sweepPeriod = time.Second
+
+// live reports whether the value can still be read at now.
+func (pos Value) live(now int64) bool {
+	return !pos.Deleted && (pos.Expire == 0 || now < pos.Expire)
+}
+
+// PutWithTTL stores val for ttl, counted from when the owner accepts it.
+// The expiry is kept as an absolute time, so it travels unchanged with handoffs and replicas.
+func (pos *Node) PutWithTTL(key string, val string, ttl time.Duration) error {
+	return pos.PutWithTTLContext(context.Background(), key, val, ttl)
+}
+
+// PutWithTTLContext is PutWithTTL giving up when ctx is done.
+func (pos *Node) PutWithTTLContext(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return dhterr.New("PutWithTTL", "", dhterr.ErrBadArgument)
+	}
+
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(key), &temp)
+	if err != nil {
+		return pos.fail(dhterr.Wrap("PutWithTTL", "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "PutWithTTL", ip, dhterr.ErrDial))
+	}
+	err = client.CallContext(ctx, "RPCNode.InsertInside", KeyValue{key, val, ttl, pos.writeQuorum}, nil)
+	_ = client.Close()
+	if err != nil {
+		return pos.fail(dhterr.FromRPC("PutWithTTL", ip, err))
+	}
+
+	return nil
+}
+
+// sweep drops expired keys and tombstones older than tombstoneLife from sto and dataPre.
+// Replicas expire on their own, so nothing is sent to other nodes.
+func (pos *Node) sweep() {
+	now := time.Now()
+	if now.Sub(pos.lastSweep) < sweepPeriod {
+		return
+	}
+	pos.lastSweep = now
+
+	limit := now.Add(-tombstoneLife).UnixNano()
+	for _, sto := range []*Storage{&pos.sto, &pos.dataPre} {
+		sto.lock.Lock()
+		var old []string
+		sto.eng.Range(func(k string, v Value) bool {
+			if v.Deleted && v.Ver.Time < limit || !v.Deleted && !v.live(now.UnixNano()) {
+				old = append(old, k)
+			}
+			return true
+		})
+		for _, k := range old {
+			_ = sto.eng.Delete(k)
+			if sto == &pos.dataPre {
+				delete(pos.preKeys, k)
+			}
+		}
+		sto.lock.Unlock()
+	}
+}
@@ -2,7 +2,8 @@ package chord
 
 import (
 	"crypto/sha1"
-	"errors"
+	"dhterr"
+	"fmt"
 	"math/big"
 	"net/rpc"
 	"time"
@@ -24,34 +25,34 @@ func hashStr(s string) *big.Int {
 	return new(big.Int).SetBytes(h.Sum(nil))
 }
 
-// return rpc.Client to a given IP, nil when failed.
+// return rpc.Client to a given IP over TCP, nil when failed.
 func Dial(ip string) *rpc.Client {
-	var err error
-	var client *rpc.Client
-	for i := 1; i <= tryTime; i++ {
-		client, err = rpc.Dial("tcp", ip)
-		if err != nil {
-			time.Sleep(waitTime)
-		} else {
-			return client
-		}
-	}
-	return nil
+	client, _ := TCPTransport{}.Dial(ip)
+	return client
 }
 
 func Ping(ip string) error {
-	var err error
-	var client *rpc.Client
-	for i := 1; i <= tryTime; i++ {
-		client, err = rpc.Dial("tcp", ip)
-		if err != nil {
-			time.Sleep(waitTime)
-		} else {
-			_ = client.Close()
-			return nil
-		}
+	return pingWith(TCPTransport{}, ip)
+}
+
+// checkClient is the health check used on pooled clients.
+func checkClient(client *rpc.Client) error {
+	var id big.Int
+	return client.Call("RPCNode.GetID", 0, &id)
+}
+
+func pingWith(trans Transport, ip string) error {
+	client, err := trans.Dial(ip)
+	if err != nil {
+		return dhterr.New("Ping", ip, dhterr.ErrDial)
 	}
-	return errors.New("Error(1):: Ping Failure.")
+	_ = client.Close()
+	return nil
+}
+
+// first 8 hex digits of id, enough to tell nodes apart in logs.
+func shortID(id *big.Int) string {
+	return fmt.Sprintf("%040x", id)[:8]
 }
 
 func powTwo(p int64) *big.Int {
@@ -0,0 +1,118 @@
+package chord
+
+import (
+	"context"
+	"dhterr"
+	"sync/atomic"
+	"time"
+)
+
+// tombstones older than this are dropped, a replica that missed a delete for longer may bring the key back.
+const tombstoneLife = 10 * time.Minute
+
+// Version orders the writes of one key, a hybrid clock in nanoseconds plus the owner that accepted the write.
+type Version struct {
+	Time   int64
+	Writer string
+}
+
+// Newer reports whether pos was written after x.
+func (pos Version) Newer(x Version) bool {
+	if pos.Time != x.Time {
+		return pos.Time > x.Time
+	}
+	return pos.Writer > x.Writer
+}
+
+// Value is what a node stores for a key, a deleted key is kept as a tombstone until it is old enough.
+type Value struct {
+	Val     string
+	Ver     Version
+	Deleted bool
+	Expire  int64 // unix nanoseconds after which the key is gone, 0 for never
+}
+
+type VersionedKV struct {
+	Key string
+	Val Value
+}
+
+// tick returns a version newer than every version this node has made or seen.
+func (pos *Node) tick() Version {
+	for {
+		last := atomic.LoadInt64(&pos.clock)
+		now := time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&pos.clock, last, now) {
+			return Version{now, pos.Ip}
+		}
+	}
+}
+
+// witness moves the clock past ver, so later writes here win over it.
+func (pos *Node) witness(ver Version) {
+	for {
+		last := atomic.LoadInt64(&pos.clock)
+		if ver.Time <= last || atomic.CompareAndSwapInt64(&pos.clock, last, ver.Time) {
+			return
+		}
+	}
+}
+
+// merge stores val unless the storage already has a newer version, lock must be held.
+func (pos *Storage) merge(key string, val Value) (bool, error) {
+	if old, ok := pos.eng.Get(key); ok && !val.Ver.Newer(old.Ver) {
+		return false, nil
+	}
+	return true, pos.eng.Put(key, val)
+}
+
+// MergeInside keeps the newer of kv and the local value of its key, used to write back keys with their versions.
+func (pos *Node) MergeInside(kv VersionedKV, _ *int) error {
+	pos.witness(kv.Val.Ver)
+	pos.sto.lock.Lock()
+	changed, err := pos.sto.merge(kv.Key, kv.Val)
+	pos.sto.lock.Unlock()
+	if err != nil {
+		return pos.fail(dhterr.Wrap("MergeInside", "", dhterr.ErrStorage, err))
+	}
+	if !changed {
+		return nil
+	}
+
+	// for force quit
+	if pos.FixList() != nil {
+		return pos.fail(dhterr.New("MergeInside", "", dhterr.ErrAllSuccessorsFailed))
+	}
+	pos.fanOut("MergeInside", "RPCNode.InsertDataPre", &PreKeyValue{Edge{pos.Ip, pos.id}, kv.Key, kv.Val})
+	return nil
+}
+
+// MergeKeyVal writes kv to the owner of its key, which keeps it only when it is newer.
+func (pos *Node) MergeKeyVal(kv VersionedKV) error {
+	return pos.MergeKeyValContext(context.Background(), kv)
+}
+
+// MergeKeyValContext is MergeKeyVal giving up when ctx is done.
+func (pos *Node) MergeKeyValContext(ctx context.Context, kv VersionedKV) error {
+	var temp Edge
+	err := pos.FindSuccessorContext(ctx, hashStr(kv.Key), &temp)
+	if err != nil {
+		return pos.fail(dhterr.Wrap("MergeKeyVal", "", dhterr.ErrLookup, err))
+	}
+
+	ip := temp.Ip
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return pos.fail(dhterr.FromContext(ctx, "MergeKeyVal", ip, dhterr.ErrDial))
+	}
+	err = client.CallContext(ctx, "RPCNode.MergeInside", kv, nil)
+	_ = client.Close()
+	if err != nil {
+		return pos.fail(dhterr.FromRPC("MergeKeyVal", ip, err))
+	}
+
+	return nil
+}
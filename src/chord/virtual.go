@@ -0,0 +1,334 @@
+package chord
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// VirtualPerWeight is the number of virtual nodes a host of capacity weight 1 gets.
+	VirtualPerWeight = 4
+	headerTimeout    = time.Second
+)
+
+// VirtualAddr is the address of the k-th virtual node of the host at ip.
+func VirtualAddr(ip string, k int) string {
+	return ip + "#" + strconv.Itoa(k)
+}
+
+// hostOf strips the virtual node from an address.
+func hostOf(ip string) string {
+	if i := strings.LastIndexByte(ip, '#'); i >= 0 {
+		return ip[:i]
+	}
+	return ip
+}
+
+// VirtualCount returns how many virtual nodes a host of capacity weight gets, at least one.
+func VirtualCount(weight float64) int {
+	n := int(math.Round(weight * VirtualPerWeight))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// VirtualTransport lets the virtual nodes of a host share one listener of the base transport.
+// A virtual node is addressed as ip#k, every connection to it starts with a "k\n" line naming it.
+// Addresses without # go to the base transport untouched.
+type VirtualTransport struct {
+	base  ConnTransport
+	hosts map[string]*vhost
+	lock  sync.Mutex
+}
+
+type vhost struct {
+	listen net.Listener
+	nodes  map[string]*chanListener
+}
+
+func NewVirtualTransport(base ConnTransport) *VirtualTransport {
+	return &VirtualTransport{base: base, hosts: make(map[string]*vhost)}
+}
+
+func splitVirtual(ip string) (host string, name string, ok bool) {
+	i := strings.LastIndexByte(ip, '#')
+	if i < 0 {
+		return ip, "", false
+	}
+	return ip[:i], ip[i+1:], true
+}
+
+func (pos *VirtualTransport) Listen(ip string) (net.Listener, error) {
+	host, name, ok := splitVirtual(ip)
+	if !ok {
+		return pos.base.Listen(ip)
+	}
+
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	h, ok := pos.hosts[host]
+	if !ok {
+		listen, err := pos.base.Listen(host)
+		if err != nil {
+			return nil, err
+		}
+		h = &vhost{listen: listen, nodes: make(map[string]*chanListener)}
+		pos.hosts[host] = h
+		go pos.serve(h)
+	}
+	if _, ok := h.nodes[name]; ok {
+		return nil, errors.New("virtual transport: address " + ip + " already in use")
+	}
+
+	var l *chanListener
+	l = newChanListener(addr{"virtual", ip}, func() {
+		pos.lock.Lock()
+		defer pos.lock.Unlock()
+		if h.nodes[name] != l {
+			return
+		}
+		delete(h.nodes, name)
+		if len(h.nodes) == 0 { // last virtual node of the host
+			delete(pos.hosts, host)
+			_ = h.listen.Close()
+		}
+	})
+	h.nodes[name] = l
+	return l, nil
+}
+
+func (pos *VirtualTransport) serve(h *vhost) {
+	for {
+		conn, err := h.listen.Accept()
+		if err != nil {
+			return
+		}
+		go pos.route(h, conn)
+	}
+}
+
+// route reads the header of conn and hands it to the virtual node it names.
+func (pos *VirtualTransport) route(h *vhost, conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	name, err := readHeader(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	pos.lock.Lock()
+	l, ok := h.nodes[name]
+	pos.lock.Unlock()
+	if err != nil || !ok {
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// readHeader reads one byte at a time, so nothing after the line is consumed.
+func readHeader(conn net.Conn) (string, error) {
+	var buf [32]byte
+	for i := range buf {
+		if _, err := conn.Read(buf[i : i+1]); err != nil {
+			return "", err
+		}
+		if buf[i] == '\n' {
+			return string(buf[:i]), nil
+		}
+	}
+	return "", errors.New("virtual transport: header too long")
+}
+
+func (pos *VirtualTransport) DialConn(ip string) (net.Conn, error) {
+	host, name, ok := splitVirtual(ip)
+	conn, err := pos.base.DialConn(host)
+	if err != nil || !ok {
+		return conn, err
+	}
+	if _, err := conn.Write([]byte(name + "\n")); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (pos *VirtualTransport) Dial(ip string) (*rpc.Client, error) {
+	conn, err := pos.DialConn(ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// HostConfig describes the virtual nodes of one host.
+type HostConfig struct {
+	Config                                    // shared by every virtual node, Engine must be nil
+	Count     int                             // virtual nodes, VirtualCount(Weight) if 0
+	Weight    float64                         // capacity of the host, 1 if 0
+	NewEngine func(ip string) (Engine, error) // storage of one virtual node, a MemoryEngine if nil
+}
+
+// Host runs the virtual nodes of one machine, each one is an ordinary Node with its own ring position.
+type Host struct {
+	Ip    string
+	Nodes []*Node
+	rpcs  []*RPCNode
+
+	metricsAddr string
+	adminAddr   string
+	httpSrv     []*http.Server
+}
+
+// NewHost makes the virtual nodes of ip, cfg.Transport is wrapped in a VirtualTransport unless it already is one.
+func NewHost(ip string, cfg HostConfig) (*Host, error) {
+	if cfg.Engine != nil {
+		return nil, errors.New("chord: HostConfig.Engine is shared by every virtual node, use NewEngine")
+	}
+	count := cfg.Count
+	if count <= 0 {
+		weight := cfg.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		count = VirtualCount(weight)
+	}
+
+	switch trans := cfg.Transport.(type) {
+	case *VirtualTransport:
+	case nil:
+		cfg.Transport = NewVirtualTransport(TCPTransport{})
+	case ConnTransport:
+		cfg.Transport = NewVirtualTransport(trans)
+	default:
+		return nil, errors.New("chord: virtual nodes need a ConnTransport")
+	}
+
+	ret := &Host{Ip: ip, metricsAddr: cfg.MetricsAddr, adminAddr: cfg.AdminAddr}
+	for k := 0; k < count; k++ {
+		vcfg := cfg.Config
+		vcfg.MetricsAddr, vcfg.AdminAddr = "", "" // one listener for the host, see Run
+		if cfg.NewEngine != nil {
+			eng, err := cfg.NewEngine(VirtualAddr(ip, k))
+			if err != nil {
+				ret.Close()
+				return nil, err
+			}
+			vcfg.Engine = eng
+		}
+		node := new(Node)
+		node.InitWithConfig(VirtualAddr(ip, k), vcfg)
+		ret.Nodes = append(ret.Nodes, node)
+		ret.rpcs = append(ret.rpcs, &RPCNode{Data: node})
+	}
+	return ret, nil
+}
+
+// Run starts serving and maintaining every virtual node.
+// The metrics and admin view of the k-th virtual node are offered at /metrics/k and /admin/k
+// when HostConfig.MetricsAddr and HostConfig.AdminAddr are set.
+func (pos *Host) Run() error {
+	routes := make(httpRoutes)
+	for k, node := range pos.Nodes {
+		routes.handle(pos.metricsAddr, "/metrics/"+strconv.Itoa(k), node.Metrics())
+		routes.handle(pos.adminAddr, "/admin/"+strconv.Itoa(k), node.Admin())
+	}
+	servers, err := routes.listen()
+	if err != nil {
+		return err
+	}
+	pos.httpSrv = servers
+	for i, node := range pos.Nodes {
+		server := rpc.NewServer()
+		if err := server.Register(pos.rpcs[i]); err != nil {
+			return err
+		}
+		if err := server.Register(&ClientNode{Data: node}); err != nil {
+			return err
+		}
+		listen, err := node.Listen()
+		if err != nil {
+			return err
+		}
+		pos.rpcs[i].Listen = listen
+		node.On.Store(true)
+
+		go node.Serve(server, listen)
+		go node.Maintain()
+	}
+	return nil
+}
+
+// Create starts a new ring on the first virtual node, the others join it.
+func (pos *Host) Create() error {
+	if err := pos.Nodes[0].CreateNetwork(); err != nil {
+		return err
+	}
+	return pos.joinFrom(1, pos.Nodes[0].Ip)
+}
+
+// Join adds every virtual node to the ring ip belongs to.
+func (pos *Host) Join(ip string) error {
+	return pos.joinFrom(0, ip)
+}
+
+func (pos *Host) joinFrom(k int, ip string) error {
+	for ; k < len(pos.Nodes); k++ {
+		if err := pos.Nodes[k].JoinNetwork(ip); err != nil {
+			return err
+		}
+		time.Sleep(maintainPeriod * 4) // let the ring settle before the next position is taken
+	}
+	return nil
+}
+
+// Quit hands the data of every virtual node over and leaves the ring.
+func (pos *Host) Quit() error {
+	var ret error
+	for i, node := range pos.Nodes {
+		if !node.On.Load() {
+			continue
+		}
+		node.On.Store(false)
+		if err := node.Quit(); err != nil && ret == nil {
+			ret = err
+		}
+		_ = pos.rpcs[i].Listen.Close()
+	}
+	pos.stopHTTP()
+	return ret
+}
+
+// ForceQuit stops every virtual node at once.
+func (pos *Host) ForceQuit() {
+	for i, node := range pos.Nodes {
+		if !node.On.Load() {
+			continue
+		}
+		node.On.Store(false)
+		_ = pos.rpcs[i].Listen.Close()
+	}
+	pos.stopHTTP()
+}
+
+func (pos *Host) stopHTTP() {
+	closeHTTP(pos.httpSrv)
+	pos.httpSrv = nil
+}
+
+// Close releases the pools and storage engines of every virtual node.
+func (pos *Host) Close() {
+	for _, node := range pos.Nodes {
+		_ = node.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"chord"
+	"context"
+)
+
+// chordRing reaches a chord node, ip#k addresses a virtual node.
+type chordRing struct {
+	*node
+}
+
+func newChordRing(addr string) *chordRing {
+	return &chordRing{newNode(addr, chord.NewVirtualTransport(chord.TCPTransport{}).DialConn)}
+}
+
+func (pos *chordRing) Put(ctx context.Context, key string, val string) error {
+	return pos.call(ctx, "Put", "ClientNode.Put", &chord.ClientArgs{Key: key, Val: val, Budget: budget(ctx), W: writeQuorum}, nil)
+}
+
+func (pos *chordRing) Get(ctx context.Context, key string) (string, error) {
+	var ret chord.Value
+	err := pos.call(ctx, "Get", "ClientNode.Get", &chord.ClientArgs{Key: key, Budget: budget(ctx), R: readQuorum}, &ret)
+	return ret.Val, err
+}
+
+func (pos *chordRing) Delete(ctx context.Context, key string) error {
+	return pos.call(ctx, "Delete", "ClientNode.Delete", &chord.ClientArgs{Key: key, Budget: budget(ctx), W: writeQuorum}, nil)
+}
+
+func (pos *chordRing) Lookup(ctx context.Context, key string) (lookup, error) {
+	var trace chord.LookupTrace
+	if err := pos.call(ctx, "Lookup", "ClientNode.Lookup", &chord.ClientArgs{Key: key, Budget: budget(ctx)}, &trace); err != nil {
+		return lookup{}, err
+	}
+	ret := lookup{Owners: []string{trace.Result.Ip}}
+	for _, x := range trace.Hops {
+		ret.Hops = append(ret.Hops, hop{x.Node.Ip, x.Latency, x.Err})
+	}
+	return ret, nil
+}
+
+func (pos *chordRing) Ping(ctx context.Context) error {
+	return pos.call(ctx, "Ping", "ClientNode.Ping", 0, nil)
+}
+
+func (pos *chordRing) Info(ctx context.Context) (interface{}, error) {
+	var ret chord.NodeInfo
+	err := pos.call(ctx, "Info", "ClientNode.Info", 0, &ret)
+	return ret, err
+}
+
+// Check crawls the whole ring from the node, see chord.CheckRing.
+func (pos *chordRing) Check(ctx context.Context) (*chord.RingReport, error) {
+	return chord.CheckRing(ctx, pos.adminDial, pos.addr)
+}
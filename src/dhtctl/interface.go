@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"dhterr"
+	"net"
+	"rpcpool"
+	"time"
+)
+
+// ring is the network dhtctl talks to through one of its nodes, that node runs every operation on its behalf.
+type ring interface {
+	Put(ctx context.Context, key string, val string) error
+	Get(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+	Lookup(ctx context.Context, key string) (lookup, error) // the nodes storing key and the path taken to them
+	Ping(ctx context.Context) error
+	Info(ctx context.Context) (interface{}, error) // the admin view of the node, printed as JSON
+}
+
+type hop struct {
+	Ip      string
+	Latency time.Duration
+	Err     string
+}
+
+type lookup struct {
+	Owners []string
+	Hops   []hop
+}
+
+// node is the connection to the node dhtctl was pointed at.
+// Client operations authenticate with -key-file, the maintenance RPCs behind info and check with -peer-key-file.
+type node struct {
+	addr      string
+	pool      *rpcpool.Pool
+	admin     *rpcpool.Pool
+	adminDial rpcpool.DialFunc
+}
+
+func newNode(addr string, dialConn func(ip string) (net.Conn, error)) *node {
+	dial := rpcpool.AuthDial(dialConn, rpcpool.RoleClient, clientKey)
+	adminDial := rpcpool.AuthDial(dialConn, rpcpool.RolePeer, peerKey)
+	if len(clientKey) == 0 {
+		dial = adminDial // a peer may call the client RPCs as well
+	} else if len(peerKey) == 0 {
+		adminDial = dial // so the node says the maintenance RPCs are denied
+	}
+	return &node{addr, rpcpool.New(dial, rpcpool.Options{}), rpcpool.New(adminDial, rpcpool.Options{}), adminDial}
+}
+
+// call runs method on the node, errors keep the kind the node gave them.
+func (pos *node) call(ctx context.Context, op string, method string, args interface{}, reply interface{}) error {
+	return pos.callWith(ctx, pos.pool, op, method, args, reply)
+}
+
+// callAdmin is call for the maintenance RPCs, which only peers may call.
+func (pos *node) callAdmin(ctx context.Context, op string, method string, args interface{}, reply interface{}) error {
+	return pos.callWith(ctx, pos.admin, op, method, args, reply)
+}
+
+func (pos *node) callWith(ctx context.Context, pool *rpcpool.Pool, op string, method string, args interface{}, reply interface{}) error {
+	client, err := pool.GetContext(ctx, pos.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return dhterr.Wrap(op, pos.addr, dhterr.ErrCanceled, err)
+		}
+		return dhterr.Wrap(op, pos.addr, dhterr.ErrDial, err)
+	}
+	err = client.CallContext(ctx, method, args, reply)
+	_ = client.Close()
+	if err != nil {
+		return dhterr.FromRPC(op, pos.addr, err)
+	}
+	return nil
+}
+
+// budget is what is left of the deadline of ctx, 0 for none.
+func budget(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if left := time.Until(deadline); left > 0 {
+		return left
+	}
+	return 1
+}
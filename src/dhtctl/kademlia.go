@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"kademlia"
+	"net"
+)
+
+type kademliaRing struct {
+	*node
+}
+
+func newKademliaRing(addr string) *kademliaRing {
+	return &kademliaRing{newNode(addr, func(ip string) (net.Conn, error) {
+		return net.Dial("tcp", ip)
+	})}
+}
+
+func (pos *kademliaRing) Put(ctx context.Context, key string, val string) error {
+	return pos.call(ctx, "Put", "ClientNode.Put", &kademlia.ClientArgument{Key: key, Val: val, Budget: budget(ctx)}, nil)
+}
+
+func (pos *kademliaRing) Get(ctx context.Context, key string) (string, error) {
+	var ret string
+	err := pos.call(ctx, "Get", "ClientNode.Get", &kademlia.ClientArgument{Key: key, Budget: budget(ctx)}, &ret)
+	return ret, err
+}
+
+func (pos *kademliaRing) Delete(ctx context.Context, key string) error {
+	return pos.call(ctx, "Delete", "ClientNode.Delete", &kademlia.ClientArgument{Key: key, Budget: budget(ctx)}, nil)
+}
+
+// Lookup lists the closest nodes of key, closest first.
+func (pos *kademliaRing) Lookup(ctx context.Context, key string) (lookup, error) {
+	var trace kademlia.LookupTrace
+	if err := pos.call(ctx, "Lookup", "ClientNode.Lookup", &kademlia.ClientArgument{Key: key, Budget: budget(ctx)}, &trace); err != nil {
+		return lookup{}, err
+	}
+	var ret lookup
+	seen := make(map[string]bool)
+	for _, x := range trace.Result.Data {
+		if x.Ip != "" && !seen[x.Ip] {
+			seen[x.Ip] = true
+			ret.Owners = append(ret.Owners, x.Ip)
+		}
+	}
+	for _, x := range trace.Hops {
+		ret.Hops = append(ret.Hops, hop{x.Node.Ip, x.Latency, x.Err})
+	}
+	return ret, nil
+}
+
+func (pos *kademliaRing) Ping(ctx context.Context) error {
+	return pos.call(ctx, "Ping", "ClientNode.Ping", 0, nil)
+}
+
+func (pos *kademliaRing) Info(ctx context.Context) (interface{}, error) {
+	var ret kademlia.NodeInfo
+	err := pos.call(ctx, "Info", "ClientNode.Info", 0, &ret)
+	return ret, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rpcpool"
+	"time"
+)
+
+var (
+	proto       string
+	addr        string
+	timeout     time.Duration
+	writeQuorum int
+	readQuorum  int
+	clientKey   []byte
+	peerKey     []byte
+)
+
+func init() {
+	flag.StringVar(&proto, "proto", "chord", "protocol of the network: chord/kademlia")
+	flag.StringVar(&addr, "addr", "", "RPC address of any node of the network, ip#k for a chord virtual node")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "give up after this long, 0 for never")
+	flag.IntVar(&writeQuorum, "w", 0, "chord: copies put and delete wait for, the node's default if 0")
+	flag.IntVar(&readQuorum, "r", 0, "chord: copies get compares, the node's default if 0")
+	flag.Func("key-file", "file holding the client key of the network, put, get, delete, lookup, ping and info authenticate with it", readKey(&clientKey))
+	flag.Func("peer-key-file", "file holding the peer key of the network, check and dot authenticate with it, the other commands too without -key-file", readKey(&peerKey))
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: dhtctl -addr HOST:PORT [flags] COMMAND [ARGS]
+
+Commands:
+  put KEY VALUE   store VALUE under KEY
+  get KEY         print the value of KEY
+  delete KEY      remove KEY
+  lookup KEY      print the nodes storing KEY and the path of the lookup
+  ping            check the node answers
+  info            print the routing state and key counts of the node as JSON
+  check           crawl the whole ring and print where it is inconsistent, chord only
+  dot             crawl the whole ring and print it with its fingers as a Graphviz graph, chord only
+
+check and dot call the maintenance RPCs of every node, on a network with keys they need -peer-key-file.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func readKey(key *[]byte) func(string) error {
+	return func(path string) (err error) {
+		*key, err = rpcpool.ReadKey(path)
+		return
+	}
+}
+
+// arity is the number of arguments every command takes.
+var arity = map[string]int{"put": 2, "get": 1, "delete": 1, "lookup": 1, "ping": 0, "info": 0, "check": 0, "dot": 0}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if addr == "" || len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if n, ok := arity[args[0]]; !ok || len(args) != n+1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var r ring
+	switch proto {
+	case "chord":
+		r = newChordRing(addr)
+	case "kademlia":
+		if writeQuorum != 0 || readQuorum != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		r = newKademliaRing(addr)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := run(ctx, r, args[0], args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "dhtctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs cmd with its args against r, writing what it prints to out.
+func run(ctx context.Context, r ring, cmd string, args []string, out io.Writer) error {
+	switch cmd {
+	case "put":
+		return r.Put(ctx, args[0], args[1])
+	case "get":
+		val, err := r.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, val)
+	case "delete":
+		return r.Delete(ctx, args[0])
+	case "lookup":
+		ret, err := r.Lookup(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		for _, ip := range ret.Owners {
+			fmt.Fprintln(out, ip)
+		}
+		for i, x := range ret.Hops {
+			status := "ok"
+			if x.Err != "" {
+				status = x.Err
+			}
+			fmt.Fprintf(out, "  hop %d  %-24s %10v  %s\n", i, x.Ip, x.Latency.Round(time.Microsecond), status)
+		}
+	case "ping":
+		start := time.Now()
+		if err := r.Ping(ctx); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s is alive, %v\n", addr, time.Since(start).Round(time.Microsecond))
+	case "info":
+		info, err := r.Info(ctx)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	case "check", "dot":
+		c, ok := r.(*chordRing)
+		if !ok {
+			return errors.New(cmd + " only knows chord rings")
+		}
+		report, err := c.Check(ctx)
+		if err != nil {
+			return err
+		}
+		if cmd == "dot" {
+			return report.WriteDOT(out)
+		}
+		closed := "closed"
+		if !report.Closed {
+			closed = "open"
+		}
+		fmt.Fprintf(out, "%d nodes, %s\n", len(report.Ring), closed)
+		for _, v := range report.Violations {
+			fmt.Fprintln(out, v)
+		}
+		if n := len(report.Violations); n > 0 {
+			return fmt.Errorf("%d violations", n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	"context"
+	"dhterr"
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRing starts size chord nodes on a MemoryTransport with cfg and joins them into one ring.
+func newTestRing(t *testing.T, cfg chord.Config, size int) *chord.MemoryTransport {
+	trans := chord.NewMemoryTransport()
+	cfg.Transport = trans
+	for i := 0; i < size; i++ {
+		n := new(chord.Node)
+		n.InitWithConfig("node-"+strconv.Itoa(i), cfg)
+		rpcSrv := &chord.RPCNode{Data: n}
+		server := rpc.NewServer()
+		if err := server.Register(rpcSrv); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Register(&chord.ClientNode{Data: n}); err != nil {
+			t.Fatal(err)
+		}
+		listen, err := n.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpcSrv.Listen = listen
+		n.On.Store(true)
+		go n.Serve(server, listen)
+		go n.Maintain()
+		t.Cleanup(func() {
+			n.On.Store(false)
+			_ = listen.Close()
+		})
+
+		if i == 0 {
+			_ = n.CreateNetwork()
+		} else if err := n.JoinNetwork("node-0"); err != nil {
+			t.Fatalf("node %d failed to join: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+	return trans
+}
+
+// withKeys sets the keys dhtctl was started with until the test ends.
+func withKeys(t *testing.T, client string, peer string) {
+	oldClient, oldPeer := clientKey, peerKey
+	clientKey, peerKey = []byte(client), []byte(peer)
+	t.Cleanup(func() { clientKey, peerKey = oldClient, oldPeer })
+}
+
+func TestRun(t *testing.T) {
+	trans := newTestRing(t, chord.Config{PeerKey: []byte("peer secret"), ClientKey: []byte("client secret")}, 3)
+	addr = "node-1"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a client holding the client key alone
+	withKeys(t, "client secret", "")
+	r := &chordRing{newNode(addr, trans.DialConn)}
+	exec := func(cmd string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(ctx, r, cmd, args, &out)
+		return out.String(), err
+	}
+
+	if _, err := exec("put", "dhtctl-key", "dhtctl-val"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if out, err := exec("get", "dhtctl-key"); err != nil || out != "dhtctl-val\n" {
+		t.Fatalf("get: got %q, %v, want %q", out, err, "dhtctl-val\n")
+	}
+	out, err := exec("lookup", "dhtctl-key")
+	if err != nil || !strings.HasPrefix(out, "node-") || !strings.Contains(out, "hop 0") {
+		t.Fatalf("lookup: got %q, %v, want the owner and its hops", out, err)
+	}
+	if out, err := exec("ping"); err != nil || !strings.HasPrefix(out, "node-1 is alive") {
+		t.Fatalf("ping: got %q, %v", out, err)
+	}
+	out, err = exec("info")
+	var info chord.NodeInfo
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil || info.Ip != addr {
+		t.Fatalf("info: got %q, %v, want the JSON view of %s", out, err, addr)
+	}
+	if _, err := exec("delete", "dhtctl-key"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if out, err := exec("get", "dhtctl-key"); !errors.Is(err, dhterr.ErrNotFound) {
+		t.Fatalf("get after delete: got %q, %v, want %v", out, err, dhterr.ErrNotFound)
+	}
+
+	// check and dot crawl the ring through the maintenance RPCs, the client key does not open them
+	for _, cmd := range []string{"check", "dot"} {
+		if out, err := exec(cmd); !errors.Is(err, dhterr.ErrDenied) {
+			t.Errorf("%s with the client key: got %q, %v, want %v", cmd, out, err, dhterr.ErrDenied)
+		}
+	}
+
+	withKeys(t, "client secret", "peer secret")
+	r = &chordRing{newNode(addr, trans.DialConn)}
+	if out, err := exec("check"); err != nil || !strings.HasPrefix(out, "3 nodes, closed\n") {
+		t.Errorf("check: got %q, %v, want a closed ring of 3 nodes", out, err)
+	}
+	if out, err := exec("dot"); err != nil || !strings.Contains(out, "digraph") {
+		t.Errorf("dot: got %q, %v, want a Graphviz graph", out, err)
+	}
+
+	// a wrong key is refused before any command runs
+	withKeys(t, "guess", "")
+	r = &chordRing{newNode(addr, trans.DialConn)}
+	if _, err := exec("ping"); !errors.Is(err, dhterr.ErrDial) {
+		t.Errorf("ping with a wrong key: got %v, want %v", err, dhterr.ErrDial)
+	}
+}
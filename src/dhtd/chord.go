@@ -0,0 +1,100 @@
+package main
+
+import (
+	"chord"
+	"context"
+	"dhterr"
+	"dhtlog"
+	"net/rpc"
+	"time"
+)
+
+type chordNode struct {
+	node   *chord.Node
+	server *rpc.Server
+	rpc    *chord.RPCNode
+}
+
+func newChordNode(cfg config, logger *dhtlog.Logger) (*chordNode, error) {
+	peerKey, clientKey, err := cfg.keys()
+	if err != nil {
+		return nil, err
+	}
+	ccfg := chord.Config{
+		Logger:      logger,
+		Replicas:    cfg.Replicas,
+		MetricsAddr: cfg.Metrics,
+		AdminAddr:   cfg.Admin,
+		AntiEntropy: time.Duration(cfg.AntiEntropy),
+		ReadRepair:  cfg.ReadRepair,
+		WriteQuorum: cfg.WriteQuorum,
+		ReadQuorum:  cfg.ReadQuorum,
+		PeerKey:     peerKey,
+		ClientKey:   clientKey,
+	}
+	if cfg.Lookup == "iterative" {
+		ccfg.Lookup = chord.LookupIterative
+	}
+	if cfg.DataDir != "" {
+		eng, err := chord.OpenDiskEngine(cfg.DataDir, cfg.Sync)
+		if err != nil {
+			return nil, err
+		}
+		ccfg.Engine = eng
+	}
+
+	ret := &chordNode{node: new(chord.Node), server: rpc.NewServer()}
+	ret.node.InitWithConfig(cfg.Addr, ccfg)
+	ret.rpc = &chord.RPCNode{Data: ret.node}
+	if err := ret.server.Register(ret.rpc); err != nil {
+		_ = ret.node.Close()
+		return nil, err
+	}
+	if err := ret.server.Register(&chord.ClientNode{Data: ret.node}); err != nil {
+		_ = ret.node.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (pos *chordNode) Run() error {
+	listen, err := pos.node.Listen()
+	if err != nil {
+		return dhterr.Wrap("Run", pos.node.Ip, dhterr.ErrSetup, err)
+	}
+	pos.rpc.Listen = listen
+	pos.node.On.Store(true)
+
+	go pos.node.Serve(pos.server, listen)
+	go pos.node.Maintain()
+	return nil
+}
+
+func (pos *chordNode) Join(ctx context.Context, seeds []string) error {
+	if len(seeds) == 0 {
+		return pos.node.CreateNetwork()
+	}
+	var err error
+	for _, ip := range seeds {
+		if err = pos.node.JoinNetworkContext(ctx, ip); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (pos *chordNode) Quit(ctx context.Context) error {
+	pos.node.On.Store(false)
+	err := pos.node.QuitContext(ctx)
+	_ = pos.rpc.Listen.Close()
+	return err
+}
+
+func (pos *chordNode) ForceQuit() {
+	pos.node.On.Store(false)
+	_ = pos.rpc.Listen.Close()
+}
+
+func (pos *chordNode) Close() error {
+	return pos.node.Close()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"rpcpool"
+	"strings"
+	"time"
+)
+
+// config is read from the JSON file given by -config, flags set on the command line override it.
+type config struct {
+	Proto       string   `json:"proto"`       // chord or kademlia
+	Addr        string   `json:"addr"`        // RPC address to bind, also the address of the node in the network
+	Join        []string `json:"join"`        // seed nodes tried in order, a chord node with none starts a new ring
+	Log         string   `json:"log"`         // debug/info/warn/error/off
+	LogJSON     bool     `json:"logJSON"`     // write logs as JSON
+	Metrics     string   `json:"metrics"`     // address of the /metrics listener, none if empty
+	Admin       string   `json:"admin"`       // address of the /admin listener, none if empty
+	QuitTimeout duration `json:"quitTimeout"` // how long a graceful quit may take
+
+	PeerKeyFile   string `json:"peerKeyFile"`   // key the nodes of the network authenticate each other with, RPCs are open to anyone if empty
+	ClientKeyFile string `json:"clientKeyFile"` // key clients authenticate with, they may only call the client RPCs
+
+	// chord only
+	Replicas    int      `json:"replicas"`    // copies of every key, the default if 0
+	Lookup      string   `json:"lookup"`      // recursive or iterative
+	DataDir     string   `json:"dataDir"`     // keep the keys on disk here, in memory if empty
+	Sync        bool     `json:"sync"`        // fsync every write to DataDir
+	AntiEntropy duration `json:"antiEntropy"` // how often replicas are compared with their owner, the default if 0, never if negative
+	ReadRepair  bool     `json:"readRepair"`  // reads compare the owner with its replicas and fix the copies that differ
+	WriteQuorum int      `json:"writeQuorum"` // copies a write waits for, the owner's included, the owner alone if 0, replicas away get a hint
+	ReadQuorum  int      `json:"readQuorum"`  // copies a read compares, the owner's included, the owner's alone if 0
+}
+
+// duration is a time.Duration written as "30s" in JSON.
+type duration time.Duration
+
+func (pos *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	*pos = duration(d)
+	return err
+}
+
+func (pos duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(pos).String())
+}
+
+func defaultConfig() config {
+	return config{Proto: "chord", Log: "info", QuitTimeout: duration(30 * time.Second), Lookup: "recursive"}
+}
+
+// loadConfig reads the file named by -config, then applies the flags set on the command line.
+func loadConfig(args []string) (config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("dhtd", flag.ContinueOnError)
+	path := fs.String("config", "", "JSON config file, flags given as well override it")
+	fs.String("proto", cfg.Proto, "protocol: chord/kademlia")
+	fs.String("addr", "", "RPC address to bind, e.g. 10.0.0.5:7000")
+	fs.String("join", "", "comma separated seed nodes, tried in order")
+	fs.String("log", cfg.Log, "log level: debug/info/warn/error/off")
+	fs.Bool("logjson", false, "write logs as JSON")
+	fs.String("metrics", "", "address to serve /metrics on")
+	fs.String("admin", "", "address to serve the read-only /admin on")
+	fs.Duration("quit-timeout", time.Duration(cfg.QuitTimeout), "how long a graceful quit may take")
+	fs.String("peer-key-file", "", "file holding the key the nodes of the network authenticate each other with")
+	fs.String("client-key-file", "", "file holding the key clients authenticate with, needs -peer-key-file")
+	fs.Int("replicas", 0, "chord: copies of every key, the default if 0")
+	fs.String("lookup", cfg.Lookup, "chord: recursive/iterative")
+	fs.String("data", "", "chord: keep the keys on disk in this directory")
+	fs.Bool("sync", false, "chord: fsync every write to the data directory")
+	fs.Bool("read-repair", false, "chord: reads compare the owner with its replicas and fix the copies that differ")
+	fs.Int("w", 0, "chord: copies a write waits for, the owner's included, the owner alone if 0, replicas away get a hint")
+	fs.Int("r", 0, "chord: copies a read compares, the owner's included, the owner's alone if 0")
+	fs.Duration("anti-entropy", 0, "chord: how often replicas are compared with their owner, the default if 0, never if negative")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, errors.New("unexpected argument " + fs.Arg(0))
+	}
+
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return cfg, err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		_ = f.Close()
+		if err != nil {
+			return cfg, errors.New(*path + ": " + err.Error())
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		get := f.Value.(flag.Getter).Get()
+		switch f.Name {
+		case "proto":
+			cfg.Proto = get.(string)
+		case "addr":
+			cfg.Addr = get.(string)
+		case "join":
+			cfg.Join = splitList(get.(string))
+		case "log":
+			cfg.Log = get.(string)
+		case "logjson":
+			cfg.LogJSON = get.(bool)
+		case "metrics":
+			cfg.Metrics = get.(string)
+		case "admin":
+			cfg.Admin = get.(string)
+		case "quit-timeout":
+			cfg.QuitTimeout = duration(get.(time.Duration))
+		case "peer-key-file":
+			cfg.PeerKeyFile = get.(string)
+		case "client-key-file":
+			cfg.ClientKeyFile = get.(string)
+		case "replicas":
+			cfg.Replicas = get.(int)
+		case "lookup":
+			cfg.Lookup = get.(string)
+		case "data":
+			cfg.DataDir = get.(string)
+		case "sync":
+			cfg.Sync = get.(bool)
+		case "read-repair":
+			cfg.ReadRepair = get.(bool)
+		case "w":
+			cfg.WriteQuorum = get.(int)
+		case "r":
+			cfg.ReadQuorum = get.(int)
+		case "anti-entropy":
+			cfg.AntiEntropy = duration(get.(time.Duration))
+		}
+	})
+	return cfg, cfg.check()
+}
+
+func (pos *config) check() error {
+	if pos.Proto != "chord" && pos.Proto != "kademlia" {
+		return errors.New("proto must be chord or kademlia, got " + pos.Proto)
+	}
+	if pos.Addr == "" {
+		return errors.New("no address to bind, set addr")
+	}
+	if pos.Lookup != "recursive" && pos.Lookup != "iterative" {
+		return errors.New("lookup must be recursive or iterative, got " + pos.Lookup)
+	}
+	if pos.Proto == "kademlia" && (pos.Replicas != 0 || pos.DataDir != "" || pos.Lookup != "recursive" || pos.AntiEntropy != 0 || pos.ReadRepair ||
+		pos.WriteQuorum != 0 || pos.ReadQuorum != 0) {
+		return errors.New("replicas, lookup, data, antiEntropy, readRepair and quorums only apply to chord")
+	}
+	if pos.WriteQuorum < 0 || pos.ReadQuorum < 0 {
+		return errors.New("quorums can not be negative")
+	}
+	if pos.ClientKeyFile != "" && pos.PeerKeyFile == "" {
+		return errors.New("clientKeyFile needs peerKeyFile")
+	}
+	return nil
+}
+
+// keys reads the keys named by PeerKeyFile and ClientKeyFile, nil for the ones not set.
+func (pos *config) keys() (peer []byte, client []byte, err error) {
+	if pos.PeerKeyFile != "" {
+		if peer, err = rpcpool.ReadKey(pos.PeerKeyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if pos.ClientKeyFile != "" {
+		if client, err = rpcpool.ReadKey(pos.ClientKeyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return peer, client, nil
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
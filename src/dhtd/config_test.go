@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig([]string{"-config", "dhtd.example.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := config{
+		Proto:       "chord",
+		Addr:        "127.0.0.1:7000",
+		Join:        []string{"127.0.0.1:7001", "127.0.0.1:7002"},
+		Log:         "info",
+		Metrics:     "127.0.0.1:9100",
+		Admin:       "127.0.0.1:9100",
+		QuitTimeout: duration(30 * time.Second),
+		Replicas:    3,
+		Lookup:      "iterative",
+		DataDir:     "/var/lib/dhtd",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+
+	// flags override the file wherever they come on the command line
+	cfg, err = loadConfig([]string{"-addr", ":7100", "-config", "dhtd.example.json", "-join", "a:1, b:2", "-quit-timeout", "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Addr, want.Join, want.QuitTimeout = ":7100", []string{"a:1", "b:2"}, duration(5*time.Second)
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+
+	for _, args := range [][]string{
+		{},                                     // no address
+		{"-addr", ":7000", "-proto", "pastry"}, // unknown protocol
+		{"-addr", ":7000", "-proto", "kademlia", "-data", "/tmp"}, // chord only
+		{"-addr", ":7000", "extra"},
+		{"-addr", ":7000", "-client-key-file", "client.key"}, // clients without peers
+	} {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+}
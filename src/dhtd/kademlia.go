@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"dhterr"
+	"dhtlog"
+	"kademlia"
+	"net/rpc"
+)
+
+type kademliaNode struct {
+	node   *kademlia.Node
+	server *rpc.Server
+	rpc    *kademlia.RPCNode
+}
+
+func newKademliaNode(cfg config, logger *dhtlog.Logger) (*kademliaNode, error) {
+	peerKey, clientKey, err := cfg.keys()
+	if err != nil {
+		return nil, err
+	}
+	ret := &kademliaNode{node: new(kademlia.Node), server: rpc.NewServer()}
+	ret.node.InitWithConfig(cfg.Addr, kademlia.Config{
+		Logger:      logger,
+		MetricsAddr: cfg.Metrics,
+		AdminAddr:   cfg.Admin,
+		PeerKey:     peerKey,
+		ClientKey:   clientKey,
+	})
+	ret.rpc = &kademlia.RPCNode{Data: ret.node}
+	if err := ret.server.Register(ret.rpc); err != nil {
+		return nil, err
+	}
+	if err := ret.server.Register(&kademlia.ClientNode{Data: ret.node}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (pos *kademliaNode) Run() error {
+	listen, err := pos.node.Listen()
+	if err != nil {
+		return dhterr.Wrap("Run", pos.node.Ip, dhterr.ErrSetup, err)
+	}
+	pos.rpc.Listen = listen
+	pos.node.On.Store(true)
+
+	go pos.node.Serve(pos.server, listen)
+	go pos.node.Maintain()
+	return nil
+}
+
+// Join needs no seed for the first node, it is found by the nodes joining through it.
+func (pos *kademliaNode) Join(ctx context.Context, seeds []string) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+	var err error
+	for _, ip := range seeds {
+		if err = pos.node.JoinContext(ctx, ip); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (pos *kademliaNode) Quit(ctx context.Context) error {
+	pos.node.On.Store(false)
+	err := pos.node.QuitContext(ctx)
+	_ = pos.rpc.Listen.Close()
+	return err
+}
+
+func (pos *kademliaNode) ForceQuit() {
+	pos.node.On.Store(false)
+	_ = pos.rpc.Listen.Close()
+}
+
+func (pos *kademliaNode) Close() error {
+	return nil
+}
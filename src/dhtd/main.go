@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"dhtlog"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dhtd:", err)
+		os.Exit(2)
+	}
+	level, err := dhtlog.ParseLevel(cfg.Log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dhtd:", err)
+		os.Exit(2)
+	}
+	logger := dhtlog.New(os.Stderr, level, cfg.LogJSON)
+	os.Exit(run(cfg, logger))
+}
+
+// run serves until the first SIGTERM or SIGINT, then quits gracefully. A second signal forces the quit.
+func run(cfg config, logger *dhtlog.Logger) int {
+	// registered first so a signal during the join is not lost
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	var n node
+	var err error
+	if cfg.Proto == "chord" {
+		n, err = newChordNode(cfg, logger)
+	} else {
+		n, err = newKademliaNode(cfg, logger)
+	}
+	if err != nil {
+		logger.Error("dhtd", "failed to set up the node", "cause", err)
+		return 1
+	}
+	return serve(n, cfg, logger, sigs)
+}
+
+// serve runs n until the first signal on sigs, then quits it within cfg.QuitTimeout. A second signal forces the quit.
+func serve(n node, cfg config, logger *dhtlog.Logger, sigs <-chan os.Signal) int {
+	defer func() {
+		if err := n.Close(); err != nil {
+			logger.Error("dhtd", "failed to close the storage", "cause", err)
+		}
+	}()
+
+	if err := n.Run(); err != nil {
+		logger.Error("dhtd", "failed to listen", "addr", cfg.Addr, "cause", err)
+		return 1
+	}
+
+	joined := make(chan error, 1)
+	joinCtx, cancelJoin := context.WithCancel(context.Background())
+	go func() { joined <- n.Join(joinCtx, cfg.Join) }()
+	select {
+	case err := <-joined:
+		cancelJoin()
+		if err != nil {
+			logger.Error("dhtd", "failed to join", "seeds", cfg.Join, "cause", err)
+			n.ForceQuit()
+			return 1
+		}
+	case sig := <-sigs:
+		cancelJoin()
+		logger.Info("dhtd", "stopped while joining", "signal", sig)
+		n.ForceQuit()
+		return 1
+	}
+	logger.Info("dhtd", "serving", "proto", cfg.Proto, "addr", cfg.Addr, "seeds", cfg.Join)
+
+	sig := <-sigs
+	logger.Info("dhtd", "quitting, signal again to force", "signal", sig, "timeout", time.Duration(cfg.QuitTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.QuitTimeout))
+	defer cancel()
+	quit := make(chan error, 1)
+	go func() { quit <- n.Quit(ctx) }()
+
+	select {
+	case err := <-quit:
+		if err != nil {
+			logger.Error("dhtd", "quit did not hand all data over", "cause", err)
+			return 1
+		}
+		logger.Info("dhtd", "quit")
+		return 0
+	case sig := <-sigs:
+		logger.Warn("dhtd", "forcing the quit", "signal", sig)
+		cancel()
+		n.ForceQuit()
+		return 1
+	}
+}
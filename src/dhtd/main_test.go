@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"dhtlog"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNode records what serve does to it. Join and Quit hang until their context is done when hangJoin and hangQuit are set,
+// Quit tells when it started on quitting and reports how it ended on quit.
+type fakeNode struct {
+	hangJoin bool
+	hangQuit bool
+	quitting chan struct{}
+	quit     chan error
+	forced   atomic.Bool
+	closed   atomic.Bool
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{quitting: make(chan struct{}), quit: make(chan error, 1)}
+}
+
+func (pos *fakeNode) Run() error {
+	return nil
+}
+
+func (pos *fakeNode) Join(ctx context.Context, _ []string) error {
+	if pos.hangJoin {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (pos *fakeNode) Quit(ctx context.Context) error {
+	close(pos.quitting)
+	var err error
+	if pos.hangQuit {
+		<-ctx.Done()
+		err = ctx.Err()
+	}
+	pos.quit <- err
+	return err
+}
+
+func (pos *fakeNode) ForceQuit() {
+	pos.forced.Store(true)
+}
+
+func (pos *fakeNode) Close() error {
+	pos.closed.Store(true)
+	return nil
+}
+
+// servingLog closes serving once serve logs it joined, a signal sent later is not taken for one during the join.
+type servingLog struct {
+	serving chan struct{}
+	once    sync.Once
+}
+
+func (pos *servingLog) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "serving") {
+		pos.once.Do(func() { close(pos.serving) })
+	}
+	return len(p), nil
+}
+
+// startServe runs serve on n in the background, the exit code comes on the returned channel.
+func startServe(n *fakeNode, timeout time.Duration) (chan<- os.Signal, <-chan int, <-chan struct{}) {
+	sigs := make(chan os.Signal, 2)
+	code := make(chan int, 1)
+	log := &servingLog{serving: make(chan struct{})}
+	logger := dhtlog.New(log, dhtlog.LevelInfo, false)
+	go func() { code <- serve(n, config{QuitTimeout: duration(timeout)}, logger, sigs) }()
+	return sigs, code, log.serving
+}
+
+func exitCode(t *testing.T, code <-chan int) int {
+	t.Helper()
+	select {
+	case ret := <-code:
+		return ret
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
+		return 0
+	}
+}
+
+func TestServeOneSignal(t *testing.T) {
+	n := newFakeNode()
+	sigs, code, serving := startServe(n, time.Minute)
+	<-serving
+	sigs <- syscall.SIGTERM
+	if ret := exitCode(t, code); ret != 0 {
+		t.Fatalf("graceful quit: got exit code %d, want 0", ret)
+	}
+	if err := <-n.quit; err != nil {
+		t.Errorf("graceful quit: got %v", err)
+	}
+	if n.forced.Load() || !n.closed.Load() {
+		t.Errorf("graceful quit: forced %v, closed %v, want false, true", n.forced.Load(), n.closed.Load())
+	}
+
+	// a quit running past the timeout is given up
+	n = newFakeNode()
+	n.hangQuit = true
+	sigs, code, serving = startServe(n, 50*time.Millisecond)
+	<-serving
+	sigs <- syscall.SIGINT
+	if ret := exitCode(t, code); ret != 1 {
+		t.Fatalf("quit past its timeout: got exit code %d, want 1", ret)
+	}
+	if err := <-n.quit; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("quit past its timeout: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n.forced.Load() || !n.closed.Load() {
+		t.Errorf("quit past its timeout: forced %v, closed %v, want false, true", n.forced.Load(), n.closed.Load())
+	}
+}
+
+func TestServeTwoSignals(t *testing.T) {
+	n := newFakeNode()
+	n.hangQuit = true
+	sigs, code, serving := startServe(n, time.Minute)
+	<-serving
+	sigs <- syscall.SIGTERM
+	<-n.quitting
+	sigs <- syscall.SIGTERM
+	if ret := exitCode(t, code); ret != 1 {
+		t.Fatalf("forced quit: got exit code %d, want 1", ret)
+	}
+	if !n.forced.Load() || !n.closed.Load() {
+		t.Errorf("forced quit: forced %v, closed %v, want true, true", n.forced.Load(), n.closed.Load())
+	}
+	if err := <-n.quit; !errors.Is(err, context.Canceled) {
+		t.Errorf("graceful quit under a forced one: got %v, want %v", err, context.Canceled)
+	}
+
+	// a signal while joining stops at once
+	n = newFakeNode()
+	n.hangJoin = true
+	sigs, code, _ = startServe(n, time.Minute)
+	sigs <- syscall.SIGINT
+	if ret := exitCode(t, code); ret != 1 {
+		t.Fatalf("signal while joining: got exit code %d, want 1", ret)
+	}
+	if !n.forced.Load() || !n.closed.Load() {
+		t.Errorf("signal while joining: forced %v, closed %v, want true, true", n.forced.Load(), n.closed.Load())
+	}
+}
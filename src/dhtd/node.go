@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+)
+
+// node is the one node a dhtd process runs.
+type node interface {
+	/* "Run" starts serving RPCs and the maintenance loop. */
+	Run() error
+
+	/* Join the network through the first seed that answers, with no seeds a chord node starts a new ring. */
+	Join(ctx context.Context, seeds []string) error
+
+	/* Quit hands the data over and leaves the network, ForceQuit just stops answering. */
+	/* ForceQuit may be called while Quit is still running. */
+	Quit(ctx context.Context) error
+	ForceQuit()
+
+	/* Close releases the storage of the node once it stopped. */
+	Close() error
+}
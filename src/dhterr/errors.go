@@ -0,0 +1,166 @@
+package dhterr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"regexp"
+	"strconv"
+)
+
+// Code is the number in the "error(N)::" prefix, see Errors Definition in README.md.
+type Code int
+
+const (
+	CodeNotFound Code = iota
+	CodeDial
+	CodeRPC
+	CodeLookup
+	CodeSetup
+	CodeAllSuccessorsFailed
+	CodeStorage
+	CodeBadArgument
+	CodeConflict
+	CodeCanceled
+	CodeQuorum
+	CodeDenied
+	CodeNotOwner
+)
+
+// Kind is a sentinel error, compare against it with errors.Is.
+type Kind struct {
+	Code Code
+	Msg  string
+}
+
+func (pos *Kind) Error() string {
+	return "error(" + strconv.Itoa(int(pos.Code)) + "):: " + pos.Msg
+}
+
+var (
+	ErrNotFound            = &Kind{CodeNotFound, "Value Not Found"}
+	ErrDial                = &Kind{CodeDial, "Dial Connect Failure"}
+	ErrRPC                 = &Kind{CodeRPC, "RPC Calling Failure"}
+	ErrLookup              = &Kind{CodeLookup, "Unable to Find Successor"}
+	ErrSetup               = &Kind{CodeSetup, "Node Setup Failure"}
+	ErrAllSuccessorsFailed = &Kind{CodeAllSuccessorsFailed, "All Successor has Failed"}
+	ErrStorage             = &Kind{CodeStorage, "Storage Engine Failure"}
+	ErrBadArgument         = &Kind{CodeBadArgument, "Invalid Argument"}
+	ErrConflict            = &Kind{CodeConflict, "Condition Not Met"}
+	ErrCanceled            = &Kind{CodeCanceled, "Operation Canceled"}
+	ErrQuorum              = &Kind{CodeQuorum, "Quorum Not Reached"}
+	ErrDenied              = &Kind{CodeDenied, "Permission Denied"}
+	ErrNotOwner            = &Kind{CodeNotOwner, "Not the Owner"}
+)
+
+var kinds = map[Code]*Kind{
+	CodeNotFound:            ErrNotFound,
+	CodeDial:                ErrDial,
+	CodeRPC:                 ErrRPC,
+	CodeLookup:              ErrLookup,
+	CodeSetup:               ErrSetup,
+	CodeAllSuccessorsFailed: ErrAllSuccessorsFailed,
+	CodeStorage:             ErrStorage,
+	CodeBadArgument:         ErrBadArgument,
+	CodeConflict:            ErrConflict,
+	CodeCanceled:            ErrCanceled,
+	CodeQuorum:              ErrQuorum,
+	CodeDenied:              ErrDenied,
+	CodeNotOwner:            ErrNotOwner,
+}
+
+// Error records which operation failed against which peer.
+// Its text always starts with the "error(N)::" prefix of its kind,
+// which is how the kind survives net/rpc, where only the text is sent.
+type Error struct {
+	Op     string // operation, such as "FindSuccessor"
+	Addr   string // peer address, empty for local failures
+	Kind   *Kind
+	Err    error  // underlying cause, may be nil
+	Remote string // text of the error reported by the peer, if any
+}
+
+func New(op string, addr string, kind *Kind) *Error {
+	return &Error{Op: op, Addr: addr, Kind: kind}
+}
+
+func Wrap(op string, addr string, kind *Kind, err error) *Error {
+	return &Error{Op: op, Addr: addr, Kind: kind, Err: err}
+}
+
+func (pos *Error) Error() string {
+	s := pos.Kind.Error() + ": " + pos.Op
+	if pos.Addr != "" {
+		s += " " + pos.Addr
+	}
+	if pos.Remote != "" {
+		s += ": remote: " + pos.Remote
+	} else if pos.Err != nil {
+		s += ": " + pos.Err.Error()
+	}
+	return s
+}
+
+// Is reports whether target is the kind of this error, so errors.Is(err, ErrDial) works.
+func (pos *Error) Is(target error) bool {
+	return target == error(pos.Kind)
+}
+
+func (pos *Error) Unwrap() error {
+	return pos.Err
+}
+
+var prefix = regexp.MustCompile(`^error\((-?\d+)\)::`)
+
+// FromRPC turns the error of an RPC call to addr back into a typed error.
+// Errors the peer returned keep their kind, a call given up for its context becomes ErrCanceled
+// and other transport failures become ErrRPC.
+func FromRPC(op string, addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Wrap(op, addr, ErrCanceled, err)
+	}
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return Wrap(op, addr, ErrRPC, err)
+	}
+	ret := &Error{Op: op, Addr: addr, Kind: ErrRPC, Remote: string(serverErr)}
+	if m := prefix.FindStringSubmatch(string(serverErr)); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		if kind, ok := kinds[Code(code)]; ok {
+			ret.Kind = kind
+		}
+	}
+	return ret
+}
+
+// FromContext is New, unless ctx is done, then the failure is put down to it with ErrCanceled.
+func FromContext(ctx context.Context, op string, addr string, kind *Kind) *Error {
+	if err := ctx.Err(); err != nil {
+		return Wrap(op, addr, ErrCanceled, err)
+	}
+	return New(op, addr, kind)
+}
+
+// CodeOf returns the code of the kind err carries, -1 when it carries none.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind.Code
+	}
+	var kind *Kind
+	if errors.As(err, &kind) {
+		return kind.Code
+	}
+	return -1
+}
+
+func (pos Code) String() string {
+	if kind, ok := kinds[pos]; ok {
+		return kind.Msg
+	}
+	return fmt.Sprintf("Code(%d)", int(pos))
+}
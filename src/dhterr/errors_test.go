@@ -0,0 +1,89 @@
+package dhterr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type Store struct{}
+
+// Get fails with the kind numbered by code.
+func (pos *Store) Get(code Code, _ *int) error {
+	return New("Get", "", kinds[code])
+}
+
+func TestFromRPC(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(&Store{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+	addr := l.Addr().String()
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// every kind comes back from the peer as itself
+	for code, kind := range kinds {
+		err := FromRPC("Query", addr, client.Call("Store.Get", code, nil))
+		if !errors.Is(err, kind) || CodeOf(err) != code {
+			t.Errorf("code %d: got %v with code %d, want %v", code, err, CodeOf(err), kind)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Op != "Query" || e.Addr != addr || e.Remote != kind.Error()+": Get" {
+			t.Errorf("code %d: got %+v", code, e)
+		}
+	}
+
+	// a text with no known prefix and a broken connection are RPC failures
+	if err := FromRPC("Query", addr, rpc.ServerError("error(99):: Unknown")); !errors.Is(err, ErrRPC) {
+		t.Errorf("unknown code: got %v, want %v", err, ErrRPC)
+	}
+	_ = client.Close()
+	if err := FromRPC("Query", addr, client.Call("Store.Get", CodeNotFound, nil)); !errors.Is(err, ErrRPC) || errors.Is(err, ErrNotFound) {
+		t.Errorf("closed client: got %v, want %v", err, ErrRPC)
+	}
+	if FromRPC("Query", addr, nil) != nil {
+		t.Errorf("no error: got one")
+	}
+	if CodeOf(errors.New("plain")) != -1 {
+		t.Errorf("plain error: got code %d, want -1", CodeOf(errors.New("plain")))
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if err := FromContext(context.Background(), "Join", "peer", ErrDial); !errors.Is(err, ErrDial) {
+		t.Errorf("live context: got %v, want %v", err, ErrDial)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := FromContext(ctx, "Join", "peer", ErrDial)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) || errors.Is(err, ErrDial) {
+		t.Errorf("canceled context: got %v, want %v from %v", err, ErrCanceled, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err = FromContext(ctx, "Join", "peer", ErrDial)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("context past its deadline: got %v, want %v from %v", err, ErrCanceled, context.DeadlineExceeded)
+	}
+
+	// a call given up for its context is told apart from a peer failing
+	if err := FromRPC("Join", "peer", context.DeadlineExceeded); !errors.Is(err, ErrCanceled) || CodeOf(err) != CodeCanceled {
+		t.Errorf("call past its deadline: got %v, want %v", err, ErrCanceled)
+	}
+}
@@ -0,0 +1,170 @@
+package dhtlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff // nothing is written
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error", "off"}
+
+func (pos Level) String() string {
+	if pos < LevelDebug || pos > LevelOff {
+		return fmt.Sprintf("level(%d)", int(pos))
+	}
+	return levelNames[pos]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelOff, errors.New("dhtlog: unknown level " + s)
+}
+
+type field struct {
+	key string
+	val interface{}
+}
+
+// Logger writes one line per entry, either as key=value text or as a JSON object.
+// Loggers made by With share the writer of their parent.
+type Logger struct {
+	out    io.Writer
+	level  Level
+	json   bool
+	fields []field
+	lock   *sync.Mutex
+}
+
+func New(out io.Writer, level Level, json bool) *Logger {
+	return &Logger{out: out, level: level, json: json, lock: new(sync.Mutex)}
+}
+
+// Default writes warnings and errors as text to stderr.
+func Default() *Logger {
+	return New(os.Stderr, LevelWarn, false)
+}
+
+// Discard drops everything.
+func Discard() *Logger {
+	return New(io.Discard, LevelOff, false)
+}
+
+// With returns a logger that adds key=val to every entry.
+func (pos *Logger) With(key string, val interface{}) *Logger {
+	ret := *pos
+	ret.fields = make([]field, len(pos.fields), len(pos.fields)+1)
+	copy(ret.fields, pos.fields)
+	ret.fields = append(ret.fields, field{key, val})
+	return &ret
+}
+
+func (pos *Logger) Enabled(level Level) bool {
+	return level >= pos.level && pos.level != LevelOff
+}
+
+// Debug, Info, Warn and Error write msg for operation op, followed by key/value pairs in kv.
+func (pos *Logger) Debug(op string, msg string, kv ...interface{}) {
+	pos.write(LevelDebug, op, msg, kv)
+}
+
+func (pos *Logger) Info(op string, msg string, kv ...interface{}) {
+	pos.write(LevelInfo, op, msg, kv)
+}
+
+func (pos *Logger) Warn(op string, msg string, kv ...interface{}) {
+	pos.write(LevelWarn, op, msg, kv)
+}
+
+func (pos *Logger) Error(op string, msg string, kv ...interface{}) {
+	pos.write(LevelError, op, msg, kv)
+}
+
+func (pos *Logger) write(level Level, op string, msg string, kv []interface{}) {
+	if !pos.Enabled(level) {
+		return
+	}
+
+	fields := make([]field, 0, len(pos.fields)+len(kv)/2+4)
+	fields = append(fields, field{"time", time.Now().Format(time.RFC3339Nano)}, field{"level", level.String()})
+	fields = append(fields, pos.fields...)
+	fields = append(fields, field{"op", op}, field{"msg", msg})
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, field{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+
+	var buf bytes.Buffer
+	if pos.json {
+		encodeJSON(&buf, fields)
+	} else {
+		encodeText(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	pos.lock.Lock()
+	_, _ = pos.out.Write(buf.Bytes())
+	pos.lock.Unlock()
+}
+
+func encodeText(buf *bytes.Buffer, fields []field) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.key)
+		buf.WriteByte('=')
+		s := fmt.Sprint(value(f.val))
+		if s == "" || strings.ContainsAny(s, " =\"") {
+			s = fmt.Sprintf("%q", s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, fields []field) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(value(f.val))
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(f.val))
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+}
+
+// errors and Stringers are written as their text.
+func value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
@@ -0,0 +1,112 @@
+package dhtlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func lines(buf *bytes.Buffer) []string {
+	s := strings.TrimSuffix(buf.String(), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, LevelWarn, false)
+	log.Debug("op", "debug")
+	log.Info("op", "info")
+	log.Warn("op", "warn")
+	log.Error("op", "error")
+	got := lines(&buf)
+	if len(got) != 2 || !strings.Contains(got[0], "level=warn") || !strings.Contains(got[1], "level=error") {
+		t.Fatalf("warn logger wrote %q, want the warn and error entries", got)
+	}
+
+	buf.Reset()
+	log = New(&buf, LevelOff, false)
+	log.Error("op", "error")
+	if buf.Len() != 0 || log.Enabled(LevelError) {
+		t.Fatalf("off logger wrote %q", buf.String())
+	}
+
+	for _, s := range []string{"debug", "info", "warn", "error", "off"} {
+		level, err := ParseLevel(s)
+		if err != nil || level.String() != s {
+			t.Errorf("parse %q: got %v, %v", s, level, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("parse %q: got no error", "loud")
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf, LevelInfo, false).With("node", "a")
+	child := parent.With("id", 7)
+	sibling := parent.With("id", 8)
+	child.Info("Join", "joined", "peer", "b")
+	sibling.Info("Join", "joined")
+	parent.Info("Quit", "left")
+
+	got := lines(&buf)
+	if len(got) != 3 {
+		t.Fatalf("wrote %q, want 3 entries", got)
+	}
+	for i, want := range []string{
+		"node=a id=7 op=Join msg=joined peer=b",
+		"node=a id=8 op=Join msg=joined",
+		"node=a op=Quit msg=left",
+	} {
+		// the time and level come first
+		if !strings.HasSuffix(got[i], " level=info "+want) {
+			t.Errorf("entry %d: got %q, want it to end in %q", i, got[i], want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, LevelInfo, false).Info("Get", "not found", "key", "", "cause", errors.New("a=b"))
+	if got := lines(&buf)[0]; !strings.HasSuffix(got, ` op=Get msg="not found" key="" cause="a=b"`) {
+		t.Errorf("got %q, want values with spaces, quotes or = quoted", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, LevelDebug, true).With("node", "a")
+	log.Warn("Get", "failed \"badly\"", "peer", "b", "cause", errors.New("gone"), "tries", 3, "dangling")
+
+	got := lines(&buf)
+	if len(got) != 1 {
+		t.Fatalf("wrote %q, want 1 entry", got)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(got[0]), &entry); err != nil {
+		t.Fatalf("entry %q is not JSON: %v", got[0], err)
+	}
+	want := map[string]interface{}{
+		"level": "warn",
+		"node":  "a",
+		"op":    "Get",
+		"msg":   "failed \"badly\"",
+		"peer":  "b",
+		"cause": "gone",
+		"tries": 3.0,
+	}
+	for key, val := range want {
+		if entry[key] != val {
+			t.Errorf("%s: got %v, want %v", key, entry[key], val)
+		}
+	}
+	if _, ok := entry["time"]; !ok || len(entry) != len(want)+1 {
+		t.Errorf("got keys %v, want the time and %v", entry, want)
+	}
+}
@@ -0,0 +1,303 @@
+package dhtmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are upper bounds in seconds fitting RPC and lookup latencies.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// LinearBuckets returns count upper bounds starting at start, width apart.
+func LinearBuckets(start, width float64, count int) []float64 {
+	ret := make([]float64, count)
+	for i := range ret {
+		ret[i] = start + float64(i)*width
+	}
+	return ret
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics of one node and writes them in the Prometheus text format.
+// It is an http.Handler serving that text.
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	lock    sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (pos *Registry) add(name string, m metric) {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	if pos.names[name] {
+		panic("dhtmetrics: duplicate metric " + name)
+	}
+	pos.names[name] = true
+	pos.metrics = append(pos.metrics, m)
+}
+
+// Counter registers a counter with the given label names.
+func (pos *Registry) Counter(name, help string, labels ...string) *Counter {
+	ret := &Counter{desc: desc{name, help, labels}, vals: make(map[string]*series)}
+	pos.add(name, ret)
+	return ret
+}
+
+// Histogram registers a histogram with the given upper bounds, which must be sorted.
+func (pos *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	ret := &Histogram{desc: desc{name, help, labels}, buckets: buckets, vals: make(map[string]*series)}
+	pos.add(name, ret)
+	return ret
+}
+
+// GaugeFunc registers a gauge read from f on every scrape.
+func (pos *Registry) GaugeFunc(name, help string, f func() float64) {
+	pos.add(name, &gaugeFunc{desc{name, help, nil}, func() map[string]float64 {
+		return map[string]float64{"": f()}
+	}})
+}
+
+// GaugeVecFunc registers a gauge with one label, f gives the value of every label value on every scrape.
+func (pos *Registry) GaugeVecFunc(name, help, label string, f func() map[string]float64) {
+	pos.add(name, &gaugeFunc{desc{name, help, []string{label}}, f})
+}
+
+// WriteText writes every metric in the Prometheus text format, in the order they were registered.
+func (pos *Registry) WriteText(w io.Writer) error {
+	pos.lock.Lock()
+	metrics := append([]metric(nil), pos.metrics...)
+	pos.lock.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+func (pos *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = pos.WriteText(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (pos *desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", pos.name, escapeHelp(pos.help), pos.name, kind)
+}
+
+// key joins label values, \xff can not appear in valid UTF-8.
+func (pos *desc) key(values []string) string {
+	if len(values) != len(pos.labels) {
+		panic(fmt.Sprintf("dhtmetrics: %s takes %d label values, got %d", pos.name, len(pos.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// pairs formats the labels of a sample, extra is appended as is.
+func (pos *desc) pairs(values []string, extra string) string {
+	var b strings.Builder
+	for i, l := range pos.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString("=\"")
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "{" + b.String() + "}"
+}
+
+type series struct {
+	values []string
+	sum    float64
+	count  uint64
+	bucket []uint64 // histograms only, not cumulative
+}
+
+// sorted returns the series of vals ordered by their label values, so scrapes are stable.
+func sorted(vals map[string]*series) []*series {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]*series, len(keys))
+	for i, k := range keys {
+		s := *vals[k]
+		s.bucket = append([]uint64(nil), s.bucket...)
+		ret[i] = &s
+	}
+	return ret
+}
+
+// Counter only goes up. It is safe for concurrent use.
+type Counter struct {
+	desc
+	vals map[string]*series
+	lock sync.Mutex
+}
+
+func (pos *Counter) Inc(values ...string) {
+	pos.Add(1, values...)
+}
+
+func (pos *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("dhtmetrics: counter " + pos.name + " can not go down")
+	}
+	k := pos.key(values)
+	pos.lock.Lock()
+	s, ok := pos.vals[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		pos.vals[k] = s
+	}
+	s.sum += v
+	pos.lock.Unlock()
+}
+
+// Value reads the counter with the given label values, 0 when it was never added to.
+func (pos *Counter) Value(values ...string) float64 {
+	k := pos.key(values)
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	if s, ok := pos.vals[k]; ok {
+		return s.sum
+	}
+	return 0
+}
+
+func (pos *Counter) write(w *bufio.Writer) {
+	pos.header(w, "counter")
+	pos.lock.Lock()
+	all := sorted(pos.vals)
+	pos.lock.Unlock()
+	for _, s := range all {
+		fmt.Fprintf(w, "%s%s %s\n", pos.name, pos.pairs(s.values, ""), formatFloat(s.sum))
+	}
+}
+
+// Histogram counts observations into buckets. It is safe for concurrent use.
+type Histogram struct {
+	desc
+	buckets []float64
+	vals    map[string]*series
+	lock    sync.Mutex
+}
+
+func (pos *Histogram) Observe(v float64, values ...string) {
+	k := pos.key(values)
+	i := sort.SearchFloat64s(pos.buckets, v) // first bound >= v, len(buckets) for +Inf
+	pos.lock.Lock()
+	s, ok := pos.vals[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...), bucket: make([]uint64, len(pos.buckets)+1)}
+		pos.vals[k] = s
+	}
+	s.bucket[i]++
+	s.count++
+	s.sum += v
+	pos.lock.Unlock()
+}
+
+// Count reads how many observations were made with the given label values.
+func (pos *Histogram) Count(values ...string) uint64 {
+	k := pos.key(values)
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	if s, ok := pos.vals[k]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (pos *Histogram) write(w *bufio.Writer) {
+	pos.header(w, "histogram")
+	pos.lock.Lock()
+	all := sorted(pos.vals)
+	pos.lock.Unlock()
+	for _, s := range all {
+		var acc uint64
+		for i, n := range s.bucket {
+			acc += n
+			le := "+Inf"
+			if i < len(pos.buckets) {
+				le = formatFloat(pos.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", pos.name, pos.pairs(s.values, "le=\""+le+"\""), acc)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", pos.name, pos.pairs(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", pos.name, pos.pairs(s.values, ""), s.count)
+	}
+}
+
+type gaugeFunc struct {
+	desc
+	f func() map[string]float64
+}
+
+func (pos *gaugeFunc) write(w *bufio.Writer) {
+	pos.header(w, "gauge")
+	vals := pos.f()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(pos.labels) > 0 {
+			values = []string{k}
+		}
+		fmt.Fprintf(w, "%s%s %s\n", pos.name, pos.pairs(values, ""), formatFloat(vals[k]))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
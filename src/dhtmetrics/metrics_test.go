@@ -0,0 +1,79 @@
+package dhtmetrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrape(t *testing.T) {
+	reg := NewRegistry()
+	calls := reg.Counter("dht_calls_total", "RPCs made,\nby method.", "method", "peer")
+	latency := reg.Histogram("dht_call_seconds", `Latency of RPCs in \seconds.`, []float64{0.1, 1}, "method")
+	reg.GaugeFunc("dht_keys", "Keys stored.", func() float64 { return 42 })
+	reg.GaugeVecFunc("dht_hints", "Hints waiting, by replica.", "replica", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": 1}
+	})
+	plain := reg.Counter("dht_joins_total", "Joins.")
+
+	calls.Inc("Get", "node-1")
+	calls.Add(2, "Get", "node-1")
+	calls.Inc("Put", `odd "peer"\`+"\n")
+	latency.Observe(0.05, "Get")
+	latency.Observe(0.1, "Get")
+	latency.Observe(0.5, "Get")
+	latency.Observe(3, "Get")
+	plain.Inc()
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q, want the Prometheus text format", ct)
+	}
+
+	want := `# HELP dht_calls_total RPCs made,\nby method.
+# TYPE dht_calls_total counter
+dht_calls_total{method="Get",peer="node-1"} 3
+dht_calls_total{method="Put",peer="odd \"peer\"\\\n"} 1
+# HELP dht_call_seconds Latency of RPCs in \\seconds.
+# TYPE dht_call_seconds histogram
+dht_call_seconds_bucket{method="Get",le="0.1"} 2
+dht_call_seconds_bucket{method="Get",le="1"} 3
+dht_call_seconds_bucket{method="Get",le="+Inf"} 4
+dht_call_seconds_sum{method="Get"} 3.65
+dht_call_seconds_count{method="Get"} 4
+# HELP dht_keys Keys stored.
+# TYPE dht_keys gauge
+dht_keys 42
+# HELP dht_hints Hints waiting, by replica.
+# TYPE dht_hints gauge
+dht_hints{replica="a"} 1
+dht_hints{replica="b"} 2
+# HELP dht_joins_total Joins.
+# TYPE dht_joins_total counter
+dht_joins_total 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if calls.Value("Get", "node-1") != 3 || latency.Count("Get") != 4 || latency.Count("Put") != 0 {
+		t.Errorf("got %v calls and %d observations, want 3 and 4", calls.Value("Get", "node-1"), latency.Count("Get"))
+	}
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	mustPanic := func(what string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: did not panic", what)
+			}
+		}()
+		f()
+	}
+	reg := NewRegistry()
+	c := reg.Counter("dht_total", "Total.", "method")
+	mustPanic("duplicate name", func() { reg.Counter("dht_total", "Again.") })
+	mustPanic("missing label value", func() { c.Inc() })
+	mustPanic("counter going down", func() { c.Add(-1, "Get") })
+}
@@ -0,0 +1,70 @@
+// Package hops samples how many hops the lookups of a test network take, the mains of the test programs share it.
+package hops
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SampleSize is the number of lookups traced for one hop distribution.
+const SampleSize = 500
+
+// Trace is the path of one traced lookup.
+type Trace struct {
+	Hops     int             // nodes that answered, the one the lookup started at excluded
+	Failures int             // nodes that did not answer
+	Latency  []time.Duration // one per node asked, the starting one first
+}
+
+type Tracer interface {
+	TraceLookup(key string) (bool, Trace)
+}
+
+// Sample traces SampleSize lookups of random keys from random nodes of the n given by node and returns how many took each hop count.
+// Nothing is traced when the nodes are no Tracer.
+// When w is not nil every lookup is written to it as a CSV line: label,hops,failures,total_us,hop_us...
+func Sample(w io.Writer, label string, n int, node func(i int) interface{}) map[int]int {
+	hist := make(map[int]int)
+	for i := 0; i < SampleSize; i++ {
+		x, ok := node(rand.Intn(n)).(Tracer)
+		if !ok {
+			return hist
+		}
+		ok, trace := x.TraceLookup(strconv.Itoa(rand.Int()))
+		if !ok {
+			continue
+		}
+		hist[trace.Hops]++
+		if w == nil {
+			continue
+		}
+
+		var total time.Duration
+		hops := make([]string, len(trace.Latency))
+		for j, d := range trace.Latency {
+			total += d
+			hops[j] = strconv.FormatInt(d.Microseconds(), 10)
+		}
+		_, _ = fmt.Fprintf(w, "%s,%d,%d,%d,%s\n", label, trace.Hops, trace.Failures, total.Microseconds(), strings.Join(hops, ","))
+	}
+	return hist
+}
+
+// Format prints a hop distribution one "hops: lookups" pair per line.
+func Format(hist map[int]int) string {
+	keys := make([]int, 0, len(hist))
+	for k := range hist {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%3d: %d\n", k, hist[k])
+	}
+	return b.String()
+}
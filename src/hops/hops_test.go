@@ -0,0 +1,38 @@
+package hops
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedTracer takes Hops hops on every lookup, 2 of them failing.
+type fixedTracer struct {
+	Hops int
+}
+
+func (pos fixedTracer) TraceLookup(_ string) (bool, Trace) {
+	return true, Trace{Hops: pos.Hops, Failures: 2, Latency: []time.Duration{time.Millisecond, 2 * time.Millisecond}}
+}
+
+func TestSample(t *testing.T) {
+	nodes := []interface{}{fixedTracer{1}, fixedTracer{3}}
+	var buf bytes.Buffer
+	hist := Sample(&buf, "round", len(nodes), func(i int) interface{} { return nodes[i] })
+	if hist[1]+hist[3] != SampleSize || len(hist) != 2 {
+		t.Fatalf("got %v, want %d lookups of 1 and 3 hops", hist, SampleSize)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != SampleSize || (lines[0] != "round,1,2,3000,1000,2000" && lines[0] != "round,3,2,3000,1000,2000") {
+		t.Fatalf("got %d lines starting with %q, want %d CSV lines", len(lines), lines[0], SampleSize)
+	}
+	if got, want := Format(map[int]int{3: 7, 1: 12}), "  1: 12\n  3: 7\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// nodes that can not trace give an empty distribution
+	if hist := Sample(nil, "", 1, func(int) interface{} { return "node" }); len(hist) != 0 {
+		t.Errorf("got %v from a node that can not trace", hist)
+	}
+}
@@ -0,0 +1,73 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminEdge is an Edge for JSON, the id is written in hex since a 160-bit number does not fit a JSON number.
+type AdminEdge struct {
+	Ip string `json:"ip"`
+	Id string `json:"id"`
+}
+
+// BucketInfo lists the contacts of one k-bucket, least recently seen first.
+type BucketInfo struct {
+	Index    int         `json:"index"`
+	Contacts []AdminEdge `json:"contacts"`
+}
+
+// NodeInfo is a snapshot of the routing table and storage of a node.
+type NodeInfo struct {
+	Ip      string         `json:"ip"`
+	Id      string         `json:"id"`
+	On      bool           `json:"on"`
+	Buckets []BucketInfo   `json:"buckets"` // all BitLen of them, bucket i holds the contacts whose distance to this node has its highest bit at i
+	Keys    int            `json:"keys"`
+	Rem     map[string]int `json:"rem"` // maintain rounds left before a key is republished
+}
+
+// Inspect takes a snapshot of the routing table and storage of this node.
+func (pos *Node) Inspect() NodeInfo {
+	ret := NodeInfo{
+		Ip:      pos.Ip,
+		Id:      pos.Id.Text(16),
+		On:      pos.On.Load(),
+		Buckets: make([]BucketInfo, BitLen),
+	}
+	for i := 0; i < BitLen; i++ {
+		ret.Buckets[i].Index = i
+		ret.Buckets[i].Contacts = []AdminEdge{}
+		pos.route[i].lock.Lock()
+		for j := 0; j < BucketSize; j++ {
+			if x := pos.route[i].Data[j]; x.Ip != "" {
+				ret.Buckets[i].Contacts = append(ret.Buckets[i].Contacts, AdminEdge{x.Ip, x.Id.Text(16)})
+			}
+		}
+		pos.route[i].lock.Unlock()
+	}
+
+	pos.data.lock.Lock()
+	ret.Keys = len(pos.data.data)
+	ret.Rem = make(map[string]int, len(pos.data.rem))
+	for k, v := range pos.data.rem {
+		ret.Rem[k] = v
+	}
+	pos.data.lock.Unlock()
+	return ret
+}
+
+// Admin serves Inspect as JSON, it only answers GET.
+func (pos *Node) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "read-only endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(pos.Inspect())
+	})
+}
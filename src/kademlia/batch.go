@@ -0,0 +1,173 @@
+package kademlia
+
+import (
+	"context"
+	"dhterr"
+)
+
+type BatchArgument struct {
+	Data      []KV
+	Initiator Edge
+}
+
+type KeysArgument struct {
+	Keys      []string
+	Initiator Edge
+}
+
+type BatchValue struct {
+	Vals  []string
+	Found []bool
+}
+
+func (pos *DataPool) remove(key string) bool {
+	pos.lock.Lock()
+	_, ok := pos.data[key]
+	delete(pos.data, key)
+	delete(pos.rem, key)
+	pos.lock.Unlock()
+	return ok
+}
+
+// nearestGroups finds the closest nodes of every key and groups the keys by node.
+func (pos *Node) nearestGroups(ctx context.Context, keys []string) map[string][]int {
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		nodes := pos.NearestNodeContext(ctx, hashStr(key))
+		for j := 0; j < BucketSize; j++ {
+			if ip := nodes.Data[j].Ip; ip != "" {
+				groups[ip] = append(groups[ip], i)
+			}
+		}
+	}
+	return groups
+}
+
+// callBatch sends one batch RPC to ip, logging and returning its failure.
+func (pos *Node) callBatch(ctx context.Context, op string, ip string, method string, args interface{}, reply interface{}) error {
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		err := dhterr.FromContext(ctx, op, ip, dhterr.ErrDial)
+		pos.warn(err)
+		return err
+	}
+	err := client.CallContext(ctx, method, args, reply)
+	_ = client.Close()
+	if err != nil {
+		err = dhterr.FromRPC(op, ip, err)
+		pos.warn(err)
+		return err
+	}
+	return nil
+}
+
+// MultiPut stores every pair on its closest nodes with one RPC per node.
+// errs[i] is nil when at least one node took kvs[i].
+func (pos *Node) MultiPut(kvs []KV) []error {
+	return pos.MultiPutContext(context.Background(), kvs)
+}
+
+// MultiPutContext is MultiPut giving up when ctx is done.
+func (pos *Node) MultiPutContext(ctx context.Context, kvs []KV) []error {
+	keys := make([]string, len(kvs))
+	errs := make([]error, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = kv.Key
+		errs[i] = dhterr.New("MultiPut", "", dhterr.ErrLookup)
+	}
+	stored := make([]bool, len(kvs))
+
+	for ip, idx := range pos.nearestGroups(ctx, keys) {
+		args := BatchArgument{make([]KV, len(idx)), Edge{pos.Ip, pos.Id}}
+		for k, i := range idx {
+			args.Data[k] = kvs[i]
+		}
+		err := pos.callBatch(ctx, "MultiPut", ip, "RPCNode.StoreBatch", &args, nil)
+		for _, i := range idx {
+			if err == nil {
+				stored[i] = true
+				errs[i] = nil
+			} else if !stored[i] {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+// MultiGet asks the closest nodes of every key with one RPC per node,
+// keys none of them has fall back to a full Query.
+func (pos *Node) MultiGet(keys []string) ([]string, []error) {
+	return pos.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is MultiGet giving up when ctx is done.
+func (pos *Node) MultiGetContext(ctx context.Context, keys []string) ([]string, []error) {
+	vals := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	found := make([]bool, len(keys))
+
+	for ip, idx := range pos.nearestGroups(ctx, keys) {
+		args := KeysArgument{make([]string, len(idx)), Edge{pos.Ip, pos.Id}}
+		for k, i := range idx {
+			args.Keys[k] = keys[i]
+		}
+		var reply BatchValue
+		if pos.callBatch(ctx, "MultiGet", ip, "RPCNode.FindValueBatch", &args, &reply) != nil || len(reply.Found) != len(idx) {
+			continue
+		}
+		for k, i := range idx {
+			if reply.Found[k] && !found[i] {
+				found[i] = true
+				vals[i] = reply.Vals[k]
+			}
+		}
+	}
+
+	for i, key := range keys {
+		if !found[i] {
+			if ok, val := pos.QueryContext(ctx, key); ok {
+				vals[i] = val
+			} else {
+				errs[i] = dhterr.New("MultiGet", "", dhterr.ErrNotFound)
+			}
+		}
+	}
+	return vals, errs
+}
+
+// MultiDelete removes every key from its closest nodes and from this node with one RPC per node.
+// Kademlia keeps no tombstones, so a copy cached on a farther node by an earlier lookup may be republished.
+func (pos *Node) MultiDelete(keys []string) []error {
+	return pos.MultiDeleteContext(context.Background(), keys)
+}
+
+// MultiDeleteContext is MultiDelete giving up when ctx is done.
+func (pos *Node) MultiDeleteContext(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	removed := make([]bool, len(keys))
+	for i, key := range keys {
+		removed[i] = pos.data.remove(key)
+	}
+
+	for ip, idx := range pos.nearestGroups(ctx, keys) {
+		args := KeysArgument{make([]string, len(idx)), Edge{pos.Ip, pos.Id}}
+		for k, i := range idx {
+			args.Keys[k] = keys[i]
+		}
+		var reply []bool
+		if pos.callBatch(ctx, "MultiDelete", ip, "RPCNode.DeleteBatch", &args, &reply) != nil || len(reply) != len(idx) {
+			continue
+		}
+		for k, i := range idx {
+			removed[i] = removed[i] || reply[k]
+		}
+	}
+
+	for i := range keys {
+		if !removed[i] {
+			errs[i] = dhterr.New("MultiDelete", "", dhterr.ErrNotFound)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,37 @@
+package kademlia
+
+import (
+	"context"
+	"rpcpool"
+	"time"
+)
+
+// budgetOf is what is left of the deadline of ctx, sent along with a request so the peer stops in time. 0 is no deadline.
+// A remaining time rather than the deadline itself is sent, so the clocks of the nodes need not agree.
+func budgetOf(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if ret := time.Until(deadline); ret > 0 {
+		return ret
+	}
+	return 1 // spent, the peer gives up at once
+}
+
+// withBudget makes the context a request is served under from the budget it came with.
+func withBudget(budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), budget)
+}
+
+// dialContext is dial giving up when ctx is done.
+func (pos *Node) dialContext(ctx context.Context, ip string) *rpcpool.Client {
+	client, err := pos.pool.GetContext(ctx, ip)
+	if err != nil {
+		return nil
+	}
+	return client
+}
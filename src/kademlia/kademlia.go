@@ -1,9 +1,13 @@
 package kademlia
 
 import (
-	"fmt"
+	"context"
+	"dhterr"
+	"dhtlog"
 	"math/big"
+	"rpcpool"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -56,7 +60,7 @@ type Bucket struct {
 	lock sync.Mutex
 }
 
-func (pos *Bucket) push(x Edge, cur Edge) bool {
+func (pos *Bucket) push(x Edge, ping func(ip string) bool) bool {
 	pos.lock.Lock()
 	foundPos := -1
 	for i := 0; i < BucketSize; i++ {
@@ -79,7 +83,7 @@ func (pos *Bucket) push(x Edge, cur Edge) bool {
 		return false
 	} else {
 		ret := true
-		if Ping(cur, pos.Data[0].Ip) {
+		if ping(pos.Data[0].Ip) {
 			x = pos.Data[0]
 			ret = false
 		}
@@ -105,7 +109,14 @@ type Node struct {
 	Ip string
 	Id big.Int
 
-	On bool
+	On atomic.Bool // true while the node is running, Maintain stops when it is cleared
+
+	keys        rpcpool.Keys
+	pool        *rpcpool.Pool
+	log         *dhtlog.Logger
+	metrics     *nodeMetrics
+	metricsAddr string
+	adminAddr   string
 }
 
 func (pos *Node) moveData(edge Edge) {
@@ -115,60 +126,86 @@ func (pos *Node) moveData(edge Edge) {
 	for key, value := range dat {
 		h := hashStr(key)
 		if DiffBit(h, &pos.Id) > DiffBit(h, &edge.Id) {
-			client := Dial(edge.Ip)
+			client := pos.dial(edge.Ip)
 			if client == nil {
-				fmt.Println("Error(1):: Dial Connect Failure.")
+				pos.warn(dhterr.New("moveData", edge.Ip, dhterr.ErrDial))
 				continue
 			}
 			err := client.Call("RPCNode.Store", &StoreArgument{KV{key, value}, Edge{pos.Ip, pos.Id}}, nil)
 			_ = client.Close()
 			if err != nil {
-				fmt.Println("Error(2):: RPC Calling Failure.")
-				fmt.Println(err)
+				pos.warn(dhterr.FromRPC("moveData", edge.Ip, err))
 			}
 		}
 	}
 }
 
 func (pos *Node) pushNode(edge Edge) {
-	if pos.Ip == edge.Ip {
+	if pos.Ip == edge.Ip || edge.Ip == "" { // clients outside the network send no initiator
 		return
 	}
-	if pos.route[DiffBit(&pos.Id, &edge.Id)].push(edge, Edge{pos.Ip, pos.Id}) {
+	if pos.route[DiffBit(&pos.Id, &edge.Id)].push(edge, pos.Ping) {
 		pos.moveData(edge)
 	}
 }
 
 func (pos *Node) NearestNode(id *big.Int) RetBucket { // alpha = 3, however, the RPC call is synchronous.
+	return pos.nearestNode(context.Background(), id, nil)
+}
+
+// NearestNodeContext is NearestNode giving up when ctx is done, the nodes found so far are returned then.
+func (pos *Node) NearestNodeContext(ctx context.Context, id *big.Int) RetBucket {
+	return pos.nearestNode(ctx, id, nil)
+}
+
+// nearestNode appends every node asked to trace unless it is nil.
+func (pos *Node) nearestNode(ctx context.Context, id *big.Int, trace *LookupTrace) RetBucket {
 	var ret RetBucket
-	temp := pos.FindNode(id)
+	begin := time.Now()
+	start := begin
+	temp := pos.findNode(ctx, id)
 	for i := 0; i < RetBucketSize; i++ {
 		ret.Data[i] = temp.Data[i]
 	}
+	if trace != nil {
+		trace.Hops = append(trace.Hops, Hop{Node: Edge{pos.Ip, pos.Id}, Latency: time.Since(start), Improved: ret.Data[0].Ip != ""})
+	}
 	vis := make(map[string]struct{})
+	asked := 0
 
-	for true {
+	for ctx.Err() == nil {
 		flag := false
 		for i := 0; i < BucketSize; i++ {
 			if _, ok := vis[ret.Data[i].Ip]; ret.Data[i].Ip != "" && !ok {
 				vis[ret.Data[i].Ip] = struct{}{}
-				client := Dial(ret.Data[i].Ip)
+				hop := Hop{Node: ret.Data[i]}
+				start = time.Now()
+				client := pos.dialContext(ctx, ret.Data[i].Ip)
 				if client == nil {
-					fmt.Println("Error(1):: Dial Connect Failure.")
-					fmt.Println("ret.ip = ", ret.Data[i].Ip)
+					err := dhterr.FromContext(ctx, "NearestNode", ret.Data[i].Ip, dhterr.ErrDial)
+					pos.warn(err)
+					hop.Err = err.Error()
 				} else {
 					var temp RetBucketSmall
 
-					err := client.Call("RPCNode.FindNode", &FindNodeArgument{*id, Edge{pos.Ip, pos.Id}}, &temp)
+					err := client.CallContext(ctx, "RPCNode.FindNode", &FindNodeArgument{*id, Edge{pos.Ip, pos.Id}, budgetOf(ctx)}, &temp)
 					_ = client.Close()
 
 					if err != nil {
-						fmt.Println("Error(2):: RPC Calling Failure.")
-						fmt.Println(err)
+						err = dhterr.FromRPC("NearestNode", ret.Data[i].Ip, err)
+						pos.warn(err)
+						hop.Err = err.Error()
 					} else {
+						closest := ret.Data[0].Ip
 						ret = Merge(&ret, &temp, id)
+						hop.Improved = ret.Data[0].Ip != closest
 					}
 				}
+				if trace != nil {
+					hop.Latency = time.Since(start)
+					trace.Hops = append(trace.Hops, hop)
+				}
+				asked++
 				flag = true
 				break
 			}
@@ -177,75 +214,87 @@ func (pos *Node) NearestNode(id *big.Int) RetBucket { // alpha = 3, however, the
 			break
 		}
 	}
+	pos.observeLookup("node", begin, asked, ret.Data[0].Ip != "")
 	return ret
 }
 
 func (pos *Node) Store(kv KV) {
-	nodes := pos.NearestNode(hashStr(kv.Key))
+	pos.StoreContext(context.Background(), kv)
+}
+
+// StoreContext is Store giving up when ctx is done.
+func (pos *Node) StoreContext(ctx context.Context, kv KV) {
+	nodes := pos.NearestNodeContext(ctx, hashStr(kv.Key))
 	for i := 0; i < BucketSize; i++ {
 		if nodes.Data[i].Ip != "" {
-			client := Dial(nodes.Data[i].Ip)
+			client := pos.dialContext(ctx, nodes.Data[i].Ip)
 
 			if client == nil {
-				fmt.Println("Error(1):: Dial Connect Failure.")
+				pos.warn(dhterr.FromContext(ctx, "Store", nodes.Data[i].Ip, dhterr.ErrDial))
 				continue
 			}
 
-			err := client.Call("RPCNode.Store", &StoreArgument{kv, Edge{pos.Ip, pos.Id}}, nil)
+			err := client.CallContext(ctx, "RPCNode.Store", &StoreArgument{kv, Edge{pos.Ip, pos.Id}}, nil)
 			_ = client.Close()
 
 			if err != nil {
-				fmt.Println("Error(2):: RPC Calling Failure.")
-				fmt.Println(err)
+				pos.warn(dhterr.FromRPC("Store", nodes.Data[i].Ip, err))
 			}
 		}
 	}
 }
 
 func (pos *Node) Query(key string) (bool, string) {
+	return pos.QueryContext(context.Background(), key)
+}
+
+// QueryContext is Query giving up when ctx is done, ctx.Err() tells a timeout from a missing key.
+func (pos *Node) QueryContext(ctx context.Context, key string) (bool, string) {
 	id := hashStr(key)
 	var ret RetBucket
-	temp := pos.FindNode(id)
+	start := time.Now()
+	temp := pos.findNode(ctx, id)
 	for i := 0; i < RetBucketSize; i++ {
 		ret.Data[i] = temp.Data[i]
 	}
 	vis := make(map[string]struct{})
+	asked := 0
 
-	for true {
+	for ctx.Err() == nil {
 		flag := false
 		for i := 0; i < BucketSize; i++ {
 			if _, ok := vis[ret.Data[i].Ip]; ret.Data[i].Ip != " " && !ok {
 				vis[ret.Data[i].Ip] = struct{}{}
+				asked++
 
-				client := Dial(ret.Data[i].Ip)
+				client := pos.dialContext(ctx, ret.Data[i].Ip)
 				if client == nil {
-					fmt.Println("Error(1):: Dial Connect Failure.")
+					pos.warn(dhterr.FromContext(ctx, "Query", ret.Data[i].Ip, dhterr.ErrDial))
 				} else {
 					var temp RetBucketValue
-					err := client.Call("RPCNode.FindValue", &FindValueArgument{key, *id, Edge{pos.Ip, pos.Id}}, &temp)
+					err := client.CallContext(ctx, "RPCNode.FindValue", &FindValueArgument{key, *id, Edge{pos.Ip, pos.Id}, budgetOf(ctx)}, &temp)
 					_ = client.Close()
 
 					if err != nil {
-						fmt.Println("Error(2):: RPC Calling Failure.")
-						fmt.Println(err)
+						pos.warn(dhterr.FromRPC("Query", ret.Data[i].Ip, err))
 					} else {
 						if temp.Flag {
 							pos.data.insert(KV{key, temp.Val})
 							for j := 0; j < i; j++ { // cache
-								if ret.Data[j].Ip != "" && pos.Ping(ret.Data[j].Ip) {
-									client2 := Dial(ret.Data[j].Ip)
+								if ret.Data[j].Ip != "" && pos.pingContext(ctx, ret.Data[j].Ip) {
+									client2 := pos.dialContext(ctx, ret.Data[j].Ip)
 									if client2 == nil {
-										fmt.Println("Error(1):: Dial Connect Failure.")
+										pos.warn(dhterr.FromContext(ctx, "Query", ret.Data[j].Ip, dhterr.ErrDial))
 									} else {
-										err2 := client2.Call("RPCNode.Store", &StoreArgument{KV{key, temp.Val}, Edge{pos.Ip, pos.Id}}, nil)
+										err2 := client2.CallContext(ctx, "RPCNode.Store", &StoreArgument{KV{key, temp.Val}, Edge{pos.Ip, pos.Id}}, nil)
 										_ = client2.Close()
 										if err2 != nil {
-											fmt.Println("Error(2):: RPC Calling Failure.")
-											fmt.Println(err)
+											pos.warn(dhterr.FromRPC("Query", ret.Data[j].Ip, err2))
 										}
 									}
 								}
 							}
+							pos.observeLookup("value", start, asked, true)
 							return true, temp.Val
 						} else {
 							ret = Merge(&ret, &temp.Bucket, id)
@@ -260,11 +309,12 @@ func (pos *Node) Query(key string) (bool, string) {
 			break
 		}
 	}
+	pos.observeLookup("value", start, asked, false)
 	return false, ""
 }
 
 func (pos *Node) Maintain() {
-	for pos.On {
+	for pos.On.Load() {
 		// deep copy maps
 		pos.data.lock.Lock()
 		rem := make(map[string]int)
@@ -284,16 +334,15 @@ func (pos *Node) Maintain() {
 				nodes := pos.NearestNode(hashStr(key))
 				for j := 0; j < BucketSize; j++ {
 					if nodes.Data[j].Ip != "" && nodes.Data[j].Ip != pos.Ip && pos.Ping(nodes.Data[j].Ip) {
-						client := Dial(nodes.Data[j].Ip)
+						client := pos.dial(nodes.Data[j].Ip)
 						if client == nil {
-							fmt.Println("Error(1):: Dial Connect Failure.")
+							pos.warn(dhterr.New("Maintain", nodes.Data[j].Ip, dhterr.ErrDial))
 							continue
 						}
 						err := client.Call("RPCNode.RePublish", &StoreArgument{KV{key, dat[key]}, Edge{pos.Ip, pos.Id}}, nil)
 						_ = client.Close()
 						if err != nil {
-							fmt.Println("Error(2):: RPC Calling Failure.")
-							fmt.Println(err)
+							pos.warn(dhterr.FromRPC("Maintain", nodes.Data[j].Ip, err))
 						}
 					}
 				}
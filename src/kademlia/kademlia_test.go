@@ -0,0 +1,503 @@
+package kademlia
+
+import (
+	"context"
+	"dhterr"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"rpcpool"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testNodeSize  = 12 // below BucketSize, every node is among the closest of every key
+	testPutSize   = 200
+	testSleepTime = 100 * time.Millisecond
+)
+
+type testNode struct {
+	node   *Node
+	rpcSrv *RPCNode
+	server *rpc.Server
+}
+
+// newTestNode starts a node on a free local port, republishing is left off.
+func newTestNode(t *testing.T, cfg Config) *testNode {
+	var ret testNode
+	ret.node = new(Node)
+	ret.node.InitWithConfig(freeAddr(t), cfg)
+	ret.rpcSrv = &RPCNode{Data: ret.node}
+
+	server := rpc.NewServer()
+	ret.server = server
+	if err := server.Register(ret.rpcSrv); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(&ClientNode{Data: ret.node}); err != nil {
+		t.Fatal(err)
+	}
+	listen, err := ret.node.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret.rpcSrv.Listen = listen
+	ret.node.On.Store(true)
+
+	go ret.node.Serve(server, listen)
+	return &ret
+}
+
+func (pos *testNode) forceQuit() {
+	_ = pos.rpcSrv.Listen.Close()
+}
+
+// newTestNetwork starts size nodes, every one joining through a node started before it.
+func newTestNetwork(t *testing.T, cfg Config, size int) []*testNode {
+	nodes := make([]*testNode, size)
+	for i := 0; i < size; i++ {
+		nodes[i] = newTestNode(t, cfg)
+		t.Cleanup(nodes[i].forceQuit)
+	}
+	for i := 1; i < size; i++ {
+		if err := nodes[i].node.Join(nodes[rand.Intn(i)].node.Ip); err != nil {
+			t.Fatalf("node %d failed to join: %v", i, err)
+		}
+	}
+	time.Sleep(testSleepTime)
+	return nodes
+}
+
+// freeAddr finds a local TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Close()
+	return free.Addr().String()
+}
+
+func TestBatch(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestNetwork(t, Config{}, testNodeSize)
+
+	kvs := make([]KV, testPutSize)
+	keys := make([]string, testPutSize+1)
+	for i := range kvs {
+		kvs[i] = KV{"key-" + strconv.Itoa(i), "val-" + strconv.Itoa(rand.Int())}
+		keys[i] = kvs[i].Key
+	}
+	keys[testPutSize] = "missing"
+	// lookups answer with the few closest contacts a node knows, so a node far from both ends may be missed.
+	// Writing and deleting from the same node has both reach the same copies.
+	entry := nodes[rand.Intn(len(nodes))].node
+	for i, err := range entry.MultiPut(kvs) {
+		if err != nil {
+			t.Fatalf("put %s: %v", kvs[i].Key, err)
+		}
+	}
+
+	vals, errs := nodes[rand.Intn(len(nodes))].node.MultiGet(keys)
+	for i, kv := range kvs {
+		if errs[i] != nil || vals[i] != kv.Value {
+			t.Fatalf("get %s: got %q, %v, want %q", kv.Key, vals[i], errs[i], kv.Value)
+		}
+	}
+	if !errors.Is(errs[testPutSize], dhterr.ErrNotFound) {
+		t.Fatalf("get missing key: got %v, want %v", errs[testPutSize], dhterr.ErrNotFound)
+	}
+
+	// every key is on the nodes closest to it, where a single Query finds it too.
+	// Query caches what it finds on farther nodes, so only keys kept below are asked.
+	for _, kv := range kvs[testPutSize-testPutSize/10:] {
+		if ok, val := nodes[rand.Intn(len(nodes))].node.Query(kv.Key); !ok || val != kv.Value {
+			t.Fatalf("query %s: got %q, %v, want %q", kv.Key, val, ok, kv.Value)
+		}
+	}
+
+	half := keys[:testPutSize/2]
+	errs = entry.MultiDelete(append(half[:len(half):len(half)], "missing"))
+	for i, err := range errs[:len(half)] {
+		if err != nil {
+			t.Fatalf("delete %s: %v", half[i], err)
+		}
+	}
+	if !errors.Is(errs[len(half)], dhterr.ErrNotFound) {
+		t.Fatalf("delete missing key: got %v, want %v", errs[len(half)], dhterr.ErrNotFound)
+	}
+
+	vals, errs = nodes[rand.Intn(len(nodes))].node.MultiGet(keys[:testPutSize])
+	for i, kv := range kvs {
+		if i < len(half) {
+			if !errors.Is(errs[i], dhterr.ErrNotFound) {
+				t.Fatalf("get deleted key %s: got %q, %v, want %v", kv.Key, vals[i], errs[i], dhterr.ErrNotFound)
+			}
+		} else if errs[i] != nil || vals[i] != kv.Value {
+			t.Fatalf("get %s: got %q, %v, want %q", kv.Key, vals[i], errs[i], kv.Value)
+		}
+	}
+}
+
+func TestTraceLookup(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestNetwork(t, Config{}, testNodeSize)
+
+	for i := 0; i < testPutSize/10; i++ {
+		from := nodes[rand.Intn(len(nodes))].node
+		target := nodes[rand.Intn(len(nodes))].node
+		if target == from {
+			continue
+		}
+		trace := from.TraceNearestNode(&target.Id)
+		if trace.Result.Data[0].Ip != target.Ip {
+			t.Fatalf("traced %s from %s, found %s first", target.Ip, from.Ip, trace.Result.Data[0].Ip)
+		}
+		if len(trace.Hops) < 2 || trace.Hops[0].Node.Ip != from.Ip || len(trace.Failures()) != 0 {
+			t.Fatalf("bad path from %s: %+v", from.Ip, trace.Hops)
+		}
+		if trace.HopCount() != len(trace.Hops)-1 || trace.Converged() >= len(trace.Hops) || trace.Latency() <= 0 {
+			t.Fatalf("path from %s: %d hops, converged after %d, took %v: %+v", from.Ip, trace.HopCount(), trace.Converged(), trace.Latency(), trace.Hops)
+		}
+	}
+
+	// a stopped node fails its hop or is never asked, the lookup goes on without it
+	from, victim := nodes[0], nodes[1]
+	victim.forceQuit()
+	trace := from.node.TraceNearestNode(&victim.node.Id)
+	for _, x := range trace.Failures() {
+		if x.Node.Ip != victim.node.Ip {
+			t.Errorf("hop to %s failed: %s", x.Node.Ip, x.Err)
+		}
+	}
+	if trace.Result.Data[0].Ip == "" || trace.Result.Data[0].Ip == victim.node.Ip {
+		t.Errorf("found %q first after %s stopped", trace.Result.Data[0].Ip, victim.node.Ip)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	nodes := newTestNetwork(t, Config{}, testNodeSize/2)
+	node := nodes[0].node
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	node.StoreContext(ctx, KV{"key", "val"})
+	if ok, val := nodes[1].node.QueryContext(ctx, "key"); !ok || val != "val" {
+		t.Fatalf("get: got %q, %v", val, ok)
+	}
+
+	done, stop := context.WithCancel(context.Background())
+	stop()
+	if ok, _ := node.QueryContext(done, "key"); ok {
+		t.Fatalf("get with a canceled context found the key")
+	}
+	if errs := node.MultiPutContext(done, []KV{{"key", "other"}}); errs[0] == nil {
+		t.Fatalf("put with a canceled context succeeded")
+	}
+	if err := node.JoinContext(done, nodes[1].node.Ip); !errors.Is(err, dhterr.ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("join with a canceled context: %v", err)
+	}
+
+	// a node that reads requests but never answers
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+	go func() {
+		for {
+			conn, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	short, cancelShort := context.WithTimeout(context.Background(), testSleepTime)
+	defer cancelShort()
+	start := time.Now()
+	err = node.JoinContext(short, hang.Addr().String())
+	if !errors.Is(err, dhterr.ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > testSleepTime*5 {
+		t.Fatalf("join through a hanging node: %v after %v", err, time.Since(start))
+	}
+
+	// the budget reaches the next hop, which gives up at once when it is spent
+	client := node.dial(nodes[1].node.Ip)
+	var val string
+	err = client.Call("ClientNode.Get", &ClientArgument{Key: "key", Budget: 1}, &val)
+	_ = client.Close()
+	if !errors.Is(dhterr.FromRPC("Get", nodes[1].node.Ip, err), dhterr.ErrCanceled) {
+		t.Fatalf("get with a spent budget: got %q, %v", val, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	nodes := newTestNetwork(t, Config{}, 1)
+	outsider := newTestNode(t, Config{})
+	t.Cleanup(outsider.forceQuit)
+
+	// a ping makes the caller known to the peer, whose buckets are all empty yet
+	if !outsider.node.Ping(nodes[0].node.Ip) {
+		t.Fatalf("ping of %s failed", nodes[0].node.Ip)
+	}
+	found := false
+	for _, x := range nodes[0].node.route[DiffBit(&nodes[0].node.Id, &outsider.node.Id)].Data {
+		found = found || x.Ip == outsider.node.Ip
+	}
+	if !found {
+		t.Errorf("%s does not know %s after being pinged by it", nodes[0].node.Ip, outsider.node.Ip)
+	}
+
+	outsider.forceQuit()
+	if nodes[0].node.Ping(outsider.node.Ip) {
+		t.Errorf("ping of the stopped %s succeeded", outsider.node.Ip)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestNetwork(t, Config{}, testNodeSize/2)
+
+	addr := freeAddr(t)
+	watched := newTestNode(t, Config{MetricsAddr: addr})
+	t.Cleanup(watched.forceQuit)
+	if err := watched.node.Join(nodes[0].node.Ip); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		watched.node.Store(KV{key, key})
+		if ok, val := watched.node.Query(key); !ok || val != key {
+			t.Fatalf("get %s: got %q, %v", key, val, ok)
+		}
+	}
+	if ok, _ := watched.node.Query("missing"); ok {
+		t.Fatal("found a key never stored")
+	}
+	if !nodes[0].node.Ping(watched.node.Ip) {
+		t.Fatalf("ping of %s failed", watched.node.Ip)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	for _, want := range []string{
+		"# TYPE kademlia_rpc_served_total counter",
+		`kademlia_rpc_served_total{method="RPCNode.Ping",result="ok"} `,
+		`kademlia_rpc_issued_total{method="RPCNode.FindNode",result="ok"} `,
+		`kademlia_rpc_issued_total{method="RPCNode.Store",result="ok"} `,
+		`kademlia_rpc_issued_seconds_bucket{method="RPCNode.FindValue",le="+Inf"} `,
+		`kademlia_lookup_seconds_count{op="value",result="found"} `,
+		`kademlia_lookup_seconds_count{op="value",result="not_found"} 1` + "\n",
+		`kademlia_lookup_hops_count{op="node"} `,
+		"kademlia_bucket_size 20\n",
+		"kademlia_keys " + strconv.Itoa(watched.node.Inspect().Keys) + "\n",
+		"kademlia_bucket_entries{bucket=",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if lookups := watched.node.metrics.lookupSeconds.Count("value", "found"); lookups != testPutSize/10 {
+		t.Errorf("counted %d lookups, want %d", lookups, testPutSize/10)
+	}
+	if t.Failed() {
+		t.Log(text)
+	}
+
+	before := watched.node.metrics.dialFailures.Value()
+	victim := nodes[rand.Intn(len(nodes))]
+	victim.forceQuit()
+	for i := 0; i < 2; i++ { // the first ping may only find its pooled connection broken, the next one dials
+		if watched.node.Ping(victim.node.Ip) {
+			t.Fatalf("ping of the stopped %s succeeded", victim.node.Ip)
+		}
+	}
+	if watched.node.metrics.dialFailures.Value() == before {
+		t.Errorf("no dial failure counted after pinging a stopped node")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nodes := newTestNetwork(t, Config{}, testNodeSize/2)
+
+	addr := freeAddr(t)
+	watched := newTestNode(t, Config{MetricsAddr: addr, AdminAddr: addr})
+	t.Cleanup(watched.forceQuit)
+	if err := watched.node.Join(nodes[0].node.Ip); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		nodes[rand.Intn(len(nodes))].node.Store(KV{key, key})
+	}
+
+	resp, err := http.Get("http://" + addr + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info NodeInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Ip != watched.node.Ip || info.Id != watched.node.Id.Text(16) || !info.On {
+		t.Errorf("got node %s %s on=%v, want %s %s", info.Ip, info.Id, info.On, watched.node.Ip, watched.node.Id.Text(16))
+	}
+	if len(info.Buckets) != BitLen {
+		t.Fatalf("got %d buckets, want %d", len(info.Buckets), BitLen)
+	}
+	seen := false
+	for i, b := range info.Buckets {
+		if b.Index != i || b.Contacts == nil {
+			t.Fatalf("bucket %d: got index %d, contacts %v", i, b.Index, b.Contacts)
+		}
+		for _, x := range b.Contacts {
+			id, ok := new(big.Int).SetString(x.Id, 16)
+			if !ok || DiffBit(&watched.node.Id, id) != i {
+				t.Errorf("contact %s %s in bucket %d", x.Ip, x.Id, i)
+			}
+			seen = seen || x.Ip == nodes[0].node.Ip
+		}
+	}
+	if !seen {
+		t.Errorf("the node joined through, %s, is in no bucket", nodes[0].node.Ip)
+	}
+	if now := watched.node.Inspect(); info.Keys == 0 || info.Keys != now.Keys || len(info.Rem) != now.Keys {
+		t.Errorf("admin reported %d keys and %d republish counters, the node keeps %d", info.Keys, len(info.Rem), now.Keys)
+	}
+
+	resp, err = http.Post("http://"+addr+"/admin", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics on the shared listener got status %d", resp.StatusCode)
+	}
+}
+
+func TestAuthenticatedRPC(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	cfg := Config{PeerKey: []byte("peer secret"), ClientKey: []byte("client secret")}
+	nodes := newTestNetwork(t, cfg, testNodeSize/2)
+
+	// the network only forms when the nodes authenticate each other
+	for i := 0; i < testPutSize/10; i++ {
+		key := "key-" + strconv.Itoa(i)
+		nodes[rand.Intn(len(nodes))].node.Store(KV{key, "val-" + key})
+		if ok, val := nodes[rand.Intn(len(nodes))].node.Query(key); !ok || val != "val-"+key {
+			t.Fatalf("query %s: got %q, %v", key, val, ok)
+		}
+	}
+
+	entry := nodes[rand.Intn(len(nodes))].node
+	before := entry.metrics.authRejected.Value()
+
+	// a node with another key can not join
+	stranger := newTestNode(t, Config{PeerKey: []byte("guess")})
+	t.Cleanup(stranger.forceQuit)
+	if err := stranger.node.Join(entry.Ip); !errors.Is(err, dhterr.ErrDial) {
+		t.Fatalf("join with a wrong key: got %v, want %v", err, dhterr.ErrDial)
+	}
+
+	// a caller skipping the handshake is never answered
+	plain, err := rpc.Dial("tcp", entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- plain.Call("RPCNode.Ping", &PingArgument{}, nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("unauthenticated call succeeded")
+		}
+	case <-time.After(time.Second):
+	}
+	_ = plain.Close()
+
+	for _, x := range []struct {
+		role rpcpool.Role
+		key  string
+	}{
+		{rpcpool.RolePeer, "guess"},
+		{rpcpool.RolePeer, "client secret"}, // the client key is no peer key
+		{rpcpool.RoleClient, "peer secret"},
+	} {
+		if _, err := rpcpool.AuthDial(dialConn, x.role, []byte(x.key))(entry.Ip); !errors.Is(err, rpcpool.ErrAuth) {
+			t.Errorf("role %d with key %q: got %v, want %v", x.role, x.key, err, rpcpool.ErrAuth)
+		}
+	}
+
+	client, err := rpcpool.AuthDial(dialConn, rpcpool.RoleClient, cfg.ClientKey)(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	args := &ClientArgument{Key: "client-key", Val: "client-val", Budget: time.Minute}
+	if err := client.Call("ClientNode.Put", args, nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	var val string
+	if err := client.Call("ClientNode.Get", args, &val); err != nil || val != args.Val {
+		t.Fatalf("get: got %q, %v, want %q", val, err, args.Val)
+	}
+
+	// maintenance RPCs are turned away, the connection stays usable
+	err = client.Call("RPCNode.Store", &StoreArgument{KV{"client-key", "evil"}, Edge{}}, nil)
+	if err = dhterr.FromRPC("Store", entry.Ip, err); !errors.Is(err, dhterr.ErrDenied) {
+		t.Fatalf("Store as client: got %v, want %v", err, dhterr.ErrDenied)
+	}
+	var info NodeInfo
+	if err := client.Call("RPCNode.Info", 0, &info); !errors.Is(dhterr.FromRPC("Info", entry.Ip, err), dhterr.ErrDenied) {
+		t.Fatalf("Info as client: got %v, want %v", err, dhterr.ErrDenied)
+	}
+	if err := client.Call("ClientNode.Get", args, &val); err != nil || val != args.Val {
+		t.Fatalf("get after a denied call: got %q, %v, want %q", val, err, args.Val)
+	}
+
+	peer, err := rpcpool.AuthDial(dialConn, rpcpool.RolePeer, cfg.PeerKey)(entry.Ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err := peer.Call("RPCNode.Info", 0, &info); err != nil || info.Ip != entry.Ip {
+		t.Fatalf("Info as peer: got %q, %v, want %q", info.Ip, err, entry.Ip)
+	}
+
+	// the stranger, the bad keys and the denied calls, the plain caller may still be waiting on its handshake
+	if rejected := entry.metrics.authRejected.Value() - before; rejected < 6 {
+		t.Errorf("counted %v rejections, want at least 6", rejected)
+	}
+}
@@ -0,0 +1,142 @@
+package kademlia
+
+import (
+	"dhtmetrics"
+	"net"
+	"net/http"
+	"net/rpc"
+	"rpcpool"
+	"strconv"
+	"time"
+)
+
+// nodeMetrics are the counters of one node, served in the Prometheus text format.
+type nodeMetrics struct {
+	reg *dhtmetrics.Registry
+
+	served        *dhtmetrics.Counter
+	servedSeconds *dhtmetrics.Histogram
+	issued        *dhtmetrics.Counter
+	issuedSeconds *dhtmetrics.Histogram
+	dialFailures  *dhtmetrics.Counter
+	authRejected  *dhtmetrics.Counter
+
+	lookupSeconds *dhtmetrics.Histogram
+	lookupHops    *dhtmetrics.Histogram
+}
+
+func newNodeMetrics(pos *Node) *nodeMetrics {
+	reg := dhtmetrics.NewRegistry()
+	ret := &nodeMetrics{
+		reg: reg,
+
+		served:        reg.Counter("kademlia_rpc_served_total", "RPCs answered by this node.", "method", "result"),
+		servedSeconds: reg.Histogram("kademlia_rpc_served_seconds", "Time spent answering RPCs.", dhtmetrics.DefBuckets, "method"),
+		issued:        reg.Counter("kademlia_rpc_issued_total", "RPCs sent by this node.", "method", "result"),
+		issuedSeconds: reg.Histogram("kademlia_rpc_issued_seconds", "Time until RPCs sent by this node were answered.", dhtmetrics.DefBuckets, "method"),
+		dialFailures:  reg.Counter("kademlia_dial_failures_total", "Connections to other nodes that could not be opened."),
+		authRejected:  reg.Counter("kademlia_auth_rejected_total", "Connections that failed to authenticate and client requests to maintenance RPCs."),
+
+		lookupSeconds: reg.Histogram("kademlia_lookup_seconds", "Time lookups started on this node took, node for NearestNode and value for Query.", dhtmetrics.DefBuckets, "op", "result"),
+		lookupHops:    reg.Histogram("kademlia_lookup_hops", "Nodes asked by a lookup started on this node.", dhtmetrics.LinearBuckets(0, 2, 16), "op"),
+	}
+
+	reg.GaugeVecFunc("kademlia_bucket_entries", "Contacts in every non-empty k-bucket of the routing table.", "bucket", func() map[string]float64 {
+		ret := make(map[string]float64)
+		for i := range pos.route {
+			if n := pos.route[i].size(); n > 0 {
+				ret[strconv.Itoa(i)] = float64(n)
+			}
+		}
+		return ret
+	})
+	reg.GaugeFunc("kademlia_bucket_size", "Contacts a k-bucket holds at most.", func() float64 {
+		return BucketSize
+	})
+	reg.GaugeFunc("kademlia_keys", "Keys kept by this node.", func() float64 {
+		pos.data.lock.Lock()
+		defer pos.data.lock.Unlock()
+		return float64(len(pos.data.data))
+	})
+	return ret
+}
+
+// observer counts the calls of one side of an RPC by method and result.
+func observer(count *dhtmetrics.Counter, seconds *dhtmetrics.Histogram) rpcpool.ObserveFunc {
+	return func(method string, elapsed time.Duration, err error) {
+		count.Inc(method, result(err))
+		seconds.Observe(elapsed.Seconds(), method)
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeLookup counts a lookup started at start that asked hops nodes.
+func (pos *Node) observeLookup(op string, start time.Time, hops int, found bool) {
+	res := "found"
+	if !found {
+		res = "not_found"
+	}
+	pos.metrics.lookupSeconds.Observe(time.Since(start).Seconds(), op, res)
+	pos.metrics.lookupHops.Observe(float64(hops), op)
+}
+
+func (pos *Bucket) size() int {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	ret := 0
+	for i := 0; i < BucketSize; i++ {
+		if pos.Data[i].Ip != "" {
+			ret++
+		}
+	}
+	return ret
+}
+
+// Metrics serves the metrics of this node in the Prometheus text format.
+func (pos *Node) Metrics() http.Handler {
+	return pos.metrics.reg
+}
+
+// Serve answers the RPCs registered on server over l until l is closed, counting them in the metrics of this node.
+// The listeners of Config.MetricsAddr and Config.AdminAddr, if any, run meanwhile, sharing one when the addresses are equal.
+// With Config.PeerKey set, callers that do not authenticate are turned away and clients may call ClientNode alone.
+func (pos *Node) Serve(server *rpc.Server, l net.Listener) {
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr string, path string, h http.Handler) {
+		if addr == "" {
+			return
+		}
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(path, h)
+	}
+	handle(pos.metricsAddr, "/metrics", pos.Metrics())
+	handle(pos.adminAddr, "/admin", pos.Admin())
+
+	for addr, mux := range muxes {
+		listen, err := net.Listen("tcp", addr)
+		if err != nil {
+			pos.log.Warn("Serve", "http listener failed", "addr", addr, "cause", err)
+			continue
+		}
+		srv := &http.Server{Handler: mux}
+		go func() { _ = srv.Serve(listen) }()
+		defer srv.Close()
+	}
+	rpcpool.ServeWith(server, l, rpcpool.ServeOptions{
+		Observe: observer(pos.metrics.served, pos.metrics.servedSeconds),
+		Keys:    pos.keys,
+		Client:  []string{"ClientNode"},
+		Rejected: func(addr string, err error) {
+			pos.metrics.authRejected.Inc()
+			pos.log.Warn("Serve", "caller rejected", "peer", addr, "cause", err)
+		},
+	})
+}
@@ -1,9 +1,15 @@
 package kademlia
 
 import (
+	"context"
+	"dhterr"
+	"dhtlog"
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
+	"net/rpc"
+	"rpcpool"
 )
 
 // method and struct to be called by RPCNode
@@ -54,22 +60,27 @@ func max(a int, b int) int {
 }
 
 func (pos *Node) FindNode(id *big.Int) RetBucketSmall {
+	return pos.findNode(context.Background(), id)
+}
+
+// findNode stops pinging candidates when ctx is done, those found so far are returned.
+func (pos *Node) findNode(ctx context.Context, id *big.Int) RetBucketSmall {
 	usedSize := 0
 	var ret RetBucketSmall
 	init := max(DiffBit(id, &pos.Id), 0)
-	for i := init; i < BitLen && usedSize < RetBucketSize; i++ {
+	for i := init; i < BitLen && usedSize < RetBucketSize && ctx.Err() == nil; i++ {
 		pos.route[i].lock.Lock()
 		for j := 0; j < BucketSize && usedSize < RetBucketSize; j++ {
-			if pos.route[i].Data[j].Ip != "" && pos.Ping(pos.route[i].Data[j].Ip) {
+			if pos.route[i].Data[j].Ip != "" && pos.pingContext(ctx, pos.route[i].Data[j].Ip) {
 				usedSize += ret.push(pos.route[i].Data[j])
 			}
 		}
 		pos.route[i].lock.Unlock()
 	}
-	for i := init - 1; i > 0 && usedSize < RetBucketSize; i-- {
+	for i := init - 1; i > 0 && usedSize < RetBucketSize && ctx.Err() == nil; i-- {
 		pos.route[i].lock.Lock()
 		for j := 0; j < BucketSize && usedSize < RetBucketSize; j++ {
-			if pos.route[i].Data[j].Ip != "" && pos.Ping(pos.route[i].Data[j].Ip) {
+			if pos.route[i].Data[j].Ip != "" && pos.pingContext(ctx, pos.route[i].Data[j].Ip) {
 				usedSize += ret.push(pos.route[i].Data[j])
 			}
 		}
@@ -79,42 +90,189 @@ func (pos *Node) FindNode(id *big.Int) RetBucketSmall {
 }
 
 func (pos *Node) FindValue(id *big.Int, Key string) RetBucketValue {
+	return pos.findValue(context.Background(), id, Key)
+}
+
+func (pos *Node) findValue(ctx context.Context, id *big.Int, Key string) RetBucketValue {
 	var ret RetBucketValue
 	if pos.data.hasKey(Key) {
 		ret.Flag = true
 		ret.Val = pos.data.query(Key)
 	} else {
 		ret.Flag = false
-		ret.Bucket = pos.FindNode(id)
+		ret.Bucket = pos.findNode(ctx, id)
 	}
 	return ret
 }
 
+// Config holds the optional parts of a node, zero values fall back to the defaults.
+type Config struct {
+	Logger      *dhtlog.Logger // dhtlog.Default() if nil
+	MetricsAddr string         // TCP address Serve offers /metrics on, none if empty
+	AdminAddr   string         // TCP address Serve offers the read-only /admin on, none if empty, may equal MetricsAddr
+	PeerKey     []byte         // shared by the nodes of the network, every RPC is authenticated when set, see Serve
+	ClientKey   []byte         // lets clients call ClientNode alone, only used together with PeerKey
+}
+
 func (pos *Node) Init(ip string) {
+	pos.InitWithConfig(ip, Config{})
+}
+
+func (pos *Node) InitWithConfig(ip string, cfg Config) {
 	pos.Ip = ip
 	pos.Id = *hashStr(ip) // generate id in a "random" way initialized by ip
 	pos.data.data = make(map[string]string)
 	pos.data.rem = make(map[string]int)
+	pos.metrics = newNodeMetrics(pos)
+	pos.metricsAddr = cfg.MetricsAddr
+	pos.adminAddr = cfg.AdminAddr
+	pos.keys = rpcpool.Keys{Peer: cfg.PeerKey, Client: cfg.ClientKey}
+	pos.pool = rpcpool.New(rpcpool.AuthDial(dialConn, rpcpool.RolePeer, cfg.PeerKey), rpcpool.Options{
+		Check:      checkClient,
+		Observe:    observer(pos.metrics.issued, pos.metrics.issuedSeconds),
+		DialFailed: func(string) { pos.metrics.dialFailures.Inc() },
+	})
+
+	pos.log = cfg.Logger
+	if pos.log == nil {
+		pos.log = dhtlog.Default()
+	}
+	pos.log = pos.log.With("node", pos.Ip).With("id", fmt.Sprintf("%040x", &pos.Id)[:8])
+}
+
+// warn logs err together with the operation and peer it carries.
+func (pos *Node) warn(err error) {
+	var e *dhterr.Error
+	if !errors.As(err, &e) {
+		pos.log.Warn("", err.Error())
+		return
+	}
+	var kv []interface{}
+	if e.Addr != "" {
+		kv = append(kv, "peer", e.Addr)
+	}
+	if e.Remote != "" {
+		kv = append(kv, "remote", e.Remote)
+	} else if e.Err != nil {
+		kv = append(kv, "cause", e.Err)
+	}
+	pos.log.Warn(e.Op, e.Kind.Error(), kv...)
+}
+
+// Listen opens the listener the RPC server of this node should accept on.
+// Closing it also drops the connections other nodes keep pooled to this node.
+func (pos *Node) Listen() (net.Listener, error) {
+	listen, err := net.Listen("tcp", pos.Ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpcpool.Track(listen), nil
+}
+
+// return pooled client to a given IP, nil when failed. Close gives it back to the pool.
+func (pos *Node) dial(ip string) *rpcpool.Client {
+	client, err := pos.pool.Get(ip)
+	if err != nil {
+		return nil
+	}
+	return client
 }
 
 func (pos *Node) Join(ip string) error {
-	if !pos.Ping(ip) {
-		fmt.Println("Error(-1):: Ping Error.")
-		return errors.New("error(-1):: Ping Error")
+	return pos.JoinContext(context.Background(), ip)
+}
+
+// JoinContext is Join giving up when ctx is done.
+func (pos *Node) JoinContext(ctx context.Context, ip string) error {
+	if !pos.pingContext(ctx, ip) {
+		err := dhterr.FromContext(ctx, "Join", ip, dhterr.ErrDial)
+		pos.warn(err)
+		return err
 	}
-	pos.route[DiffBit(&pos.Id, hashStr(ip))].push(Edge{ip, *hashStr(ip)}, Edge{pos.Ip, pos.Id})
+	pos.route[DiffBit(&pos.Id, hashStr(ip))].push(Edge{ip, *hashStr(ip)}, pos.Ping)
 
-	nodes := pos.NearestNode(&pos.Id)
+	nodes := pos.NearestNodeContext(ctx, &pos.Id)
 
 	for i := 0; i < BucketSize; i++ {
 		if nodes.Data[i].Ip != "" && nodes.Data[i].Ip != pos.Ip {
-			pos.route[DiffBit(&pos.Id, &nodes.Data[i].Id)].push(nodes.Data[i], Edge{pos.Ip, pos.Id})
+			pos.route[DiffBit(&pos.Id, &nodes.Data[i].Id)].push(nodes.Data[i], pos.Ping)
 		}
 	}
 
+	if err := ctx.Err(); err != nil {
+		err = dhterr.Wrap("Join", "", dhterr.ErrCanceled, err)
+		pos.warn(err)
+		return err
+	}
+	return nil
+}
+
+// Quit hands every key this node keeps to the closest other nodes, the routing tables of the network need no notice.
+// Keys no other node took are reported with ErrLookup.
+func (pos *Node) Quit() error {
+	return pos.QuitContext(context.Background())
+}
+
+// QuitContext is Quit giving up when ctx is done, the keys not handed over yet are left to their other copies.
+func (pos *Node) QuitContext(ctx context.Context) error {
+	pos.data.lock.Lock()
+	kvs := make([]KV, 0, len(pos.data.data))
+	for key, value := range pos.data.data {
+		kvs = append(kvs, KV{key, value})
+	}
+	pos.data.lock.Unlock()
+
+	keys := make([]string, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = kv.Key
+	}
+	handed := make([]bool, len(kvs))
+	for ip, idx := range pos.nearestGroups(ctx, keys) {
+		if ip == pos.Ip {
+			continue
+		}
+		args := BatchArgument{Data: make([]KV, len(idx))} // no initiator, the node is leaving
+		for k, i := range idx {
+			args.Data[k] = kvs[i]
+		}
+		if pos.callBatch(ctx, "Quit", ip, "RPCNode.StoreBatch", &args, nil) == nil {
+			for _, i := range idx {
+				handed[i] = true
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		err = dhterr.Wrap("Quit", "", dhterr.ErrCanceled, err)
+		pos.warn(err)
+		return err
+	}
+	for i := range kvs {
+		if !handed[i] {
+			err := dhterr.New("Quit", "", dhterr.ErrLookup)
+			pos.warn(err)
+			return err
+		}
+	}
 	return nil
 }
 
 func (pos *Node) Ping(ip string) bool {
-	return Ping(Edge{pos.Ip, pos.Id}, ip)
+	return pos.pingContext(context.Background(), ip)
+}
+
+func (pos *Node) pingContext(ctx context.Context, ip string) bool {
+	client := pos.dialContext(ctx, ip)
+	if client == nil {
+		return false
+	}
+	err := client.CallContext(ctx, "RPCNode.Ping", &PingArgument{Edge{pos.Ip, pos.Id}}, nil)
+	_ = client.Close()
+	if _, ok := err.(rpc.ServerError); err != nil && !ok { // connection is gone, or the call was given up
+		if ctx.Err() == nil {
+			pos.pool.Invalidate(ip)
+		}
+		return false
+	}
+	return true
 }
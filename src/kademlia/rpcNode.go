@@ -1,12 +1,13 @@
 package kademlia
 
 import (
+	"dhterr"
 	"math/big"
 	"net"
+	"time"
 )
 
-// we assert the network is safe, so do not return ip and id.
-
+// RPCNode is the service the nodes of the network call each other on, with Config.PeerKey set only they may.
 type RPCNode struct {
 	Data *Node
 
@@ -42,10 +43,13 @@ func (pos *RPCNode) RePublish(arg *StoreArgument, _ *int) error {
 type FindNodeArgument struct {
 	Id        big.Int
 	Initiator Edge
+	Budget    time.Duration // what is left of the initiator's deadline, 0 for none
 }
 
 func (pos *RPCNode) FindNode(arg *FindNodeArgument, ret *RetBucketSmall) error {
-	*ret = pos.Data.FindNode(&arg.Id)
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	*ret = pos.Data.findNode(ctx, &arg.Id)
 	pos.Data.pushNode(arg.Initiator)
 	return nil
 }
@@ -54,10 +58,107 @@ type FindValueArgument struct {
 	Key       string
 	Id        big.Int
 	Initiator Edge
+	Budget    time.Duration // what is left of the initiator's deadline, 0 for none
 }
 
 func (pos *RPCNode) FindValue(arg *FindValueArgument, ret *RetBucketValue) error {
-	*ret = pos.Data.FindValue(&arg.Id, arg.Key)
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	*ret = pos.Data.findValue(ctx, &arg.Id, arg.Key)
+	pos.Data.pushNode(arg.Initiator)
+	return nil
+}
+
+func (pos *RPCNode) StoreBatch(arg *BatchArgument, _ *int) error {
+	for _, kv := range arg.Data {
+		pos.Data.data.insert(kv)
+	}
 	pos.Data.pushNode(arg.Initiator)
 	return nil
 }
+
+func (pos *RPCNode) FindValueBatch(arg *KeysArgument, ret *BatchValue) error {
+	ret.Vals = make([]string, len(arg.Keys))
+	ret.Found = make([]bool, len(arg.Keys))
+	for i, key := range arg.Keys {
+		if pos.Data.data.hasKey(key) {
+			ret.Vals[i] = pos.Data.data.query(key)
+			ret.Found[i] = true
+		}
+	}
+	pos.Data.pushNode(arg.Initiator)
+	return nil
+}
+
+func (pos *RPCNode) DeleteBatch(arg *KeysArgument, ret *[]bool) error {
+	*ret = make([]bool, len(arg.Keys))
+	for i, key := range arg.Keys {
+		(*ret)[i] = pos.Data.data.remove(key)
+	}
+	pos.Data.pushNode(arg.Initiator)
+	return nil
+}
+
+// ClientNode is the service clients outside the network call, the node reached runs the operation on their behalf.
+// It is registered next to RPCNode, with Config.ClientKey set it is the only service a client may call.
+type ClientNode struct {
+	Data *Node
+}
+
+// ClientArgument carries the request of a client, Val is only read by Put.
+// Budget is what is left of the client's deadline, 0 for none.
+type ClientArgument struct {
+	Key    string
+	Val    string
+	Budget time.Duration
+}
+
+func (pos *ClientNode) Put(arg *ClientArgument, _ *int) error {
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	pos.Data.StoreContext(ctx, KV{arg.Key, arg.Val})
+	if err := ctx.Err(); err != nil {
+		return dhterr.Wrap("Put", "", dhterr.ErrCanceled, err)
+	}
+	return nil
+}
+
+func (pos *ClientNode) Get(arg *ClientArgument, ret *string) error {
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	ok, val := pos.Data.QueryContext(ctx, arg.Key)
+	if !ok {
+		return dhterr.FromContext(ctx, "Get", "", dhterr.ErrNotFound)
+	}
+	*ret = val
+	return nil
+}
+
+func (pos *ClientNode) Delete(arg *ClientArgument, _ *int) error {
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	return pos.Data.MultiDeleteContext(ctx, []string{arg.Key})[0]
+}
+
+// Lookup traces the lookup of the nodes closest to arg.Key, they are ret.Result.
+func (pos *ClientNode) Lookup(arg *ClientArgument, ret *LookupTrace) error {
+	ctx, cancel := withBudget(arg.Budget)
+	defer cancel()
+	*ret = pos.Data.TraceKeyContext(ctx, arg.Key)
+	return nil
+}
+
+func (pos *ClientNode) Ping(_ int, _ *int) error {
+	return nil
+}
+
+// Info is RPCNode.Info for clients, the view it gives is read-only.
+func (pos *ClientNode) Info(_ int, ret *NodeInfo) error {
+	*ret = pos.Data.Inspect()
+	return nil
+}
+
+func (pos *RPCNode) Info(_ int, ret *NodeInfo) error {
+	*ret = pos.Data.Inspect()
+	return nil
+}
@@ -0,0 +1,85 @@
+package kademlia
+
+import (
+	"context"
+	"math/big"
+	"time"
+)
+
+// Hop is one node asked during a lookup.
+type Hop struct {
+	Node     Edge
+	Latency  time.Duration
+	Err      string // why the hop failed, empty when it answered
+	Improved bool   // the answer held a node closer to the target than any known before
+}
+
+// LookupTrace is the path a lookup took, the node the lookup started at comes first.
+type LookupTrace struct {
+	Hops   []Hop
+	Result RetBucket
+}
+
+// HopCount is the number of nodes that answered, not counting the one the lookup started at.
+func (pos *LookupTrace) HopCount() int {
+	ret := 0
+	for i, x := range pos.Hops {
+		if i > 0 && x.Err == "" {
+			ret++
+		}
+	}
+	return ret
+}
+
+// Converged is the number of hops until the closest node was known, the rest only confirm it.
+func (pos *LookupTrace) Converged() int {
+	ret := 0
+	for i, x := range pos.Hops {
+		if x.Improved {
+			ret = i
+		}
+	}
+	return ret
+}
+
+// Failures lists the hops that did not answer.
+func (pos *LookupTrace) Failures() []Hop {
+	var ret []Hop
+	for _, x := range pos.Hops {
+		if x.Err != "" {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// Latency is the time the whole lookup took.
+func (pos *LookupTrace) Latency() time.Duration {
+	var ret time.Duration
+	for _, x := range pos.Hops {
+		ret += x.Latency
+	}
+	return ret
+}
+
+// TraceNearestNode is NearestNode that also records every node asked.
+func (pos *Node) TraceNearestNode(id *big.Int) LookupTrace {
+	return pos.TraceNearestNodeContext(context.Background(), id)
+}
+
+// TraceNearestNodeContext is TraceNearestNode giving up when ctx is done.
+func (pos *Node) TraceNearestNodeContext(ctx context.Context, id *big.Int) LookupTrace {
+	var ret LookupTrace
+	ret.Result = pos.nearestNode(ctx, id, &ret)
+	return ret
+}
+
+// TraceKey traces the lookup of the nodes storing key.
+func (pos *Node) TraceKey(key string) LookupTrace {
+	return pos.TraceNearestNodeContext(context.Background(), hashStr(key))
+}
+
+// TraceKeyContext is TraceKey giving up when ctx is done.
+func (pos *Node) TraceKeyContext(ctx context.Context, key string) LookupTrace {
+	return pos.TraceNearestNodeContext(ctx, hashStr(key))
+}
@@ -3,6 +3,7 @@ package kademlia
 import (
 	"crypto/sha1"
 	"math/big"
+	"net"
 	"net/rpc"
 	"time"
 )
@@ -27,17 +28,35 @@ func hashStr(s string) *big.Int {
 }
 
 func Dial(ip string) *rpc.Client {
+	client, _ := dialTCP(ip)
+	return client
+}
+
+func dialTCP(ip string) (*rpc.Client, error) {
+	conn, err := dialConn(ip)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func dialConn(ip string) (net.Conn, error) {
 	var err error
-	var client *rpc.Client
+	var conn net.Conn
 	for i := 1; i <= tryTime; i++ {
-		client, err = rpc.Dial("tcp", ip)
+		conn, err = net.Dial("tcp", ip)
 		if err != nil {
 			time.Sleep(waitTime)
 		} else {
-			return client
+			return conn, nil
 		}
 	}
-	return nil
+	return nil, err
+}
+
+// checkClient is the health check used on pooled clients, the empty initiator keeps it out of the routing table.
+func checkClient(client *rpc.Client) error {
+	return client.Call("RPCNode.Ping", &PingArgument{}, nil)
 }
 
 func Ping(Initiator Edge, ip string) bool {
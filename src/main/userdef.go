@@ -2,17 +2,21 @@ package main
 
 import (
 	"chord"
+	"dhtlog"
 	"fmt"
-	"net"
+	"hops"
 	"net/rpc"
 	"strconv"
+	"time"
 )
 
+var logger = dhtlog.Default()
+
 func NewNode(port int) dhtNode {
 	var ret DHTNode
 	ret.Data = new(chord.RPCNode)
 	ret.Data.Data = new(chord.Node)
-	ret.Data.Data.Init(":" + strconv.Itoa(port))
+	ret.Data.Data.InitWithConfig(":"+strconv.Itoa(port), chord.Config{Logger: logger})
 	ret.Server = rpc.NewServer()
 	err := ret.Server.Register(ret.Data)
 
@@ -30,16 +34,16 @@ type DHTNode struct {
 }
 
 func (pos *DHTNode) Run() {
-	listen, err := net.Listen("tcp", pos.Data.Data.Ip)
+	listen, err := pos.Data.Data.Listen()
 	if err != nil {
 		fmt.Println("Error(4):: Failed to Listen.", err)
 		return
 	}
 
 	pos.Data.Listen = listen
-	pos.Data.Data.On = true
+	pos.Data.Data.On.Store(true)
 
-	go pos.Server.Accept(listen)
+	go pos.Data.Data.Serve(pos.Server, listen)
 	go pos.Data.Data.Maintain()
 }
 
@@ -52,10 +56,10 @@ func (pos *DHTNode) Join(ip string) bool {
 }
 
 func (pos *DHTNode) Quit() {
-	if pos.Data.Data.On == false {
+	if !pos.Data.Data.On.Load() {
 		return
 	}
-	pos.Data.Data.On = false
+	pos.Data.Data.On.Store(false)
 	_ = pos.Data.Data.Quit()
 	err := pos.Data.Listen.Close()
 	if err != nil {
@@ -64,10 +68,10 @@ func (pos *DHTNode) Quit() {
 }
 
 func (pos *DHTNode) ForceQuit() {
-	if pos.Data.Data.On == false {
+	if !pos.Data.Data.On.Load() {
 		return
 	}
-	pos.Data.Data.On = false
+	pos.Data.Data.On.Store(false)
 	// pos.Data.Data.PrintLink()
 	err := pos.Data.Listen.Close()
 	if err != nil {
@@ -76,7 +80,7 @@ func (pos *DHTNode) ForceQuit() {
 }
 
 func (pos *DHTNode) Ping(addr string) bool {
-	return chord.Ping(addr) == nil
+	return pos.Data.Data.Ping(addr) == nil
 }
 
 func (pos *DHTNode) Put(key string, value string) bool {
@@ -89,6 +93,50 @@ func (pos *DHTNode) Get(key string) (bool, string) {
 	return err == nil, ret
 }
 
+// GetVersion is Get that also reports which write the value comes from.
+func (pos *DHTNode) GetVersion(key string) (bool, string, chord.Version) {
+	var ret chord.Value
+	err := pos.Data.Data.QueryVersioned(key, &ret)
+	return err == nil, ret.Val, ret.Ver
+}
+
 func (pos *DHTNode) Delete(key string) bool {
 	return pos.Data.Data.EraseKey(key) == nil
 }
+
+// MultiPut, MultiGet and MultiDelete send one RPC per owner, ok[i] is the result of keys[i].
+func (pos *DHTNode) MultiPut(keys []string, values []string) []bool {
+	kvs := make([]chord.KeyValue, len(keys))
+	for i := range keys {
+		kvs[i] = chord.KeyValue{Key: keys[i], Val: values[i]}
+	}
+	return succeeded(pos.Data.Data.MultiPut(kvs))
+}
+
+func (pos *DHTNode) MultiGet(keys []string) ([]bool, []string) {
+	values, errs := pos.Data.Data.MultiGet(keys)
+	return succeeded(errs), values
+}
+
+func (pos *DHTNode) MultiDelete(keys []string) []bool {
+	return succeeded(pos.Data.Data.MultiDelete(keys))
+}
+
+// TraceLookup looks the owner of key up and reports the path taken.
+func (pos *DHTNode) TraceLookup(key string) (bool, hops.Trace) {
+	var trace chord.LookupTrace
+	err := pos.Data.Data.TraceKey(key, &trace)
+	ret := hops.Trace{Hops: trace.HopCount(), Failures: len(trace.Failures()), Latency: make([]time.Duration, len(trace.Hops))}
+	for i, x := range trace.Hops {
+		ret.Latency[i] = x.Latency
+	}
+	return err == nil, ret
+}
+
+func succeeded(errs []error) []bool {
+	ok := make([]bool, len(errs))
+	for i, err := range errs {
+		ok[i] = err == nil
+	}
+	return ok
+}
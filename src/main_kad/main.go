@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"hops"
 	"math/rand"
 	"runtime"
 	"time"
@@ -50,6 +51,7 @@ func main() {
 		// time.Sleep(sleepTime)
 	}
 	fmt.Print("ALL Nodes Joined\n")
+	fmt.Print("Hop Distribution\n", hops.Format(hops.Sample(nil, "", len(nodes), func(i int) interface{} { return nodes[i] })))
 
 	for T := 0; T < testGroup; T++ {
 		fmt.Print("Conducting Test Group: ", T+1, "\n")
@@ -2,10 +2,11 @@ package main
 
 import (
 	"fmt"
+	"hops"
 	"kademlia"
-	"net"
 	"net/rpc"
 	"strconv"
+	"time"
 )
 
 func NewNode(port int) dhtNode {
@@ -29,16 +30,16 @@ type DHTNode struct {
 }
 
 func (pos *DHTNode) Run() {
-	listen, err := net.Listen("tcp", pos.Data.Data.Ip)
+	listen, err := pos.Data.Data.Listen()
 	if err != nil {
 		fmt.Println("Error(4):: Failed to Listen.", err)
 		return
 	}
 
 	pos.Data.Listen = listen
-	pos.Data.Data.On = true
+	pos.Data.Data.On.Store(true)
 
-	go pos.Server.Accept(listen)
+	go pos.Data.Data.Serve(pos.Server, listen)
 	go pos.Data.Data.Maintain()
 }
 
@@ -54,10 +55,10 @@ func (pos *DHTNode) Quit() { // always do ForceQuit
 }
 
 func (pos *DHTNode) ForceQuit() {
-	if pos.Data.Data.On == false {
+	if !pos.Data.Data.On.Load() {
 		return
 	}
-	pos.Data.Data.On = false
+	pos.Data.Data.On.Store(false)
 	err := pos.Data.Listen.Close()
 	if err != nil {
 		fmt.Println("Error(4):: Failed to Close Listen.", err)
@@ -76,3 +77,39 @@ func (pos *DHTNode) Put(key string, value string) bool {
 func (pos *DHTNode) Get(key string) (bool, string) {
 	return pos.Data.Data.Query(key)
 }
+
+// MultiPut, MultiGet and MultiDelete send one RPC per node, ok[i] is the result of keys[i].
+func (pos *DHTNode) MultiPut(keys []string, values []string) []bool {
+	kvs := make([]kademlia.KV, len(keys))
+	for i := range keys {
+		kvs[i] = kademlia.KV{Key: keys[i], Value: values[i]}
+	}
+	return succeeded(pos.Data.Data.MultiPut(kvs))
+}
+
+func (pos *DHTNode) MultiGet(keys []string) ([]bool, []string) {
+	values, errs := pos.Data.Data.MultiGet(keys)
+	return succeeded(errs), values
+}
+
+func (pos *DHTNode) MultiDelete(keys []string) []bool {
+	return succeeded(pos.Data.Data.MultiDelete(keys))
+}
+
+// TraceLookup looks the nodes nearest to key up and reports the path taken.
+func (pos *DHTNode) TraceLookup(key string) (bool, hops.Trace) {
+	trace := pos.Data.Data.TraceKey(key)
+	ret := hops.Trace{Hops: trace.HopCount(), Failures: len(trace.Failures()), Latency: make([]time.Duration, len(trace.Hops))}
+	for i, x := range trace.Hops {
+		ret.Latency[i] = x.Latency
+	}
+	return trace.Result.Data[0].Ip != "", ret
+}
+
+func succeeded(errs []error) []bool {
+	ok := make([]bool, len(errs))
+	for i, err := range errs {
+		ok[i] = err == nil
+	}
+	return ok
+}
@@ -0,0 +1,165 @@
+package rpcpool
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// HandshakeTimeout bounds the handshake of an authenticated connection on both ends.
+const HandshakeTimeout = 5 * time.Second
+
+// Role is what the caller of an authenticated connection may do.
+type Role byte
+
+const (
+	RolePeer   Role = 1 // a node of the network or an operator, may call every service
+	RoleClient Role = 2 // a user of the network, may only call the client services, see ServeOptions
+)
+
+// Keys are the shared secrets a server knows its callers by, one per role.
+// Connections are not authenticated at all while Peer is empty, Client is only honoured together with Peer.
+type Keys struct {
+	Peer   []byte
+	Client []byte
+}
+
+func (pos Keys) enabled() bool {
+	return len(pos.Peer) > 0
+}
+
+func (pos Keys) of(role Role) []byte {
+	switch role {
+	case RolePeer:
+		return pos.Peer
+	case RoleClient:
+		return pos.Client
+	}
+	return nil
+}
+
+var (
+	ErrAuth       = errors.New("rpcpool: authentication failed")
+	errAuthServer = errors.New("rpcpool: server failed to authenticate")
+)
+
+const nonceLen = 16
+
+// The handshake proves both ends know the key of the role, which never crosses the wire:
+// the server sends a nonce, the client answers with its role, a nonce of its own and the MAC of both,
+// the server answers with a status byte and a MAC of its own over the same nonces.
+// Fresh nonces on both sides keep a recorded handshake from being replayed in either direction.
+func handshakeMAC(key []byte, label string, role Role, server []byte, client []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write([]byte{byte(role)})
+	h.Write(server)
+	h.Write(client)
+	return h.Sum(nil)
+}
+
+const (
+	statusOK     byte = 0
+	statusDenied byte = 1
+)
+
+// Authenticate runs the client side of the handshake on conn, which may carry RPCs afterwards.
+func Authenticate(conn net.Conn, role Role, key []byte) error {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	server := make([]byte, nonceLen)
+	if _, err := io.ReadFull(conn, server); err != nil {
+		return err
+	}
+	client := make([]byte, nonceLen)
+	if _, err := rand.Read(client); err != nil {
+		return err
+	}
+	msg := append([]byte{byte(role)}, client...)
+	msg = append(msg, handshakeMAC(key, "dht client", role, server, client)...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1+sha256.Size)
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return err
+	}
+	if reply[0] != statusOK {
+		return ErrAuth
+	}
+	if _, err := io.ReadFull(conn, reply[1:]); err != nil {
+		return err
+	}
+	if !hmac.Equal(reply[1:], handshakeMAC(key, "dht server", role, server, client)) {
+		return errAuthServer
+	}
+	return nil
+}
+
+// accept runs the server side of the handshake on conn and returns the role the caller proved.
+func accept(conn net.Conn, keys Keys) (Role, error) {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	server := make([]byte, nonceLen)
+	if _, err := rand.Read(server); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(server); err != nil {
+		return 0, err
+	}
+	msg := make([]byte, 1+nonceLen+sha256.Size)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return 0, err
+	}
+	role, client, mac := Role(msg[0]), msg[1:1+nonceLen], msg[1+nonceLen:]
+	key := keys.of(role)
+	if len(key) == 0 || bytes.Equal(client, server) || !hmac.Equal(mac, handshakeMAC(key, "dht client", role, server, client)) {
+		_, _ = conn.Write([]byte{statusDenied})
+		return 0, ErrAuth
+	}
+	reply := append([]byte{statusOK}, handshakeMAC(key, "dht server", role, server, client)...)
+	if _, err := conn.Write(reply); err != nil {
+		return 0, err
+	}
+	return role, nil
+}
+
+// ReadKey reads a key from path, surrounding whitespace is not part of it.
+func ReadKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, errors.New("rpcpool: key file " + path + " is empty")
+	}
+	return key, nil
+}
+
+// AuthDial is a DialFunc authenticating every connection dialConn opens as role, no key dials them as they are.
+func AuthDial(dialConn func(ip string) (net.Conn, error), role Role, key []byte) DialFunc {
+	return func(ip string) (*rpc.Client, error) {
+		conn, err := dialConn(ip)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) > 0 {
+			if err := Authenticate(conn, role, key); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+		return rpc.NewClient(conn), nil
+	}
+}
@@ -0,0 +1,67 @@
+package rpcpool
+
+import (
+	"net"
+	"sync"
+)
+
+// Track wraps l so that closing it also closes every connection it accepted.
+// Pooled clients of other nodes then see the node go away, exactly as a fresh dial would.
+func Track(l net.Listener) net.Listener {
+	return &listener{Listener: l, conns: make(map[net.Conn]struct{})}
+}
+
+type listener struct {
+	net.Listener
+
+	conns  map[net.Conn]struct{}
+	closed bool
+	lock   sync.Mutex
+}
+
+func (pos *listener) Accept() (net.Conn, error) {
+	conn, err := pos.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	if pos.closed {
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+	tc := &trackedConn{Conn: conn, owner: pos}
+	pos.conns[tc] = struct{}{}
+	return tc, nil
+}
+
+func (pos *listener) Close() error {
+	err := pos.Listener.Close()
+
+	pos.lock.Lock()
+	pos.closed = true
+	conns := pos.conns
+	pos.conns = make(map[net.Conn]struct{})
+	pos.lock.Unlock()
+
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	return err
+}
+
+type trackedConn struct {
+	net.Conn
+	owner *listener
+	once  sync.Once
+}
+
+func (pos *trackedConn) Close() error {
+	pos.once.Do(func() {
+		pos.owner.lock.Lock()
+		delete(pos.owner.conns, pos)
+		pos.owner.lock.Unlock()
+	})
+	return pos.Conn.Close()
+}
@@ -0,0 +1,289 @@
+package rpcpool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdleTimeout = 30 * time.Second
+	DefaultCheckAfter  = 5 * time.Second
+)
+
+type DialFunc func(ip string) (*rpc.Client, error)
+
+type Options struct {
+	IdleTimeout time.Duration           // unused clients older than this are closed
+	CheckAfter  time.Duration           // clients idle longer than this are checked before reuse
+	Check       func(*rpc.Client) error // nil to skip health checks
+	Observe     ObserveFunc             // called after every call, nil to skip
+	DialFailed  func(ip string)         // called when a dial fails, nil to skip
+}
+
+// ObserveFunc learns the method, duration and error of one call.
+type ObserveFunc func(method string, elapsed time.Duration, err error)
+
+// Pool keeps one rpc.Client per peer. rpc.Client is safe for concurrent use,
+// so every caller shares it instead of dialing on each call.
+type Pool struct {
+	dial DialFunc
+	opt  Options
+
+	clients   map[string]*entry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type entry struct {
+	client   *rpc.Client
+	lastUsed time.Time
+	refs     int
+}
+
+func New(dial DialFunc, opt Options) *Pool {
+	if opt.IdleTimeout <= 0 {
+		opt.IdleTimeout = DefaultIdleTimeout
+	}
+	if opt.CheckAfter <= 0 {
+		opt.CheckAfter = DefaultCheckAfter
+	}
+	return &Pool{
+		dial:      dial,
+		opt:       opt,
+		clients:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns a client to ip, dialing when there is none. Close it when done.
+func (pos *Pool) Get(ip string) (*Client, error) {
+	c, err := pos.acquire(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{pool: pos, ip: ip, c: c}, nil
+}
+
+// GetContext is Get giving up when ctx is done. A dial still running then goes on in the background,
+// its client is kept for the next Get.
+func (pos *Pool) GetContext(ctx context.Context, ip string) (*Client, error) {
+	if ctx.Done() == nil {
+		return pos.Get(ip)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		c   *rpc.Client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := pos.acquire(ip)
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &Client{pool: pos, ip: ip, c: r.c}, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				pos.release(ip, r.c)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Invalidate drops the client to ip, the next Get dials again.
+func (pos *Pool) Invalidate(ip string) {
+	pos.lock.Lock()
+	e, ok := pos.clients[ip]
+	if ok {
+		delete(pos.clients, ip)
+	}
+	pos.lock.Unlock()
+
+	if ok {
+		_ = e.client.Close()
+	}
+}
+
+// Close drops every client in the pool.
+func (pos *Pool) Close() {
+	pos.lock.Lock()
+	old := pos.clients
+	pos.clients = make(map[string]*entry)
+	pos.lock.Unlock()
+
+	for _, e := range old {
+		_ = e.client.Close()
+	}
+}
+
+func (pos *Pool) acquire(ip string) (*rpc.Client, error) {
+	pos.sweep()
+
+	pos.lock.Lock()
+	e, ok := pos.clients[ip]
+	if ok {
+		e.refs++
+		stale := time.Since(e.lastUsed) > pos.opt.CheckAfter
+		pos.lock.Unlock()
+
+		if !stale || pos.opt.Check == nil || pos.opt.Check(e.client) == nil {
+			return e.client, nil
+		}
+		pos.release(ip, e.client)
+		pos.invalidateClient(ip, e.client)
+	} else {
+		pos.lock.Unlock()
+	}
+
+	c, err := pos.dial(ip)
+	if err != nil {
+		if pos.opt.DialFailed != nil {
+			pos.opt.DialFailed(ip)
+		}
+		return nil, err
+	}
+
+	pos.lock.Lock()
+	if e, ok := pos.clients[ip]; ok { // someone else dialed meanwhile
+		e.refs++
+		pos.lock.Unlock()
+		_ = c.Close()
+		return e.client, nil
+	}
+	pos.clients[ip] = &entry{client: c, lastUsed: time.Now(), refs: 1}
+	pos.lock.Unlock()
+	return c, nil
+}
+
+func (pos *Pool) release(ip string, c *rpc.Client) {
+	pos.lock.Lock()
+	if e, ok := pos.clients[ip]; ok && e.client == c {
+		e.refs--
+		e.lastUsed = time.Now()
+	}
+	pos.lock.Unlock()
+}
+
+func (pos *Pool) invalidateClient(ip string, c *rpc.Client) {
+	pos.lock.Lock()
+	if e, ok := pos.clients[ip]; ok && e.client == c {
+		delete(pos.clients, ip)
+	}
+	pos.lock.Unlock()
+	_ = c.Close()
+}
+
+// sweep closes clients nobody used for IdleTimeout, at most twice per IdleTimeout.
+func (pos *Pool) sweep() {
+	var idle []*rpc.Client
+
+	pos.lock.Lock()
+	now := time.Now()
+	if now.Sub(pos.lastSweep) < pos.opt.IdleTimeout/2 {
+		pos.lock.Unlock()
+		return
+	}
+	pos.lastSweep = now
+	for ip, e := range pos.clients {
+		if e.refs == 0 && now.Sub(e.lastUsed) > pos.opt.IdleTimeout {
+			idle = append(idle, e.client)
+			delete(pos.clients, ip)
+		}
+	}
+	pos.lock.Unlock()
+
+	for _, c := range idle {
+		_ = c.Close()
+	}
+}
+
+// Client is a pooled rpc.Client. Close gives it back to the pool instead of closing the connection.
+type Client struct {
+	pool   *Pool
+	ip     string
+	c      *rpc.Client
+	closed bool
+}
+
+// Call behaves like rpc.Client.Call. A connection found dead before the request
+// was sent is dropped and the call is tried once more on a fresh one.
+func (pos *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return pos.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is Call giving up when ctx is done. The reply may still be written after that, so it must not be reused.
+func (pos *Client) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	if pos.pool.opt.Observe == nil {
+		return pos.callRetry(ctx, serviceMethod, args, reply)
+	}
+	start := time.Now()
+	err := pos.callRetry(ctx, serviceMethod, args, reply)
+	pos.pool.opt.Observe(serviceMethod, time.Since(start), err)
+	return err
+}
+
+func (pos *Client) callRetry(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	err := pos.call(ctx, serviceMethod, args, reply)
+	if !broken(err) {
+		return err
+	}
+
+	pos.pool.release(pos.ip, pos.c)
+	pos.pool.invalidateClient(pos.ip, pos.c)
+	if err != rpc.ErrShutdown {
+		pos.closed = true
+		return err
+	}
+
+	c, dialErr := pos.pool.acquire(pos.ip)
+	if dialErr != nil {
+		pos.closed = true
+		return err
+	}
+	pos.c = c
+	return pos.call(ctx, serviceMethod, args, reply)
+}
+
+func (pos *Client) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	if ctx.Done() == nil {
+		return pos.c.Call(serviceMethod, args, reply)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Go itself may block on a peer that stopped reading
+	done := make(chan *rpc.Call, 1)
+	go pos.c.Go(serviceMethod, args, reply, done)
+	select {
+	case call := <-done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (pos *Client) Close() error {
+	if !pos.closed {
+		pos.closed = true
+		pos.pool.release(pos.ip, pos.c)
+	}
+	return nil
+}
+
+func broken(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,351 @@
+package rpcpool
+
+import (
+	"crypto/sha256"
+	"dhterr"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Echo struct{}
+
+func (pos *Echo) Say(arg string, ret *string) error {
+	*ret = arg
+	return nil
+}
+
+// Hang answers after a while, long enough for a test to break the connection under it.
+func (pos *Echo) Hang(arg string, ret *string) error {
+	time.Sleep(200 * time.Millisecond)
+	*ret = arg
+	return nil
+}
+
+type Admin struct{}
+
+func (pos *Admin) Say(arg string, ret *string) error {
+	*ret = arg
+	return nil
+}
+
+// testServer serves Echo and Admin on a local port until the test ends, with opt when it is given.
+func testServer(t *testing.T, opt *ServeOptions) string {
+	server := rpc.NewServer()
+	if err := server.Register(&Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(&Admin{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	if opt == nil {
+		go server.Accept(l)
+	} else {
+		go ServeWith(server, l, *opt)
+	}
+	return l.Addr().String()
+}
+
+// countingDial dials plain TCP and remembers every client it made.
+type countingDial struct {
+	clients []*rpc.Client
+	lock    sync.Mutex
+}
+
+func (pos *countingDial) dial(ip string) (*rpc.Client, error) {
+	c, err := rpc.Dial("tcp", ip)
+	if err != nil {
+		return nil, err
+	}
+	pos.lock.Lock()
+	pos.clients = append(pos.clients, c)
+	pos.lock.Unlock()
+	return c, nil
+}
+
+func (pos *countingDial) count() int {
+	pos.lock.Lock()
+	defer pos.lock.Unlock()
+	return len(pos.clients)
+}
+
+func say(t *testing.T, pool *Pool, ip string) {
+	t.Helper()
+	client, err := pool.Get(ip)
+	if err != nil {
+		t.Fatalf("get %s: %v", ip, err)
+	}
+	var ret string
+	err = client.Call("Echo.Say", "hi", &ret)
+	_ = client.Close()
+	if err != nil || ret != "hi" {
+		t.Fatalf("call: got %q, %v, want %q", ret, err, "hi")
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	ip := testServer(t, nil)
+	d := &countingDial{}
+	pool := New(d.dial, Options{})
+	defer pool.Close()
+
+	for i := 0; i < 10; i++ {
+		say(t, pool, ip)
+	}
+	if d.count() != 1 {
+		t.Errorf("dialed %d times, want 1", d.count())
+	}
+}
+
+func TestPoolIdleEviction(t *testing.T) {
+	ip := testServer(t, nil)
+	d := &countingDial{}
+	pool := New(d.dial, Options{IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	say(t, pool, ip)
+	time.Sleep(100 * time.Millisecond)
+	say(t, pool, ip)
+	if d.count() != 2 {
+		t.Fatalf("dialed %d times, want 2", d.count())
+	}
+	if err := d.clients[0].Call("Echo.Say", "hi", new(string)); err != rpc.ErrShutdown {
+		t.Errorf("evicted client: got %v, want %v", err, rpc.ErrShutdown)
+	}
+
+	// a client in use is never evicted
+	client, err := pool.Get(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	say(t, pool, ip)
+	_ = client.Close()
+	if d.count() != 2 {
+		t.Errorf("dialed %d times, want 2", d.count())
+	}
+}
+
+func TestPoolCheckBeforeReuse(t *testing.T) {
+	ip := testServer(t, nil)
+	d := &countingDial{}
+	var checks int
+	var healthy bool
+	pool := New(d.dial, Options{
+		CheckAfter: 50 * time.Millisecond,
+		Check: func(c *rpc.Client) error {
+			checks++
+			if !healthy {
+				return errors.New("unhealthy")
+			}
+			return c.Call("Echo.Say", "ping", new(string))
+		},
+	})
+	defer pool.Close()
+
+	say(t, pool, ip)
+	say(t, pool, ip)
+	if checks != 0 {
+		t.Fatalf("checked %d times a client used just now, want 0", checks)
+	}
+
+	healthy = true
+	time.Sleep(100 * time.Millisecond)
+	say(t, pool, ip)
+	if checks != 1 || d.count() != 1 {
+		t.Fatalf("healthy client: checked %d times, dialed %d times, want 1, 1", checks, d.count())
+	}
+
+	healthy = false
+	time.Sleep(100 * time.Millisecond)
+	say(t, pool, ip)
+	if checks != 2 || d.count() != 2 {
+		t.Fatalf("failed check: checked %d times, dialed %d times, want 2, 2", checks, d.count())
+	}
+	if err := d.clients[0].Call("Echo.Say", "hi", new(string)); err != rpc.ErrShutdown {
+		t.Errorf("client failing its check: got %v, want %v", err, rpc.ErrShutdown)
+	}
+}
+
+func TestPoolInvalidateOnCallError(t *testing.T) {
+	ip := testServer(t, nil)
+	d := &countingDial{}
+	pool := New(d.dial, Options{})
+	defer pool.Close()
+
+	// found shut down before the request was sent, the call is tried again on a fresh client
+	say(t, pool, ip)
+	_ = d.clients[0].Close()
+	say(t, pool, ip)
+	if d.count() != 2 {
+		t.Fatalf("dialed %d times, want 2", d.count())
+	}
+
+	// the connection breaks under the call, it fails and the next Get dials again
+	server := rpc.NewServer()
+	if err := server.Register(&Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go server.ServeConn(conn)
+		}
+	}()
+	ip = l.Addr().String()
+	d = &countingDial{}
+	pool = New(d.dial, Options{})
+	defer pool.Close()
+
+	client, err := pool.Get(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn := <-conns
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	err = client.Call("Echo.Hang", "hi", new(string))
+	_ = client.Close()
+	if !broken(err) || err == rpc.ErrShutdown {
+		t.Fatalf("call on a broken connection: got %v, want it to fail with the connection", err)
+	}
+	say(t, pool, ip)
+	if d.count() != 2 {
+		t.Errorf("dialed %d times, want 2", d.count())
+	}
+}
+
+func TestPoolInvalidate(t *testing.T) {
+	ip := testServer(t, nil)
+	d := &countingDial{}
+	pool := New(d.dial, Options{})
+	defer pool.Close()
+
+	say(t, pool, ip)
+	pool.Invalidate(ip)
+	say(t, pool, ip)
+	if d.count() != 2 {
+		t.Errorf("dialed %d times, want 2", d.count())
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	rejected := make(chan error, 16)
+	keys := Keys{Peer: []byte("peer key"), Client: []byte("client key")}
+	ip := testServer(t, &ServeOptions{
+		Keys:     keys,
+		Client:   []string{"Echo"},
+		Rejected: func(_ string, err error) { rejected <- err },
+	})
+	dial := func(ip string) (net.Conn, error) { return net.Dial("tcp", ip) }
+	call := func(role Role, key []byte, method string) error {
+		client, err := AuthDial(dial, role, key)(ip)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		var ret string
+		if err := client.Call(method, "hi", &ret); err != nil {
+			return err
+		}
+		if ret != "hi" {
+			t.Errorf("%s: got %q, want %q", method, ret, "hi")
+		}
+		return nil
+	}
+
+	for _, method := range []string{"Echo.Say", "Admin.Say"} {
+		if err := call(RolePeer, keys.Peer, method); err != nil {
+			t.Errorf("peer %s: %v", method, err)
+		}
+	}
+	if err := call(RoleClient, keys.Client, "Echo.Say"); err != nil {
+		t.Errorf("client Echo.Say: %v", err)
+	}
+	if err := call(RoleClient, keys.Client, "Admin.Say"); !errors.Is(dhterr.FromRPC("Admin.Say", ip, err), dhterr.ErrDenied) {
+		t.Errorf("client Admin.Say: got %v, want %v", err, dhterr.ErrDenied)
+	}
+	if err := <-rejected; !errors.Is(err, dhterr.ErrDenied) {
+		t.Errorf("rejected client Admin.Say: got %v, want %v", err, dhterr.ErrDenied)
+	}
+
+	// wrong keys, a key of the other role and no handshake at all are turned away
+	for _, c := range []struct {
+		role Role
+		key  []byte
+	}{
+		{RolePeer, []byte("guess")},
+		{RoleClient, []byte("guess")},
+		{RolePeer, keys.Client},
+		{RoleClient, keys.Peer},
+		{Role(7), keys.Peer},
+	} {
+		if err := call(c.role, c.key, "Echo.Say"); err != ErrAuth {
+			t.Errorf("role %d with key %q: got %v, want %v", c.role, c.key, err, ErrAuth)
+		}
+		select {
+		case err := <-rejected:
+			if err != ErrAuth {
+				t.Errorf("rejected role %d with key %q: got %v, want %v", c.role, c.key, err, ErrAuth)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("role %d with key %q was not reported", c.role, c.key)
+		}
+	}
+	if err := call(RolePeer, nil, "Echo.Say"); err == nil {
+		t.Errorf("unauthenticated call: got nil, want an error")
+	}
+}
+
+func TestAuthenticateServer(t *testing.T) {
+	// a server not knowing the key can not pass for the real one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write(make([]byte, nonceLen)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 1+nonceLen+sha256.Size)); err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte{statusOK}, make([]byte, sha256.Size)...))
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Authenticate(conn, RolePeer, []byte("peer key")); err != errAuthServer {
+		t.Errorf("got %v, want %v", err, errAuthServer)
+	}
+}
@@ -0,0 +1,170 @@
+package rpcpool
+
+import (
+	"bufio"
+	"dhterr"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve is rpc.Server.Accept that calls observe after every request served, it returns when l is closed.
+// A nil observe serves exactly like Accept.
+func Serve(server *rpc.Server, l net.Listener, observe ObserveFunc) {
+	ServeWith(server, l, ServeOptions{Observe: observe})
+}
+
+type ServeOptions struct {
+	Observe  ObserveFunc                  // called after every request served, nil to skip
+	Keys     Keys                         // callers must authenticate with one of these, see Authenticate
+	Client   []string                     // services RoleClient may call, RolePeer may call every one
+	Rejected func(addr string, err error) // called when a caller fails to authenticate or calls what its role may not
+}
+
+// ServeWith is Serve checking every connection against opt.Keys first when they are set.
+// Requests a client is not allowed to send are answered with dhterr.ErrDenied and never reach server.
+func ServeWith(server *rpc.Server, l net.Listener, opt ServeOptions) {
+	if opt.Observe == nil && !opt.Keys.enabled() {
+		server.Accept(l)
+		return
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go serveConn(server, conn, opt)
+	}
+}
+
+func serveConn(server *rpc.Server, conn net.Conn, opt ServeOptions) {
+	role := RolePeer
+	if opt.Keys.enabled() {
+		var err error
+		if role, err = accept(conn, opt.Keys); err != nil {
+			if opt.Rejected != nil {
+				opt.Rejected(conn.RemoteAddr().String(), err)
+			}
+			_ = conn.Close()
+			return
+		}
+	}
+	codec := newObservedCodec(conn, opt.Observe)
+	if role != RolePeer {
+		codec.allowed = make(map[string]bool, len(opt.Client))
+		for _, x := range opt.Client {
+			codec.allowed[x] = true
+		}
+		codec.denied = make(map[uint64]string)
+		codec.rejected = func(err error) {
+			if opt.Rejected != nil {
+				opt.Rejected(conn.RemoteAddr().String(), err)
+			}
+		}
+	}
+	server.ServeCodec(codec)
+}
+
+// observedCodec is the gob codec of net/rpc timing every request from its header to its response.
+// With allowed set, requests to other services are turned away before server looks at them.
+type observedCodec struct {
+	rwc     io.ReadWriteCloser
+	dec     *gob.Decoder
+	enc     *gob.Encoder
+	encBuf  *bufio.Writer
+	closed  bool
+	observe ObserveFunc
+
+	allowed  map[string]bool   // services the caller may use, nil for all
+	denied   map[uint64]string // seq -> method of a request turned away
+	rejected func(err error)
+
+	started map[uint64]time.Time // seq -> time its header was read
+	lock    sync.Mutex
+}
+
+func newObservedCodec(conn io.ReadWriteCloser, observe ObserveFunc) *observedCodec {
+	buf := bufio.NewWriter(conn)
+	return &observedCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		observe: observe,
+		started: make(map[uint64]time.Time),
+	}
+}
+
+func (pos *observedCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := pos.dec.Decode(r); err != nil {
+		return err
+	}
+	pos.lock.Lock()
+	pos.started[r.Seq] = time.Now()
+	if pos.allowed != nil && !pos.allowed[service(r.ServiceMethod)] {
+		// an ill-formed method makes server discard the body and answer an error, see WriteResponse
+		pos.denied[r.Seq] = r.ServiceMethod
+		r.ServiceMethod = ""
+	}
+	pos.lock.Unlock()
+	return nil
+}
+
+func service(method string) string {
+	if dot := strings.LastIndex(method, "."); dot >= 0 {
+		return method[:dot]
+	}
+	return method
+}
+
+func (pos *observedCodec) ReadRequestBody(body interface{}) error {
+	return pos.dec.Decode(body)
+}
+
+func (pos *observedCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	pos.lock.Lock()
+	start, ok := pos.started[r.Seq]
+	delete(pos.started, r.Seq)
+	method, denied := pos.denied[r.Seq]
+	delete(pos.denied, r.Seq)
+	pos.lock.Unlock()
+	if denied {
+		err := dhterr.New(method, "", dhterr.ErrDenied)
+		r.ServiceMethod, r.Error = method, err.Error()
+		pos.rejected(err)
+	}
+	if ok && pos.observe != nil {
+		var failed error
+		if r.Error != "" {
+			failed = rpc.ServerError(r.Error)
+		}
+		pos.observe(r.ServiceMethod, time.Since(start), failed)
+	}
+
+	if err = pos.enc.Encode(r); err != nil {
+		if pos.encBuf.Flush() == nil {
+			// gob could not encode the header, the connection can not go on
+			_ = pos.Close()
+		}
+		return
+	}
+	if err = pos.enc.Encode(body); err != nil {
+		if pos.encBuf.Flush() == nil {
+			_ = pos.Close()
+		}
+		return
+	}
+	return pos.encBuf.Flush()
+}
+
+func (pos *observedCodec) Close() error {
+	if pos.closed {
+		return nil
+	}
+	pos.closed = true
+	return pos.rwc.Close()
+}